@@ -2,64 +2,110 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
+	"net"
 	"net/http"
-	"os"
 	"time"
 
+	"github.com/Kaamos-Comms/server/internal/config"
 	"github.com/Kaamos-Comms/server/internal/middleware"
+	"github.com/Kaamos-Comms/server/internal/relay"
 	"github.com/Kaamos-Comms/server/internal/signaling"
 	"github.com/labstack/echo/v4"
 	echomiddleware "github.com/labstack/echo/v4/middleware"
+	"github.com/pion/webrtc/v4"
 	"golang.org/x/time/rate"
 )
 
-var defaultPort = "8080"
-
 type App struct {
 	e               *echo.Echo
 	signalingServer *signaling.Server
-	port            string
+	roomStore       signaling.RoomStore
+	relayServer     *relay.Server
+	webrtcAPI       *signaling.WebRTCAPI
+	config          *config.Config
 }
 
-func Initialize() *App {
+func Initialize(cfg *config.Config) *App {
+	roomStore, err := newRoomStore(cfg.Rooms)
+	if err != nil {
+		log.Fatalf("Room store initialization failed: %v", err)
+	}
+
+	webrtcAPI, err := signaling.NewWebRTCAPI(iceNetworkConfig(cfg.WebRTC.ICE), bandwidthEstimationConfig(cfg.WebRTC.BandwidthEstimation))
+	if err != nil {
+		log.Fatalf("WebRTC initialization failed: %v", err)
+	}
+
+	signalingCfg := signalingConfig(cfg)
+	signalingCfg.API = webrtcAPI
+	var relayCfg *relay.Config
+	if cfg.WebRTC.TURNServer.Enabled {
+		relayCfg = embeddedTURNConfig(cfg)
+		signalingCfg.TURN.Secret = relayCfg.Secret
+		if len(signalingCfg.TURN.URLs) == 0 {
+			signalingCfg.TURN.URLs = relayCfg.URLs()
+		}
+	}
+
+	signalingServer, err := signaling.NewServerWithConfig(signalingCfg, roomStore)
+	if err != nil {
+		log.Fatalf("Signaling server initialization failed: %v", err)
+	}
+
 	app := &App{
 		e:               echo.New(),
-		signalingServer: signaling.NewServer(),
-		port:            getPort(),
+		signalingServer: signalingServer,
+		roomStore:       roomStore,
+		webrtcAPI:       webrtcAPI,
+		config:          cfg,
+	}
+
+	if relayCfg != nil {
+		app.relayServer, err = relay.NewServer(*relayCfg, app.signalingServer.HasParticipant)
+		if err != nil {
+			log.Fatalf("TURN server startup failed: %v", err)
+		}
+		log.Printf("Embedded TURN server listening on %s:%d (udp, tcp)", relayCfg.ListenAddress, relayCfg.Port)
 	}
 
 	app.e.HideBanner = true
 	app.e.HidePort = false
+	app.e.Server.ReadHeaderTimeout = cfg.Server.ReadHeaderTimeout
 
 	app.e.Use(echomiddleware.Logger())
 	app.e.Use(echomiddleware.Recover())
-	app.e.Use(echomiddleware.CORS())
+	app.e.Use(echomiddleware.CORSWithConfig(echomiddleware.CORSConfig{
+		AllowOrigins: cfg.Server.CORSOrigins,
+	}))
 	app.e.Use(echomiddleware.RequestID())
 
 	// 🟢 No rate limiting
 	app.e.GET("/health", healthHandler)
 
-	// 🔴 5 req/min
-	strictLimiter := middleware.NewIPRateLimiter(rate.Every(time.Minute/5), 1)
+	// 🔴 5 req/min by default
+	strictLimiter := newRateLimiter(cfg.RateLimits.CreateRoom)
 	strictProtected := app.e.Group("")
 	strictProtected.Use(strictLimiter.Middleware())
 	strictProtected.POST("/api/rooms/create", func(c echo.Context) error {
-		// TODO: Implement room creation handler
-		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+		return createRoomHandler(c, app.signalingServer, cfg)
 	})
 
-	// 🟡 10 req/min
-	lightLimiter := middleware.NewIPRateLimiter(rate.Every(time.Minute/10), 2)
+	// 🟡 10 req/min by default
+	lightLimiter := newRateLimiter(cfg.RateLimits.RoomInfo)
 	lightProtected := app.e.Group("")
 	lightProtected.Use(lightLimiter.Middleware())
 	lightProtected.GET("/api/rooms/:room_id", func(c echo.Context) error {
-		// TODO: Implement room info handler
-		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+		return roomInfoHandler(c, app.signalingServer)
+	})
+	lightProtected.GET("/api/rooms/:slug/guest-token", func(c echo.Context) error {
+		return guestTokenHandler(c, cfg.Auth)
 	})
 
-	// 🔴 3 req/min
-	wsLimiter := middleware.NewIPRateLimiter(rate.Every(time.Minute/3), 1)
+	// 🔴 3 req/min by default
+	wsLimiter := newRateLimiter(cfg.RateLimits.WebSocket)
 	app.e.GET("/ws/:room_id", wsLimiter.Middleware()(echo.WrapHandler(http.HandlerFunc(app.signalingServer.HandleWebSocket))))
 
 	return app
@@ -67,8 +113,8 @@ func Initialize() *App {
 
 func (a *App) Start() {
 	go func() {
-		log.Printf("Starting server on port %s", a.port)
-		if err := a.e.Start(":" + a.port); err != nil && err != http.ErrServerClosed {
+		log.Printf("Starting server on port %s", a.config.Server.Port)
+		if err := a.e.Start(":" + a.config.Server.Port); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server startup failed: %v", err)
 		}
 	}()
@@ -76,12 +122,113 @@ func (a *App) Start() {
 
 func (a *App) Shutdown(ctx context.Context) error {
 	a.signalingServer.Shutdown()
-	return a.e.Shutdown(ctx)
+	err := a.e.Shutdown(ctx)
+
+	if closeErr := a.webrtcAPI.Close(); closeErr != nil {
+		log.Printf("Failed to close ICE sockets: %v", closeErr)
+	}
+
+	if a.relayServer != nil {
+		if closeErr := a.relayServer.Close(); closeErr != nil {
+			log.Printf("Failed to stop TURN server: %v", closeErr)
+		}
+	}
+
+	if closeErr := a.roomStore.Close(); closeErr != nil {
+		log.Printf("Failed to close room store: %v", closeErr)
+	}
+
+	return err
+}
+
+// newRoomStore opens the on-disk room store when a store path is configured
+// and falls back to an in-memory store otherwise
+func newRoomStore(cfg config.RoomsConfig) (signaling.RoomStore, error) {
+	if cfg.StorePath != "" {
+		return signaling.NewBoltRoomStore(cfg.StorePath)
+	}
+	return signaling.NewMemoryRoomStore(), nil
+}
+
+func iceNetworkConfig(cfg config.ICEConfig) signaling.ICENetworkConfig {
+	return signaling.ICENetworkConfig{
+		UDPMuxPort: cfg.UDPMuxPort,
+		TCPMuxPort: cfg.TCPMuxPort,
+		NAT1To1IPs: cfg.NAT1To1IPs,
+		PortMin:    uint16(cfg.PortMin),
+		PortMax:    uint16(cfg.PortMax),
+		Interfaces: cfg.Interfaces,
+	}
+}
+
+func bandwidthEstimationConfig(cfg config.BandwidthEstimationConfig) signaling.BandwidthEstimationConfig {
+	return signaling.BandwidthEstimationConfig{
+		InitialBitrate: cfg.InitialBitrate,
+		MinBitrate:     cfg.MinBitrate,
+		MaxBitrate:     cfg.MaxBitrate,
+	}
 }
 
-func getPort() string {
-	if port := os.Getenv("PORT"); port != "" {
-		return port
+// embeddedTURNConfig derives the relay settings; without a configured secret
+// a random one is generated, since this process both mints and verifies the
+// credentials
+func embeddedTURNConfig(cfg *config.Config) *relay.Config {
+	secret := cfg.WebRTC.TURN.Secret
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			log.Fatalf("Failed to generate TURN secret: %v", err)
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	server := cfg.WebRTC.TURNServer
+	return &relay.Config{
+		ListenAddress: server.ListenAddress,
+		Port:          server.Port,
+		PublicIP:      net.ParseIP(server.PublicIP),
+		Realm:         server.Realm,
+		RelayPortMin:  uint16(server.RelayPortMin),
+		RelayPortMax:  uint16(server.RelayPortMax),
+		Secret:        secret,
+	}
+}
+
+func newRateLimiter(limit config.RateLimit) *middleware.IPRateLimiter {
+	return middleware.NewIPRateLimiter(rate.Every(time.Minute/time.Duration(limit.PerMinute)), limit.Burst)
+}
+
+func signalingConfig(cfg *config.Config) signaling.Config {
+	iceServers := make([]webrtc.ICEServer, 0, len(cfg.WebRTC.ICEServers))
+	for _, server := range cfg.WebRTC.ICEServers {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+
+	return signaling.Config{
+		JWTSecret: cfg.Auth.JWTSecret,
+		Limits: signaling.Limits{
+			MaxRooms:               cfg.Rooms.MaxRooms,
+			MaxParticipantsPerRoom: cfg.Rooms.MaxParticipants,
+			MaxKnockingPerRoom:     cfg.Rooms.MaxKnocking,
+		},
+		RoomIdleTimeout:         cfg.Rooms.IdleTimeout,
+		JanitorInterval:         cfg.Rooms.JanitorInterval,
+		JoinTimeout:             cfg.Server.JoinTimeout,
+		ReconnectWindow:         cfg.Server.ReconnectWindow,
+		HostGracePeriod:         cfg.Rooms.HostGracePeriod,
+		HostAbsencePolicy:       signaling.HostAbsencePolicy(cfg.Rooms.HostAbsencePolicy),
+		KeyframeRequestInterval: cfg.WebRTC.KeyframeRequestInterval,
+		NACKBufferSize:          cfg.WebRTC.NACKBufferSize,
+		ICEServers:              iceServers,
+		TURN: signaling.TURNConfig{
+			URLs:          cfg.WebRTC.TURN.URLs,
+			Secret:        cfg.WebRTC.TURN.Secret,
+			CredentialTTL: cfg.WebRTC.TURN.CredentialTTL,
+		},
+		AllowedOrigins: cfg.Server.CORSOrigins,
 	}
-	return defaultPort
 }
@@ -1,25 +1,48 @@
 package app
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/Kaamos-Comms/server/internal/config"
 	"github.com/Kaamos-Comms/server/internal/signaling"
 	"github.com/labstack/echo/v4"
 )
 
-const (
-	tokenValidity      = 24 * time.Hour
-	slugLength         = 8
-	guestTokenValidity = 2 * time.Hour
-)
+const slugLength = 8
 
-var jwtSecret = getJWTSecret()
+type CreateRoomRequest struct {
+	CreatorUserID       int64 `json:"creator_user_id"`
+	MaxParticipants     int   `json:"max_participants,omitempty"`
+	ScreenShareHostOnly bool  `json:"screen_share_host_only,omitempty"`
+	MaxScreenShares     int   `json:"max_screen_shares,omitempty"`
+	// HostAbsence is hold, auto_admit or reject; empty takes the server's
+	HostAbsence signaling.HostAbsencePolicy `json:"host_absence,omitempty"`
+}
 
-type RoomResponse struct {
-	Slug string `json:"slug"`
-	JWT  string `json:"jwt"`
+type CreateRoomResponse struct {
+	RoomID    string `json:"room_id"`
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expires_at"`
+	HostJWT   string `json:"host_jwt"`
+}
+
+type RoomInfoResponse struct {
+	RoomID          string `json:"room_id"`
+	Active          bool   `json:"active"`
+	Participants    int    `json:"participants"`
+	HasHost         bool   `json:"has_host"`
+	KnockingGuests  int    `json:"knocking_guests"`
+	MaxParticipants int    `json:"max_participants,omitempty"`
+	CreatedAt       string `json:"created_at"`
+	ExpiresAt       string `json:"expires_at,omitempty"`
+	LastActivityAt  string `json:"last_activity_at"`
+	ActiveSpeaker   string `json:"active_speaker,omitempty"`
+	Locked          bool   `json:"locked"`
+	HostReturnBy    string `json:"host_return_by,omitempty"`
 }
 
 type HealthResponse struct {
@@ -34,16 +57,38 @@ func healthHandler(c echo.Context) error {
 	})
 }
 
-func roomsAnonymousHandler(c echo.Context) error {
-	slug, err := generateSlug(slugLength)
-	if err != nil {
-		log.Printf("Failed to generate slug: %v", err)
+// createRoomHandler регистрирует комнату и выдаёт создателю токен хоста
+func createRoomHandler(c echo.Context, signalingServer *signaling.Server, cfg *config.Config) error {
+	var req CreateRoomRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "invalid request body",
+		})
+	}
+
+	room, err := signalingServer.CreateRoom(req.CreatorUserID, cfg.Rooms.TTL, signaling.RoomPolicy{
+		MaxParticipants:     req.MaxParticipants,
+		ScreenShareHostOnly: req.ScreenShareHostOnly,
+		MaxScreenShares:     req.MaxScreenShares,
+		HostAbsence:         req.HostAbsence,
+	})
+	switch {
+	case errors.Is(err, signaling.ErrInvalidRoomPolicy):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	case errors.Is(err, signaling.ErrServerAtCapacity):
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "server is at capacity, try again later",
+		})
+	case err != nil:
+		log.Printf("Failed to create room: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "failed to generate room identifier",
+			"error": "failed to create room",
 		})
 	}
 
-	token, err := generateJWT(slug)
+	token, err := generateJWT(cfg.Auth, room.Slug)
 	if err != nil {
 		log.Printf("Failed to generate JWT: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -51,12 +96,60 @@ func roomsAnonymousHandler(c echo.Context) error {
 		})
 	}
 
-	return c.JSON(http.StatusCreated, RoomResponse{
-		Slug: slug,
-		JWT:  token,
+	return c.JSON(http.StatusCreated, CreateRoomResponse{
+		RoomID:    room.Slug,
+		URL:       strings.TrimRight(cfg.Server.PublicURL, "/") + "/room/" + room.Slug,
+		ExpiresAt: room.ExpiresAt.UTC().Format(time.RFC3339),
+		HostJWT:   token,
 	})
 }
 
+// roomInfoHandler возвращает текущее состояние комнаты
+func roomInfoHandler(c echo.Context, signalingServer *signaling.Server) error {
+	roomID := sanitizeSlug(c.Param("room_id"))
+	if roomID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "invalid room id",
+		})
+	}
+
+	stats := signalingServer.GetRoomStats(roomID)
+	if stats == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "room not found",
+		})
+	}
+
+	// Просроченная комната ещё не удалена сборщиком, но войти в неё нельзя
+	if stats.Expired {
+		return c.JSON(http.StatusGone, map[string]string{
+			"error":      "room expired",
+			"expires_at": stats.ExpiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	response := RoomInfoResponse{
+		RoomID:          stats.Slug,
+		Active:          stats.InRoomCount > 0,
+		Participants:    stats.InRoomCount,
+		HasHost:         stats.HasHost,
+		KnockingGuests:  stats.KnockingCount,
+		MaxParticipants: stats.MaxParticipants,
+		CreatedAt:       stats.CreatedAt.UTC().Format(time.RFC3339),
+		LastActivityAt:  stats.LastActivityAt.UTC().Format(time.RFC3339),
+		ActiveSpeaker:   stats.ActiveSpeaker,
+		Locked:          stats.Locked,
+	}
+	if !stats.ExpiresAt.IsZero() {
+		response.ExpiresAt = stats.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if !stats.HostReturnBy.IsZero() {
+		response.HostReturnBy = stats.HostReturnBy.UTC().Format(time.RFC3339)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
 // roomKeysHandler возвращает публичные ключи участников комнаты
 func roomKeysHandler(c echo.Context, signalingServer *signaling.Server) error {
 	slug := c.Param("slug")
@@ -74,22 +167,10 @@ func roomKeysHandler(c echo.Context, signalingServer *signaling.Server) error {
 		})
 	}
 
-	// Извлекаем публичные ключи из статистики
-	participants, ok := stats["participants"].(*signaling.ParticipantsData)
-	if !ok {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "failed to get participant data",
-		})
-	}
-
-	keys := make(map[string]string)
-	if participants.Host != nil && participants.Host.Keys.PublicKey != "" {
-		keys[participants.Host.ID] = participants.Host.Keys.PublicKey
-	}
-	for id, guest := range participants.Guests {
-		if guest.Keys.PublicKey != "" {
-			keys[id] = guest.Keys.PublicKey
-		}
+	// Статистика содержит копию ключей, снятую под блокировкой комнаты
+	keys := stats.PublicKeys
+	if keys == nil {
+		keys = make(map[string]string)
 	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
@@ -98,7 +179,7 @@ func roomKeysHandler(c echo.Context, signalingServer *signaling.Server) error {
 	})
 }
 
-func guestTokenHandler(c echo.Context) error {
+func guestTokenHandler(c echo.Context, auth config.AuthConfig) error {
 	slug := c.Param("slug")
 
 	// Валидируем slug
@@ -110,7 +191,7 @@ func guestTokenHandler(c echo.Context) error {
 	}
 
 	// Генерируем гостевой токен
-	token, expiresAt, err := generateGuestJWT(slug)
+	token, expiresAt, err := generateGuestJWT(auth, slug)
 	if err != nil {
 		log.Printf("Failed to generate guest JWT: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -4,38 +4,160 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Kaamos-Comms/server/internal/config"
+	"github.com/Kaamos-Comms/server/internal/signaling"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/require"
 )
 
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.Auth.JWTSecret = "test-secret"
+	return cfg
+}
+
 func TestCreateRoom(t *testing.T) {
-	app := Initialize()
-	req := httptest.NewRequest(http.MethodPost, "/api/rooms/create", nil)
+	app := Initialize(testConfig())
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms/create", strings.NewReader(`{"creator_user_id": 123456789}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
 
 	app.e.ServeHTTP(rec, req)
 
-	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, http.StatusCreated, rec.Code)
 
-	var response map[string]string
+	var response CreateRoomResponse
 	err := json.Unmarshal(rec.Body.Bytes(), &response)
 	require.NoError(t, err)
-	require.Equal(t, "ok", response["status"])
+	require.Regexp(t, `^[a-zA-Z0-9]{10}$`, response.RoomID)
+	require.Equal(t, app.config.Server.PublicURL+"/room/"+response.RoomID, response.URL)
+	require.NotEmpty(t, response.HostJWT)
+
+	expiresAt, err := time.Parse(time.RFC3339, response.ExpiresAt)
+	require.NoError(t, err)
+	require.True(t, expiresAt.After(time.Now()))
+
+	stats := app.signalingServer.GetRoomStats(response.RoomID)
+	require.NotNil(t, stats)
+}
+
+func TestCreateRoomInvalidCapacity(t *testing.T) {
+	app := Initialize(testConfig())
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms/create", strings.NewReader(`{"creator_user_id": 1, "max_participants": 10}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	app.e.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestCreateRoomInvalidScreenSharePolicy(t *testing.T) {
+	app := Initialize(testConfig())
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms/create", strings.NewReader(`{"creator_user_id": 1, "max_screen_shares": -1}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	app.e.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestCreateRoomInvalidHostAbsencePolicy(t *testing.T) {
+	app := Initialize(testConfig())
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms/create", strings.NewReader(`{"creator_user_id": 1, "host_absence": "admit"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	app.e.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestCreateRoomServerAtCapacity(t *testing.T) {
+	cfg := testConfig()
+	cfg.Rooms.MaxRooms = 1
+	cfg.RateLimits.CreateRoom.Burst = 2
+	app := Initialize(cfg)
+	e := app.e
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/rooms/create", nil))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/rooms/create", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
 }
 
 func TestGetRoom(t *testing.T) {
-	app := Initialize()
+	app := Initialize(testConfig())
+	room, err := app.signalingServer.CreateRoom(123456789, time.Hour, signaling.RoomPolicy{})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms/"+room.Slug, nil)
+	rec := httptest.NewRecorder()
+
+	app.e.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var response RoomInfoResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
+	require.NoError(t, err)
+	require.Equal(t, room.Slug, response.RoomID)
+	require.False(t, response.Active)
+	require.Equal(t, 0, response.Participants)
+	require.False(t, response.HasHost)
+	require.Equal(t, 0, response.KnockingGuests)
+	require.Equal(t, 4, response.MaxParticipants)
+	require.Equal(t, room.CreatedAt.UTC().Format(time.RFC3339), response.CreatedAt)
+	require.Equal(t, room.ExpiresAt.UTC().Format(time.RFC3339), response.ExpiresAt)
+	// Media internals stay private
+	require.NotContains(t, rec.Body.String(), "retransmissions")
+}
+
+func TestGetRoomExpired(t *testing.T) {
+	app := Initialize(testConfig())
+	room, err := app.signalingServer.CreateRoom(123456789, -time.Minute, signaling.RoomPolicy{})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms/"+room.Slug, nil)
+	rec := httptest.NewRecorder()
+
+	app.e.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusGone, rec.Code)
+}
+
+func TestGetRoomNotFound(t *testing.T) {
+	app := Initialize(testConfig())
 	req := httptest.NewRequest(http.MethodGet, "/api/rooms/test-room", nil)
 	rec := httptest.NewRecorder()
 
 	app.e.ServeHTTP(rec, req)
 
-	// Should return 200 with "ok" status as per current implementation stub
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGuestTokenRoute(t *testing.T) {
+	app := Initialize(testConfig())
+	room, err := app.signalingServer.CreateRoom(123456789, time.Hour, signaling.RoomPolicy{})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms/"+room.Slug+"/guest-token", nil)
+	rec := httptest.NewRecorder()
+
+	app.e.ServeHTTP(rec, req)
+
 	require.Equal(t, http.StatusOK, rec.Code)
 
-	var response map[string]string
-	err := json.Unmarshal(rec.Body.Bytes(), &response)
+	var response GuestTokenResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
 	require.NoError(t, err)
-	require.Equal(t, "ok", response["status"])
+	require.NotEmpty(t, response.GuestJWT)
 }
@@ -6,32 +6,54 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/Kaamos-Comms/server/internal/signaling"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
 
-func setupTestServer() *echo.Echo {
+func setupTestServer(t *testing.T) *echo.Echo {
+	t.Helper()
+
 	e := echo.New()
+	cfg := testConfig()
+	cfg.Server.PublicURL = "https://kaamos.example.com/"
+	signalingServer, err := signaling.NewServer(cfg.Auth.JWTSecret)
+	if err != nil {
+		t.Fatalf("failed to create signaling server: %v", err)
+	}
+	t.Cleanup(signalingServer.Shutdown)
 	e.GET("/health", healthHandler)
-	e.POST("/rooms/anonymous", roomsAnonymousHandler)
+	e.POST("/api/rooms/create", func(c echo.Context) error {
+		return createRoomHandler(c, signalingServer, cfg)
+	})
 	return e
 }
 
 func TestHealthEndpoint(t *testing.T) {
-	e := setupTestServer()
+	e := setupTestServer(t)
 	req := httptest.NewRequest(http.MethodGet, "/health", nil)
 	rec := httptest.NewRecorder()
 	e.ServeHTTP(rec, req)
 	assert.Equal(t, http.StatusOK, rec.Code)
 }
 
-func TestRoomsAnonymousEndpoint(t *testing.T) {
-	e := setupTestServer()
-	req := httptest.NewRequest(http.MethodPost, "/rooms/anonymous", nil)
+func TestCreateRoomEndpoint(t *testing.T) {
+	e := setupTestServer(t)
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms/create", nil)
 	rec := httptest.NewRecorder()
 	e.ServeHTTP(rec, req)
 	assert.Equal(t, "application/json", rec.Header().Get(echo.HeaderContentType))
 	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"url":"https://kaamos.example.com/room/`)
+}
+
+func TestCreateRoomEndpointInvalidBody(t *testing.T) {
+	e := setupTestServer(t)
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms/create", strings.NewReader(`{"creator_user_id": "abc"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
 }
 
 // func TestGuestTokenHandler(t *testing.T) {
@@ -118,7 +140,7 @@ func TestGuestTokenHandlerWithContext(t *testing.T) {
 	c.SetParamNames("slug")
 	c.SetParamValues("valid-room-123")
 
-	err := guestTokenHandler(c)
+	err := guestTokenHandler(c, testConfig().Auth)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, rec.Code)
 
@@ -129,7 +151,7 @@ func TestGuestTokenHandlerWithContext(t *testing.T) {
 	c2.SetParamNames("slug")
 	c2.SetParamValues("invalid slug with spaces")
 
-	err2 := guestTokenHandler(c2)
+	err2 := guestTokenHandler(c2, testConfig().Auth)
 	assert.NoError(t, err2) // Handler не возвращает ошибку, но устанавливает статус
 	assert.Equal(t, http.StatusBadRequest, rec2.Code)
 }
@@ -3,11 +3,12 @@ package app
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"os"
+	"encoding/hex"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/Kaamos-Comms/server/internal/config"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -34,16 +35,31 @@ func generateSlug(length int) (string, error) {
 	return encoded, nil
 }
 
-func generateJWT(slug string) (string, error) {
+func generateJWT(auth config.AuthConfig, slug string) (string, error) {
+	tokenID, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
 	claims := jwt.MapClaims{
 		"slug": slug,
 		"role": "host",
+		"jti":  tokenID,
 		"iat":  time.Now().Unix(),
-		"exp":  time.Now().Add(tokenValidity).Unix(),
+		"exp":  time.Now().Add(auth.HostTokenTTL).Unix(),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(jwtSecret))
+	return token.SignedString([]byte(auth.JWTSecret))
+}
+
+// generateTokenID returns a random jti; the signaling server recognizes a
+// reconnecting host by it
+func generateTokenID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
 }
 
 func sanitizeSlug(slug string) string {
@@ -61,30 +77,28 @@ func sanitizeSlug(slug string) string {
 	return slug
 }
 
-func generateGuestJWT(slug string) (string, time.Time, error) {
-	expiresAt := time.Now().Add(guestTokenValidity)
+func generateGuestJWT(auth config.AuthConfig, slug string) (string, time.Time, error) {
+	tokenID, err := generateTokenID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(auth.GuestTokenTTL)
 
 	claims := GuestClaims{
 		Slug: slug,
 		Role: "guest",
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	tokenString, err := token.SignedString([]byte(auth.JWTSecret))
 	if err != nil {
 		return "", time.Time{}, err
 	}
 
 	return tokenString, expiresAt, nil
 }
-
-func getJWTSecret() string {
-	if secret := strings.TrimSpace(os.Getenv("JWT_SECRET")); secret != "" {
-		return secret
-	}
-	return ""
-}
@@ -0,0 +1,520 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete server configuration. Values are resolved in order
+// of increasing precedence: defaults, YAML file, environment, CLI flags.
+type Config struct {
+	Server     ServerConfig     `yaml:"server"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Rooms      RoomsConfig      `yaml:"rooms"`
+	WebRTC     WebRTCConfig     `yaml:"webrtc"`
+	RateLimits RateLimitsConfig `yaml:"rate_limits"`
+}
+
+type ServerConfig struct {
+	Port              string        `yaml:"port"`
+	PublicURL         string        `yaml:"public_url"`
+	CORSOrigins       []string      `yaml:"cors_origins"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	JoinTimeout       time.Duration `yaml:"join_timeout"`
+	// ReconnectWindow is how long a dropped client may resume its session;
+	// 0 disables resuming
+	ReconnectWindow time.Duration `yaml:"reconnect_window"`
+}
+
+type AuthConfig struct {
+	JWTSecret     string        `yaml:"jwt_secret"`
+	HostTokenTTL  time.Duration `yaml:"host_token_ttl"`
+	GuestTokenTTL time.Duration `yaml:"guest_token_ttl"`
+}
+
+type RoomsConfig struct {
+	StorePath       string        `yaml:"store_path"`
+	TTL             time.Duration `yaml:"ttl"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	JanitorInterval time.Duration `yaml:"janitor_interval"`
+	MaxRooms        int           `yaml:"max_rooms"`
+	MaxParticipants int           `yaml:"max_participants"`
+	// MaxKnocking bounds the guests waiting to be let in to a room
+	MaxKnocking int `yaml:"max_knocking"`
+	// HostGracePeriod holds the seat of a host whose connection dropped;
+	// 0 gives it up right away
+	HostGracePeriod time.Duration `yaml:"host_grace_period"`
+	// HostAbsencePolicy is hold, auto_admit or reject for guests waiting
+	// while a room has no host
+	HostAbsencePolicy string `yaml:"host_absence_policy"`
+}
+
+type WebRTCConfig struct {
+	ICEServers []ICEServer      `yaml:"ice_servers"`
+	TURN       TURNConfig       `yaml:"turn"`
+	TURNServer TURNServerConfig `yaml:"turn_server"`
+	ICE        ICEConfig        `yaml:"ice"`
+	// BandwidthEstimation bounds the per-subscriber congestion controller
+	BandwidthEstimation BandwidthEstimationConfig `yaml:"bandwidth_estimation"`
+	// KeyframeRequestInterval rate limits PLIs sent to a publisher per track
+	KeyframeRequestInterval time.Duration `yaml:"keyframe_request_interval"`
+	// NACKBufferSize is the number of packets kept per video layer for
+	// retransmission; 0 disables NACK handling
+	NACKBufferSize int `yaml:"nack_buffer_size"`
+}
+
+type ICEServer struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username,omitempty"`
+	Credential string   `yaml:"credential,omitempty"`
+}
+
+// TURNConfig describes relays that accept time-limited credentials derived
+// from a shared secret (the "TURN REST API" scheme, e.g. coturn's
+// use-auth-secret). Leave URLs empty to disable.
+type TURNConfig struct {
+	URLs          []string      `yaml:"urls"`
+	Secret        string        `yaml:"secret"`
+	CredentialTTL time.Duration `yaml:"credential_ttl"`
+}
+
+// TURNServerConfig runs a TURN relay inside this process. It authenticates
+// with the webrtc.turn secret (a random one when unset) and, unless
+// webrtc.turn.urls says otherwise, is advertised at public_ip:port.
+type TURNServerConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	ListenAddress string `yaml:"listen_address"`
+	Port          int    `yaml:"port"`
+	PublicIP      string `yaml:"public_ip"`
+	Realm         string `yaml:"realm"`
+	RelayPortMin  int    `yaml:"relay_port_min"`
+	RelayPortMax  int    `yaml:"relay_port_max"`
+}
+
+// ICEConfig controls local candidate gathering of the server-side peer
+// connections. Zero ports and empty lists keep pion's defaults.
+type ICEConfig struct {
+	UDPMuxPort int      `yaml:"udp_mux_port"`
+	TCPMuxPort int      `yaml:"tcp_mux_port"`
+	NAT1To1IPs []string `yaml:"nat_1to1_ips"`
+	PortMin    int      `yaml:"port_min"`
+	PortMax    int      `yaml:"port_max"`
+	Interfaces []string `yaml:"interfaces"`
+}
+
+// BandwidthEstimationConfig sets the bitrates, in bits per second, the
+// estimate of each subscriber's downlink starts at and is kept within
+type BandwidthEstimationConfig struct {
+	InitialBitrate int `yaml:"initial_bitrate"`
+	MinBitrate     int `yaml:"min_bitrate"`
+	MaxBitrate     int `yaml:"max_bitrate"`
+}
+
+type RateLimit struct {
+	PerMinute int `yaml:"per_minute"`
+	Burst     int `yaml:"burst"`
+}
+
+type RateLimitsConfig struct {
+	CreateRoom RateLimit `yaml:"create_room"`
+	RoomInfo   RateLimit `yaml:"room_info"`
+	WebSocket  RateLimit `yaml:"websocket"`
+}
+
+// Default returns the configuration described in the spec. It has no JWT
+// secret and therefore does not pass Validate on its own.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              "8080",
+			PublicURL:         "http://localhost:8080",
+			CORSOrigins:       []string{"*"},
+			ReadHeaderTimeout: 10 * time.Second,
+			ShutdownTimeout:   10 * time.Second,
+			JoinTimeout:       10 * time.Second,
+			ReconnectWindow:   30 * time.Second,
+		},
+		Auth: AuthConfig{
+			HostTokenTTL:  24 * time.Hour,
+			GuestTokenTTL: 2 * time.Hour,
+		},
+		Rooms: RoomsConfig{
+			TTL:               24 * time.Hour,
+			IdleTimeout:       24 * time.Hour,
+			JanitorInterval:   time.Minute,
+			MaxRooms:          50,
+			MaxParticipants:   4,
+			MaxKnocking:       10,
+			HostGracePeriod:   time.Minute,
+			HostAbsencePolicy: "hold",
+		},
+		WebRTC: WebRTCConfig{
+			ICEServers: []ICEServer{
+				{URLs: []string{"stun:stun.l.google.com:19302"}},
+			},
+			TURN: TURNConfig{
+				CredentialTTL: 24 * time.Hour,
+			},
+			KeyframeRequestInterval: 500 * time.Millisecond,
+			NACKBufferSize:          512,
+			BandwidthEstimation: BandwidthEstimationConfig{
+				InitialBitrate: 1_000_000,
+				MinBitrate:     100_000,
+				MaxBitrate:     10_000_000,
+			},
+			TURNServer: TURNServerConfig{
+				ListenAddress: "0.0.0.0",
+				Port:          3478,
+				Realm:         "kaamos",
+				RelayPortMin:  49152,
+				RelayPortMax:  65535,
+			},
+		},
+		RateLimits: RateLimitsConfig{
+			CreateRoom: RateLimit{PerMinute: 5, Burst: 1},
+			RoomInfo:   RateLimit{PerMinute: 10, Burst: 2},
+			WebSocket:  RateLimit{PerMinute: 3, Burst: 1},
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the YAML file named by
+// -config (or CONFIG_FILE), the environment and the remaining CLI flags, and
+// validates the result.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("kaamos-server", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration file")
+	port := fs.String("port", "", "HTTP listen port")
+	publicURL := fs.String("public-url", "", "public URL room links are built from")
+	storePath := fs.String("room-store", "", "path to the on-disk room store")
+	maxRooms := fs.Int("max-rooms", 0, "maximum number of concurrent rooms")
+	maxParticipants := fs.Int("max-participants", 0, "maximum participants per room")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = *port
+		case "public-url":
+			cfg.Server.PublicURL = *publicURL
+		case "room-store":
+			cfg.Rooms.StorePath = *storePath
+		case "max-rooms":
+			cfg.Rooms.MaxRooms = *maxRooms
+		case "max-participants":
+			cfg.Rooms.MaxParticipants = *maxParticipants
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv overrides file values with environment variables
+func (c *Config) applyEnv() error {
+	var errs []error
+
+	setString := func(name string, target *string) {
+		if value, ok := os.LookupEnv(name); ok && strings.TrimSpace(value) != "" {
+			*target = strings.TrimSpace(value)
+		}
+	}
+	setList := func(name string, target *[]string) {
+		if value, ok := os.LookupEnv(name); ok && strings.TrimSpace(value) != "" {
+			*target = splitList(value)
+		}
+	}
+	setBool := func(name string, target *bool) {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*target = b
+		}
+	}
+	setInt := func(name string, target *int) {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*target = n
+		}
+	}
+	setDuration := func(name string, target *time.Duration) {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*target = d
+		}
+	}
+
+	setString("PORT", &c.Server.Port)
+	setString("PUBLIC_URL", &c.Server.PublicURL)
+	setList("CORS_ORIGINS", &c.Server.CORSOrigins)
+	setDuration("READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout)
+	setDuration("SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	setDuration("JOIN_TIMEOUT", &c.Server.JoinTimeout)
+	setDuration("RECONNECT_WINDOW", &c.Server.ReconnectWindow)
+
+	setString("JWT_SECRET", &c.Auth.JWTSecret)
+	setDuration("HOST_TOKEN_TTL", &c.Auth.HostTokenTTL)
+	setDuration("GUEST_TOKEN_TTL", &c.Auth.GuestTokenTTL)
+
+	setString("ROOM_STORE_PATH", &c.Rooms.StorePath)
+	setDuration("ROOM_TTL", &c.Rooms.TTL)
+	setDuration("ROOM_IDLE_TIMEOUT", &c.Rooms.IdleTimeout)
+	setInt("MAX_ROOMS", &c.Rooms.MaxRooms)
+	setInt("MAX_PARTICIPANTS_PER_ROOM", &c.Rooms.MaxParticipants)
+	setInt("MAX_KNOCKING_PER_ROOM", &c.Rooms.MaxKnocking)
+	setDuration("HOST_GRACE_PERIOD", &c.Rooms.HostGracePeriod)
+	setString("HOST_ABSENCE_POLICY", &c.Rooms.HostAbsencePolicy)
+
+	// ICE_SERVERS is a comma-separated list of STUN URLs without credentials
+	if value, ok := os.LookupEnv("ICE_SERVERS"); ok && strings.TrimSpace(value) != "" {
+		c.WebRTC.ICEServers = nil
+		for _, u := range splitList(value) {
+			c.WebRTC.ICEServers = append(c.WebRTC.ICEServers, ICEServer{URLs: []string{u}})
+		}
+	}
+
+	setList("TURN_URLS", &c.WebRTC.TURN.URLs)
+	setString("TURN_SECRET", &c.WebRTC.TURN.Secret)
+	setDuration("TURN_CREDENTIAL_TTL", &c.WebRTC.TURN.CredentialTTL)
+
+	setBool("TURN_SERVER_ENABLED", &c.WebRTC.TURNServer.Enabled)
+	setString("TURN_SERVER_LISTEN_ADDRESS", &c.WebRTC.TURNServer.ListenAddress)
+	setInt("TURN_SERVER_PORT", &c.WebRTC.TURNServer.Port)
+	setString("TURN_SERVER_PUBLIC_IP", &c.WebRTC.TURNServer.PublicIP)
+	setString("TURN_SERVER_REALM", &c.WebRTC.TURNServer.Realm)
+	setInt("TURN_SERVER_RELAY_PORT_MIN", &c.WebRTC.TURNServer.RelayPortMin)
+	setInt("TURN_SERVER_RELAY_PORT_MAX", &c.WebRTC.TURNServer.RelayPortMax)
+
+	setDuration("KEYFRAME_REQUEST_INTERVAL", &c.WebRTC.KeyframeRequestInterval)
+	setInt("NACK_BUFFER_SIZE", &c.WebRTC.NACKBufferSize)
+
+	setInt("ICE_UDP_MUX_PORT", &c.WebRTC.ICE.UDPMuxPort)
+	setInt("ICE_TCP_MUX_PORT", &c.WebRTC.ICE.TCPMuxPort)
+	setList("ICE_NAT_1TO1_IPS", &c.WebRTC.ICE.NAT1To1IPs)
+	setInt("ICE_PORT_MIN", &c.WebRTC.ICE.PortMin)
+	setInt("ICE_PORT_MAX", &c.WebRTC.ICE.PortMax)
+	setList("ICE_INTERFACES", &c.WebRTC.ICE.Interfaces)
+
+	setInt("BWE_INITIAL_BITRATE", &c.WebRTC.BandwidthEstimation.InitialBitrate)
+	setInt("BWE_MIN_BITRATE", &c.WebRTC.BandwidthEstimation.MinBitrate)
+	setInt("BWE_MAX_BITRATE", &c.WebRTC.BandwidthEstimation.MaxBitrate)
+
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+
+	if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port: invalid port %q", c.Server.Port))
+	}
+	if u, err := url.Parse(c.Server.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("server.public_url: must be an absolute http(s) URL, got %q", c.Server.PublicURL))
+	}
+	if strings.TrimSpace(c.Auth.JWTSecret) == "" {
+		errs = append(errs, errors.New("auth.jwt_secret: must not be empty (set JWT_SECRET)"))
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+		{"server.join_timeout", c.Server.JoinTimeout},
+		{"auth.host_token_ttl", c.Auth.HostTokenTTL},
+		{"auth.guest_token_ttl", c.Auth.GuestTokenTTL},
+		{"rooms.ttl", c.Rooms.TTL},
+		{"rooms.idle_timeout", c.Rooms.IdleTimeout},
+		{"rooms.janitor_interval", c.Rooms.JanitorInterval},
+		{"webrtc.keyframe_request_interval", c.WebRTC.KeyframeRequestInterval},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive", d.name))
+		}
+	}
+
+	if c.Rooms.MaxRooms < 1 {
+		errs = append(errs, errors.New("rooms.max_rooms: must be at least 1"))
+	}
+	if c.Rooms.MaxParticipants < 2 {
+		errs = append(errs, errors.New("rooms.max_participants: must be at least 2"))
+	}
+	if c.Rooms.MaxKnocking < 1 {
+		errs = append(errs, errors.New("rooms.max_knocking: must be at least 1"))
+	}
+	if c.Server.ReconnectWindow < 0 {
+		errs = append(errs, errors.New("server.reconnect_window: must not be negative"))
+	}
+	if c.Rooms.HostGracePeriod < 0 {
+		errs = append(errs, errors.New("rooms.host_grace_period: must not be negative"))
+	}
+	switch c.Rooms.HostAbsencePolicy {
+	case "hold", "auto_admit", "reject":
+	default:
+		errs = append(errs, fmt.Errorf("rooms.host_absence_policy: must be hold, auto_admit or reject, got %q", c.Rooms.HostAbsencePolicy))
+	}
+
+	for i, server := range c.WebRTC.ICEServers {
+		if len(server.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("webrtc.ice_servers[%d]: no urls", i))
+		}
+		for _, u := range server.URLs {
+			if !hasICEScheme(u) {
+				errs = append(errs, fmt.Errorf("webrtc.ice_servers[%d]: unsupported url %q", i, u))
+			}
+		}
+	}
+
+	if turn := c.WebRTC.TURN; len(turn.URLs) > 0 {
+		for _, u := range turn.URLs {
+			if !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+				errs = append(errs, fmt.Errorf("webrtc.turn.urls: unsupported url %q", u))
+			}
+		}
+		if strings.TrimSpace(turn.Secret) == "" && !c.WebRTC.TURNServer.Enabled {
+			errs = append(errs, errors.New("webrtc.turn.secret: must not be empty when TURN urls are set (set TURN_SECRET)"))
+		}
+		if turn.CredentialTTL <= 0 {
+			errs = append(errs, errors.New("webrtc.turn.credential_ttl: must be positive"))
+		}
+	}
+
+	if relay := c.WebRTC.TURNServer; relay.Enabled {
+		if relay.Port < 1 || relay.Port > 65535 {
+			errs = append(errs, fmt.Errorf("webrtc.turn_server.port: invalid port %d", relay.Port))
+		}
+		if net.ParseIP(relay.ListenAddress) == nil {
+			errs = append(errs, fmt.Errorf("webrtc.turn_server.listen_address: invalid IP %q", relay.ListenAddress))
+		}
+		if ip := net.ParseIP(relay.PublicIP); ip == nil || ip.IsUnspecified() {
+			errs = append(errs, fmt.Errorf("webrtc.turn_server.public_ip: must be a routable IP, got %q (set TURN_SERVER_PUBLIC_IP)", relay.PublicIP))
+		}
+		if strings.TrimSpace(relay.Realm) == "" {
+			errs = append(errs, errors.New("webrtc.turn_server.realm: must not be empty"))
+		}
+		if relay.RelayPortMin < 1 || relay.RelayPortMax > 65535 || relay.RelayPortMin > relay.RelayPortMax {
+			errs = append(errs, fmt.Errorf("webrtc.turn_server: invalid relay port range %d-%d", relay.RelayPortMin, relay.RelayPortMax))
+		}
+	}
+
+	ice := c.WebRTC.ICE
+	if ice.UDPMuxPort < 0 || ice.UDPMuxPort > 65535 {
+		errs = append(errs, fmt.Errorf("webrtc.ice.udp_mux_port: invalid port %d", ice.UDPMuxPort))
+	}
+	if ice.TCPMuxPort < 0 || ice.TCPMuxPort > 65535 {
+		errs = append(errs, fmt.Errorf("webrtc.ice.tcp_mux_port: invalid port %d", ice.TCPMuxPort))
+	}
+	if ice.PortMin != 0 || ice.PortMax != 0 {
+		if ice.PortMin < 1 || ice.PortMax > 65535 || ice.PortMin > ice.PortMax {
+			errs = append(errs, fmt.Errorf("webrtc.ice: invalid port range %d-%d", ice.PortMin, ice.PortMax))
+		}
+		if ice.UDPMuxPort != 0 {
+			errs = append(errs, errors.New("webrtc.ice: port range has no effect with udp_mux_port"))
+		}
+	}
+	for _, ip := range ice.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			errs = append(errs, fmt.Errorf("webrtc.ice.nat_1to1_ips: invalid IP %q", ip))
+		}
+	}
+
+	// Half the sequence number space, so buffered packets stay unambiguous
+	if size := c.WebRTC.NACKBufferSize; size < 0 || size > 32768 {
+		errs = append(errs, fmt.Errorf("webrtc.nack_buffer_size: must be between 0 and 32768, got %d", size))
+	}
+	if bwe := c.WebRTC.BandwidthEstimation; bwe.MinBitrate < 1 || bwe.MinBitrate > bwe.InitialBitrate || bwe.InitialBitrate > bwe.MaxBitrate {
+		errs = append(errs, fmt.Errorf("webrtc.bandwidth_estimation: need 0 < min_bitrate <= initial_bitrate <= max_bitrate, got %d, %d, %d", bwe.MinBitrate, bwe.InitialBitrate, bwe.MaxBitrate))
+	}
+
+	limits := []struct {
+		name  string
+		value RateLimit
+	}{
+		{"rate_limits.create_room", c.RateLimits.CreateRoom},
+		{"rate_limits.room_info", c.RateLimits.RoomInfo},
+		{"rate_limits.websocket", c.RateLimits.WebSocket},
+	}
+	for _, limit := range limits {
+		if limit.value.PerMinute < 1 || limit.value.Burst < 1 {
+			errs = append(errs, fmt.Errorf("%s: per_minute and burst must be at least 1", limit.name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func hasICEScheme(u string) bool {
+	for _, scheme := range []string{"stun:", "stuns:", "turn:", "turns:"} {
+		if strings.HasPrefix(u, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
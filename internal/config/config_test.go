@@ -0,0 +1,214 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadRequiresJWTSecret(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+
+	_, err := Load(nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "auth.jwt_secret")
+}
+
+func TestLoadDefaults(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "8080", cfg.Server.Port)
+	assert.Equal(t, 50, cfg.Rooms.MaxRooms)
+	assert.Equal(t, 4, cfg.Rooms.MaxParticipants)
+	assert.Equal(t, 24*time.Hour, cfg.Rooms.IdleTimeout)
+	assert.Equal(t, []string{"stun:stun.l.google.com:19302"}, cfg.WebRTC.ICEServers[0].URLs)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: "9000"
+  public_url: https://kaamos.example.com
+  cors_origins: [https://kaamos.example.com]
+auth:
+  jwt_secret: from-file
+  guest_token_ttl: 30m
+rooms:
+  max_rooms: 10
+  store_path: /data/rooms.db
+webrtc:
+  ice_servers:
+    - urls: [turn:turn.example.com:3478]
+      username: user
+      credential: pass
+`)
+	t.Setenv("JWT_SECRET", "from-env")
+	t.Setenv("MAX_ROOMS", "20")
+
+	cfg, err := Load([]string{"-config", path, "-max-rooms", "30", "-port", "9100"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "9100", cfg.Server.Port)
+	assert.Equal(t, "https://kaamos.example.com", cfg.Server.PublicURL)
+	assert.Equal(t, []string{"https://kaamos.example.com"}, cfg.Server.CORSOrigins)
+	assert.Equal(t, "from-env", cfg.Auth.JWTSecret)
+	assert.Equal(t, 30*time.Minute, cfg.Auth.GuestTokenTTL)
+	assert.Equal(t, 30, cfg.Rooms.MaxRooms)
+	assert.Equal(t, "/data/rooms.db", cfg.Rooms.StorePath)
+	require.Len(t, cfg.WebRTC.ICEServers, 1)
+	assert.Equal(t, "user", cfg.WebRTC.ICEServers[0].Username)
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	path := writeConfigFile(t, `
+rooms:
+  max_room: 10
+`)
+	t.Setenv("JWT_SECRET", "secret")
+
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+}
+
+func TestLoadRejectsInvalidEnv(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("ROOM_IDLE_TIMEOUT", "a day")
+
+	_, err := Load(nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ROOM_IDLE_TIMEOUT")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.JWTSecret = "secret"
+	require.NoError(t, cfg.Validate())
+
+	cfg.Server.Port = "http"
+	cfg.Server.PublicURL = "kaamos.example.com"
+	cfg.Rooms.MaxParticipants = 1
+	cfg.Rooms.MaxKnocking = 0
+	cfg.Rooms.JanitorInterval = 0
+	cfg.Server.ReconnectWindow = -time.Second
+	cfg.Rooms.HostGracePeriod = -time.Second
+	cfg.Rooms.HostAbsencePolicy = "admit"
+	cfg.WebRTC.ICEServers = []ICEServer{{URLs: []string{"http://stun.example.com"}}}
+	cfg.RateLimits.WebSocket.PerMinute = 0
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	for _, field := range []string{
+		"server.port",
+		"server.public_url",
+		"rooms.max_participants",
+		"rooms.max_knocking",
+		"rooms.janitor_interval",
+		"server.reconnect_window",
+		"rooms.host_grace_period",
+		"rooms.host_absence_policy",
+		"webrtc.ice_servers[0]",
+		"rate_limits.websocket",
+	} {
+		assert.Contains(t, err.Error(), field)
+	}
+}
+
+func TestValidateTURN(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.JWTSecret = "secret"
+	cfg.WebRTC.TURN.URLs = []string{"stun:turn.example.com:3478"}
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webrtc.turn.urls")
+	assert.Contains(t, err.Error(), "webrtc.turn.secret")
+
+	cfg.WebRTC.TURN.URLs = []string{"turn:turn.example.com:3478", "turns:turn.example.com:5349"}
+	cfg.WebRTC.TURN.Secret = "turn-secret"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestValidateTURNServer(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.JWTSecret = "secret"
+	cfg.WebRTC.TURNServer.Enabled = true
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webrtc.turn_server.public_ip")
+
+	cfg.WebRTC.TURNServer.PublicIP = "203.0.113.7"
+	cfg.WebRTC.TURNServer.RelayPortMin = 60000
+	cfg.WebRTC.TURNServer.RelayPortMax = 50000
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "relay port range")
+
+	// The embedded relay works without a configured secret or URLs
+	cfg.WebRTC.TURNServer.RelayPortMax = 60100
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestValidateICE(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.JWTSecret = "secret"
+	cfg.WebRTC.ICE = ICEConfig{
+		UDPMuxPort: 3479,
+		PortMin:    50000,
+		PortMax:    40000,
+		NAT1To1IPs: []string{"public"},
+	}
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid port range")
+	assert.Contains(t, err.Error(), "no effect with udp_mux_port")
+	assert.Contains(t, err.Error(), "webrtc.ice.nat_1to1_ips")
+
+	cfg.WebRTC.ICE = ICEConfig{
+		UDPMuxPort: 3479,
+		TCPMuxPort: 3479,
+		NAT1To1IPs: []string{"203.0.113.7"},
+		Interfaces: []string{"eth0"},
+	}
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestValidateBandwidthEstimation(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.JWTSecret = "secret"
+	cfg.WebRTC.BandwidthEstimation.InitialBitrate = 50_000
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webrtc.bandwidth_estimation")
+
+	cfg.WebRTC.BandwidthEstimation = BandwidthEstimationConfig{InitialBitrate: 300_000, MinBitrate: 50_000, MaxBitrate: 2_000_000}
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestValidateNACKBufferSize(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.JWTSecret = "secret"
+
+	cfg.WebRTC.NACKBufferSize = 40000
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webrtc.nack_buffer_size")
+
+	cfg.WebRTC.NACKBufferSize = 0
+	assert.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/turn/v4"
+)
+
+// Config describes the embedded TURN relay
+type Config struct {
+	ListenAddress string
+	Port          int
+	// PublicIP is advertised in relay candidates and must be reachable by
+	// clients
+	PublicIP     net.IP
+	Realm        string
+	RelayPortMin uint16
+	RelayPortMax uint16
+	// Secret is shared with the signaling server, which mints TURN REST API
+	// credentials for every joined participant
+	Secret string
+}
+
+// URLs are the ICE server URLs clients use to reach the relay over UDP and TCP
+func (c Config) URLs() []string {
+	hostPort := net.JoinHostPort(c.PublicIP.String(), strconv.Itoa(c.Port))
+	return []string{
+		"turn:" + hostPort + "?transport=udp",
+		"turn:" + hostPort + "?transport=tcp",
+	}
+}
+
+// Authorizer reports whether a participant may allocate relays. It is called
+// with the participant ID embedded in the credential username.
+type Authorizer func(participantID string) bool
+
+// Server is a TURN relay running in-process next to the SFU
+type Server struct {
+	turn *turn.Server
+}
+
+// NewServer binds the UDP and TCP listeners and starts serving. Only
+// credentials minted with Secret for participants accepted by authorize are
+// let through.
+func NewServer(cfg Config, authorize Authorizer) (*Server, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("relay: shared secret is required")
+	}
+
+	address := net.JoinHostPort(cfg.ListenAddress, strconv.Itoa(cfg.Port))
+
+	udpConn, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for TURN on udp %s: %w", address, err)
+	}
+
+	tcpListener, err := net.Listen("tcp4", address)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("failed to listen for TURN on tcp %s: %w", address, err)
+	}
+
+	generator := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: cfg.PublicIP,
+			Address:      cfg.ListenAddress,
+			MinPort:      cfg.RelayPortMin,
+			MaxPort:      cfg.RelayPortMax,
+		}
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       cfg.Realm,
+		AuthHandler: authHandler(cfg.Secret, authorize),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpConn, RelayAddressGenerator: generator()},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: generator()},
+		},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, fmt.Errorf("failed to start TURN server: %w", err)
+	}
+
+	return &Server{turn: server}, nil
+}
+
+// authHandler accepts TURN REST API credentials ("<expiry>:<participant id>")
+// signed with secret, and only for participants the signaling server knows
+func authHandler(secret string, authorize Authorizer) turn.AuthHandler {
+	verify := turn.LongTermTURNRESTAuthHandler(secret, nil)
+
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		_, participantID, found := strings.Cut(username, ":")
+		if !found || participantID == "" || !authorize(participantID) {
+			return nil, false
+		}
+		return verify(username, realm, srcAddr)
+	}
+}
+
+// Close stops the listeners and drops all allocations
+func (s *Server) Close() error {
+	return s.turn.Close()
+}
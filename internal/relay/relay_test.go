@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func restCredentials(secret, participantID string, expiresAt time.Time) (string, string) {
+	username := fmt.Sprintf("%d:%s", expiresAt.Unix(), participantID)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func startTestServer(t *testing.T, authorize Authorizer) Config {
+	t.Helper()
+
+	cfg := Config{
+		ListenAddress: "127.0.0.1",
+		Port:          freePort(t),
+		PublicIP:      net.ParseIP("127.0.0.1"),
+		Realm:         "kaamos",
+		RelayPortMin:  50000,
+		RelayPortMax:  50100,
+		Secret:        "secret",
+	}
+
+	server, err := NewServer(cfg, authorize)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	return cfg
+}
+
+func allocate(t *testing.T, cfg Config, username, password string) error {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	address := net.JoinHostPort(cfg.PublicIP.String(), fmt.Sprint(cfg.Port))
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: address,
+		TURNServerAddr: address,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          cfg.Realm,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	if err != nil {
+		return err
+	}
+	return relayConn.Close()
+}
+
+func TestConfigURLs(t *testing.T) {
+	cfg := Config{PublicIP: net.ParseIP("203.0.113.7"), Port: 3478}
+	assert.Equal(t, []string{
+		"turn:203.0.113.7:3478?transport=udp",
+		"turn:203.0.113.7:3478?transport=tcp",
+	}, cfg.URLs())
+}
+
+func TestNewServerRequiresSecret(t *testing.T) {
+	_, err := NewServer(Config{}, func(string) bool { return true })
+	assert.Error(t, err)
+}
+
+func TestAllocate(t *testing.T) {
+	cfg := startTestServer(t, func(participantID string) bool {
+		return participantID == "alice"
+	})
+
+	username, password := restCredentials(cfg.Secret, "alice", time.Now().Add(time.Hour))
+	assert.NoError(t, allocate(t, cfg, username, password))
+}
+
+func TestAllocateRejectsUnknownParticipant(t *testing.T) {
+	cfg := startTestServer(t, func(participantID string) bool {
+		return participantID == "alice"
+	})
+
+	username, password := restCredentials(cfg.Secret, "mallory", time.Now().Add(time.Hour))
+	assert.Error(t, allocate(t, cfg, username, password))
+}
+
+func TestAllocateRejectsBadCredentials(t *testing.T) {
+	cfg := startTestServer(t, func(string) bool { return true })
+
+	username, password := restCredentials("other-secret", "alice", time.Now().Add(time.Hour))
+	assert.Error(t, allocate(t, cfg, username, password))
+
+	username, password = restCredentials(cfg.Secret, "alice", time.Now().Add(-time.Minute))
+	assert.Error(t, allocate(t, cfg, username, password))
+}
@@ -0,0 +1,86 @@
+package signaling
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// TokenSubprotocol is the WebSocket subprotocol a client offers alongside its
+// JWT: Sec-WebSocket-Protocol: kaamos, <jwt>
+const TokenSubprotocol = "kaamos"
+
+var ErrInvalidToken = errors.New("invalid access token")
+
+// TokenClaims mirrors the claims minted by the HTTP API for hosts and guests
+type TokenClaims struct {
+	Slug string          `json:"slug"`
+	Role ParticipantRole `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// tokenFromRequest looks for a JWT in the "token" query parameter or in the
+// subprotocol list of the upgrade request.
+func tokenFromRequest(r *http.Request) string {
+	if token := strings.TrimSpace(r.URL.Query().Get("token")); token != "" {
+		return token
+	}
+
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol != TokenSubprotocol {
+			return protocol
+		}
+	}
+
+	return ""
+}
+
+// verifyToken checks the signature, expiry and room binding of a JWT
+func (s *Server) verifyToken(tokenString, slug string) (*TokenClaims, error) {
+	if tokenString == "" {
+		return nil, fmt.Errorf("%w: token is missing", ErrInvalidToken)
+	}
+
+	claims := &TokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return s.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if claims.Slug != slug {
+		return nil, fmt.Errorf("%w: token issued for another room", ErrInvalidToken)
+	}
+
+	if claims.Role != RoleHost && claims.Role != RoleGuest {
+		return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidToken, claims.Role)
+	}
+
+	return claims, nil
+}
+
+// participantID derives the ID a participant is known by in the room from
+// its token identity. The same token always joins as the same participant,
+// and clients cannot pick the ID of someone else.
+func participantID(identity string) string {
+	sum := sha256.Sum256([]byte("participant:" + identity))
+	return hex.EncodeToString(sum[:8])
+}
+
+// tokenIdentity names whoever holds a token: its jti when set, otherwise a
+// digest of the token itself, so that reconnecting with the same token
+// matches either way
+func tokenIdentity(token string, claims *TokenClaims) string {
+	if claims.ID != "" {
+		return claims.ID
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
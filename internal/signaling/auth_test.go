@@ -0,0 +1,190 @@
+package signaling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyToken(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	claims, err := server.verifyToken(signTestToken(t, "room1", RoleHost, time.Hour), "room1")
+	require.NoError(t, err)
+	require.Equal(t, RoleHost, claims.Role)
+
+	claims, err = server.verifyToken(signTestToken(t, "room1", RoleGuest, time.Hour), "room1")
+	require.NoError(t, err)
+	require.Equal(t, RoleGuest, claims.Role)
+}
+
+func TestVerifyTokenRejects(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	foreignToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"slug": "room1",
+		"role": "host",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("another-secret"))
+	require.NoError(t, err)
+
+	noExpiryToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"slug": "room1",
+		"role": "host",
+	}).SignedString([]byte(testJWTSecret))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"missing token", ""},
+		{"garbage", "not-a-jwt"},
+		{"wrong secret", foreignToken},
+		{"expired", signTestToken(t, "room1", RoleHost, -time.Minute)},
+		{"no expiry", noExpiryToken},
+		{"other room", signTestToken(t, "room2", RoleHost, time.Hour)},
+		{"unknown role", signTestToken(t, "room1", "admin", time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := server.verifyToken(tt.token, "room1")
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws/room1?token=query-token", nil)
+	assert.Equal(t, "query-token", tokenFromRequest(req))
+
+	req = httptest.NewRequest(http.MethodGet, "/ws/room1", nil)
+	req.Header.Set("Sec-WebSocket-Protocol", TokenSubprotocol+", header-token")
+	assert.Equal(t, "header-token", tokenFromRequest(req))
+
+	req = httptest.NewRequest(http.MethodGet, "/ws/room1", nil)
+	assert.Equal(t, "", tokenFromRequest(req))
+}
+
+func TestWebSocketRejectsInvalidQueryToken(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	server.rooms["room1"] = NewRoom("room1")
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/room1?token=" +
+		signTestToken(t, "room2", RoleHost, time.Hour)
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestWebSocketHostFromSubprotocol(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	server.rooms["room1"] = NewRoom("room1")
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/room1"
+	dialer := websocket.Dialer{
+		Subprotocols: []string{TokenSubprotocol, signTestToken(t, "room1", RoleHost, time.Hour)},
+	}
+
+	conn, resp, err := dialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, TokenSubprotocol, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	require.NoError(t, conn.WriteJSON(Message{Type: MessageTypeJoin}))
+
+	var ack Message
+	require.NoError(t, conn.ReadJSON(&ack))
+	require.Equal(t, MessageTypeJoin, ack.Type)
+
+	stats := server.GetRoomStats("room1")
+	require.True(t, stats.HasHost)
+	require.Equal(t, 1, stats.InRoomCount)
+}
+
+func TestWebSocketRejectsMissingToken(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	server.rooms["room1"] = NewRoom("room1")
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/room1"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteJSON(Message{Type: MessageTypeJoin}))
+
+	var response struct {
+		Type MessageType `json:"type"`
+		Data ErrorData   `json:"data"`
+	}
+	require.NoError(t, conn.ReadJSON(&response))
+	require.Equal(t, MessageTypeError, response.Type)
+	require.Equal(t, "UNAUTHORIZED", response.Data.Code)
+	stats := server.GetRoomStats("room1")
+	require.False(t, stats.HasHost)
+	require.Zero(t, stats.GuestsCount)
+}
+
+func TestWebSocketRejectsMalformedJoin(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	server.rooms["room1"] = NewRoom("room1")
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/room1"
+
+	for _, data := range []interface{}{"token", []string{"token"}, map[string]interface{}{"last_seq": "1"}} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, conn.WriteJSON(Message{Type: MessageTypeJoin, Data: data}))
+
+		var response struct {
+			Type MessageType `json:"type"`
+			Data ErrorData   `json:"data"`
+		}
+		require.NoError(t, conn.ReadJSON(&response))
+		assert.Equal(t, MessageTypeError, response.Type)
+		assert.Equal(t, "INVALID_JOIN", response.Data.Code)
+		_, _, err = conn.ReadMessage()
+		assert.Error(t, err, "the connection is closed")
+		conn.Close()
+	}
+}
+
+func TestTokenIdentity(t *testing.T) {
+	token := signTestToken(t, "room1", RoleHost, time.Hour)
+	claims := &TokenClaims{}
+
+	assert.Equal(t, tokenIdentity(token, claims), tokenIdentity(token, claims))
+	assert.NotEqual(t, tokenIdentity(token, claims), tokenIdentity(token+"x", claims))
+
+	claims.ID = "jti"
+	assert.Equal(t, "jti", tokenIdentity(token, claims))
+}
@@ -0,0 +1,120 @@
+package signaling
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// allocationInterval limits how often a subscriber's estimate is spread over
+// its down tracks; the estimator reports far more often than layers can
+// usefully change
+const allocationInterval = 500 * time.Millisecond
+
+// onBandwidthEstimate receives the target bitrate of the congestion
+// controller for p's outgoing media
+func (p *Participant) onBandwidthEstimate(bitrate int) {
+	p.mediaMutex.Lock()
+	now := time.Now()
+	if p.mediaClosed || now.Sub(p.lastAllocation) < allocationInterval {
+		p.mediaMutex.Unlock()
+		return
+	}
+	p.lastAllocation = now
+	p.mediaMutex.Unlock()
+
+	p.allocateBandwidth(uint64(max(bitrate, 0)))
+}
+
+// allocateBandwidth spreads a bandwidth estimate over the tracks p receives.
+// Audio is always forwarded. Every video track first gets its cheapest layer,
+// in a stable order, and video that does not fit is paused until the link
+// recovers. What is left then upgrades the tracks in automatic layer
+// selection one by one.
+func (p *Participant) allocateBandwidth(estimate uint64) {
+	p.mediaMutex.Lock()
+	downTracks := make([]*DownTrack, 0, len(p.subscriptions))
+	for _, downTrack := range p.subscriptions {
+		downTracks = append(downTracks, downTrack)
+	}
+	p.mediaMutex.Unlock()
+
+	slices.SortFunc(downTracks, func(a, b *DownTrack) int {
+		if c := cmp.Compare(a.track.ParticipantID, b.track.ParticipantID); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.track.ID, b.track.ID)
+	})
+
+	now := time.Now()
+	budget := int64(estimate)
+
+	var video []*DownTrack
+	for _, downTrack := range downTracks {
+		if downTrack.Paused() {
+			continue
+		}
+		if downTrack.track.Kind == webrtc.RTPCodecTypeVideo {
+			video = append(video, downTrack)
+			continue
+		}
+		if layer := downTrack.track.pickLayer(LayerLow, 0); layer != nil {
+			budget -= int64(layer.Bitrate(now))
+		}
+	}
+
+	granted := make(map[*DownTrack]uint64, len(video))
+	auto := make(map[*DownTrack]bool, len(video))
+	for _, downTrack := range video {
+		minimum, automatic := downTrack.layerDemand(now)
+		if int64(minimum) > budget {
+			downTrack.setCongested(true)
+			continue
+		}
+		budget -= int64(minimum)
+		granted[downTrack] = minimum
+		auto[downTrack] = automatic
+	}
+
+	for _, downTrack := range video {
+		share, ok := granted[downTrack]
+		if !ok {
+			continue
+		}
+		downTrack.setCongested(false)
+		if !auto[downTrack] {
+			continue
+		}
+
+		if layer := downTrack.track.pickLayer(LayerAuto, share+uint64(budget)); layer != nil {
+			if bitrate := layer.Bitrate(now); bitrate > share {
+				budget -= int64(bitrate - share)
+				share = bitrate
+			}
+		}
+
+		// A zero estimate would mean none is known yet
+		downTrack.SetEstimate(max(share, 1))
+	}
+}
+
+// layerDemand returns the bitrate of the cheapest layer the subscriber
+// accepts, the lowest one in automatic selection and otherwise the layer it
+// asked for, and whether the layer is selected automatically
+func (d *DownTrack) layerDemand(now time.Time) (uint64, bool) {
+	d.mutex.Lock()
+	quality := d.quality
+	d.mutex.Unlock()
+
+	auto := quality == LayerAuto
+	if auto {
+		quality = LayerLow
+	}
+	layer := d.track.pickLayer(quality, 0)
+	if layer == nil {
+		return 0, auto
+	}
+	return layer.Bitrate(now), auto
+}
@@ -0,0 +1,117 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// subscribedTrack publishes a track with measured layers and subscribes p
+func subscribedTrack(p *Participant, publisherID, id string, kind webrtc.RTPCodecType, bitrates map[string]uint64) (*PublishedTrack, *DownTrack) {
+	now := time.Now()
+	track := newTestPublishedTrack(publisherID, id, kind, nil)
+	track.layers = nil
+	for rid, bitrate := range bitrates {
+		track.layers = append(track.layers, measuredLayer(rid, bitrate, now))
+	}
+	downTrack := track.NewDownTrack(p.ID)
+
+	if p.subscriptions == nil {
+		p.subscriptions = make(map[*PublishedTrack]*DownTrack)
+	}
+	p.subscriptions[track] = downTrack
+	return track, downTrack
+}
+
+func TestAllocateBandwidth(t *testing.T) {
+	subscriber := &Participant{ID: "guest1"}
+	_, audio := subscribedTrack(subscriber, "alice", "audio", webrtc.RTPCodecTypeAudio, map[string]uint64{"": 40_000})
+	_, alice := subscribedTrack(subscriber, "alice", "video", webrtc.RTPCodecTypeVideo, map[string]uint64{"q": 150_000, "f": 1_500_000})
+	_, bob := subscribedTrack(subscriber, "bob", "video", webrtc.RTPCodecTypeVideo, map[string]uint64{"q": 150_000, "f": 1_500_000})
+
+	// Room for the low layers plus one upgrade, in a stable order
+	subscriber.allocateBandwidth(2_000_000)
+	assert.False(t, alice.Stats().Congested)
+	assert.False(t, bob.Stats().Congested)
+	assert.Equal(t, "f", alice.targetLayer)
+	assert.Equal(t, "q", bob.targetLayer)
+
+	// Only one low layer fits; the other video is paused
+	subscriber.allocateBandwidth(250_000)
+	assert.False(t, alice.Stats().Congested)
+	assert.True(t, bob.Stats().Congested)
+	assert.Equal(t, "q", alice.targetLayer)
+	assert.False(t, audio.Stats().Congested, "audio is never paused")
+
+	// Not even audio and one low layer fit
+	subscriber.allocateBandwidth(100_000)
+	assert.True(t, alice.Stats().Congested)
+	assert.True(t, bob.Stats().Congested)
+
+	// The link recovers
+	subscriber.allocateBandwidth(5_000_000)
+	assert.False(t, alice.Stats().Congested)
+	assert.False(t, bob.Stats().Congested)
+	assert.Equal(t, "f", alice.targetLayer)
+	assert.Equal(t, "f", bob.targetLayer)
+}
+
+func TestAllocateBandwidthKeepsExplicitLayers(t *testing.T) {
+	subscriber := &Participant{ID: "guest1"}
+	_, alice := subscribedTrack(subscriber, "alice", "video", webrtc.RTPCodecTypeVideo, map[string]uint64{"q": 150_000, "f": 1_500_000})
+	_, bob := subscribedTrack(subscriber, "bob", "video", webrtc.RTPCodecTypeVideo, map[string]uint64{"q": 150_000, "f": 1_500_000})
+	require.NoError(t, alice.SetLayer(LayerHigh))
+
+	// The explicit high layer is accounted for before any upgrade
+	subscriber.allocateBandwidth(2_000_000)
+	assert.Equal(t, "f", alice.targetLayer)
+	assert.Equal(t, "q", bob.targetLayer)
+
+	// It is paused rather than downgraded when it no longer fits
+	subscriber.allocateBandwidth(1_000_000)
+	assert.True(t, alice.Stats().Congested)
+	assert.Equal(t, "f", alice.targetLayer)
+	assert.False(t, bob.Stats().Congested)
+}
+
+func TestCongestionResumeRequestsKeyframe(t *testing.T) {
+	keyframes, sent := capturingRequester(1234, 0)
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, keyframes)
+	downTrack, writer := boundDownTrack(t, track, "guest1", 1111)
+
+	track.forward(track.layers[0], sourcePacket(1, 3000))
+	downTrack.setCongested(true)
+	track.forward(track.layers[0], sourcePacket(2, 6000))
+	require.Len(t, writer.headers, 1)
+
+	downTrack.setCongested(false)
+	assert.Len(t, *sent, 1)
+	track.forward(track.layers[0], sourcePacket(3, 9000))
+	require.Len(t, writer.headers, 2)
+	assert.Equal(t, writer.headers[0].SequenceNumber+1, writer.headers[1].SequenceNumber)
+}
+
+func TestPeerConnectionsGetOwnEstimators(t *testing.T) {
+	api, err := NewWebRTCAPI(ICENetworkConfig{}, BandwidthEstimationConfig{
+		InitialBitrate: 300_000,
+		MinBitrate:     100_000,
+		MaxBitrate:     1_000_000,
+	})
+	require.NoError(t, err)
+	defer api.Close()
+
+	first, firstEstimator, err := api.NewPeerConnectionWithEstimator(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer first.Close()
+	second, secondEstimator, err := api.NewPeerConnectionWithEstimator(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer second.Close()
+
+	require.NotNil(t, firstEstimator)
+	require.NotNil(t, secondEstimator)
+	assert.NotSame(t, firstEstimator, secondEstimator)
+	assert.Equal(t, 300_000, firstEstimator.GetTargetBitrate())
+}
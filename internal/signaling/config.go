@@ -0,0 +1,81 @@
+package signaling
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Limits bounds the resources a single server instance hands out
+type Limits struct {
+	MaxRooms               int // concurrent unexpired rooms
+	MaxParticipantsPerRoom int // default and upper bound for RoomPolicy.MaxParticipants
+	MaxKnockingPerRoom     int // guests waiting to be let in, on top of MaxParticipants
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxRooms:               50,
+		MaxParticipantsPerRoom: 4,
+		MaxKnockingPerRoom:     10,
+	}
+}
+
+// Config carries everything the signaling server needs from the
+// application configuration
+type Config struct {
+	JWTSecret       string
+	Limits          Limits
+	RoomIdleTimeout time.Duration
+	JanitorInterval time.Duration
+	JoinTimeout     time.Duration
+	ICEServers      []webrtc.ICEServer
+	TURN            TURNConfig
+	// API creates peer connections; nil means one with default network and
+	// bandwidth estimation settings
+	API *WebRTCAPI
+	// KeyframeRequestInterval is the minimum time between keyframe
+	// requests sent to a publisher for the same track
+	KeyframeRequestInterval time.Duration
+	// NACKBufferSize is how many recent packets of each video layer are
+	// kept to answer retransmission requests; 0 disables retransmissions
+	NACKBufferSize int
+	// ReconnectWindow keeps a participant whose connection dropped, media
+	// included, for its client to resume the session; 0 disables resuming
+	ReconnectWindow time.Duration
+	// HostGracePeriod holds the seat of a host whose connection dropped so
+	// that it can reclaim the room; 0 gives the seat up right away
+	HostGracePeriod time.Duration
+	// HostAbsencePolicy applies to rooms whose policy does not set one
+	HostAbsencePolicy HostAbsencePolicy
+	// AllowedOrigins restricts WebSocket upgrades by Origin header; empty or
+	// "*" allows any origin
+	AllowedOrigins []string
+}
+
+// TURNConfig enables per-participant ephemeral credentials for relays that
+// share Secret with this server
+type TURNConfig struct {
+	URLs          []string
+	Secret        string
+	CredentialTTL time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Limits:                  DefaultLimits(),
+		RoomIdleTimeout:         24 * time.Hour,
+		JanitorInterval:         time.Minute,
+		JoinTimeout:             10 * time.Second,
+		KeyframeRequestInterval: 500 * time.Millisecond,
+		NACKBufferSize:          512,
+		ReconnectWindow:         30 * time.Second,
+		HostGracePeriod:         time.Minute,
+		HostAbsencePolicy:       HostAbsenceHold,
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+}
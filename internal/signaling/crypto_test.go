@@ -96,12 +96,16 @@ func TestRoomPublicKeys(t *testing.T) {
 }
 
 func TestKeyExchangeIntegration(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
+	defer server.Shutdown()
 	room := NewRoom("test-room")
 	server.rooms["test-room"] = room
 
 	mockConn1 := &MockWebSocketConn{} // user1 
 	mockConn2 := &MockWebSocketConn{} // user2
+	// Shutdown closes them
+	mockConn1.On("Close").Return(nil).Maybe()
+	mockConn2.On("Close").Return(nil).Maybe()
 
 	participant1 := &Participant{
 		ID:     "user1",
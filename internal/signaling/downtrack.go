@@ -0,0 +1,556 @@
+package signaling
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// PublishedTrack is a track a participant sends into the room. Its packets
+// are fanned out to one DownTrack per subscriber. A simulcast track has one
+// layer per RID; each subscriber receives exactly one of them.
+type PublishedTrack struct {
+	ID            string
+	StreamID      string
+	Kind          webrtc.RTPCodecType
+	Codec         webrtc.RTPCodecCapability
+	ParticipantID string
+
+	// bufferSize is the retransmission history kept per layer and per
+	// subscriber; 0 for audio
+	bufferSize int
+
+	mutex      sync.RWMutex
+	source     TrackSource
+	muted      bool
+	layers     []*simulcastLayer
+	downTracks map[string]*DownTrack // subscriber ID -> down track
+}
+
+func newPublishedTrack(participantID string, remote *webrtc.TrackRemote, bufferSize int) *PublishedTrack {
+	track := &PublishedTrack{
+		ID:            remote.ID(),
+		StreamID:      remote.StreamID(),
+		Kind:          remote.Kind(),
+		Codec:         remote.Codec().RTPCodecCapability,
+		ParticipantID: participantID,
+		source:        defaultTrackSource(remote.Kind()),
+		downTracks:    make(map[string]*DownTrack),
+	}
+	// Retransmissions are only negotiated for video
+	if track.Kind == webrtc.RTPCodecTypeVideo {
+		track.bufferSize = bufferSize
+	}
+	return track
+}
+
+// Source returns what the track captures
+func (t *PublishedTrack) Source() TrackSource {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.source
+}
+
+func (t *PublishedTrack) setSource(source TrackSource) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.source = source
+}
+
+// info describes the track for the tracks message
+func (t *PublishedTrack) info() TrackInfo {
+	return TrackInfo{
+		ParticipantID: t.ParticipantID,
+		TrackID:       t.ID,
+		StreamID:      t.StreamID,
+		Kind:          t.Kind.String(),
+		Source:        t.Source(),
+		Muted:         t.Muted(),
+	}
+}
+
+// Muted reports whether the host stopped the track from being forwarded
+func (t *PublishedTrack) Muted() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.muted
+}
+
+// setMuted stops or restarts forwarding the track to every subscriber and
+// reports whether that changed anything. Subscribers continue after a mute
+// without a gap in sequence numbers, on a fresh keyframe for video.
+func (t *PublishedTrack) setMuted(muted bool) bool {
+	t.mutex.Lock()
+	if t.muted == muted {
+		t.mutex.Unlock()
+		return false
+	}
+	t.muted = muted
+	downTracks := t.downTrackList()
+	t.mutex.Unlock()
+
+	if !muted {
+		for _, downTrack := range downTracks {
+			downTrack.restart()
+		}
+	}
+	return true
+}
+
+// addLayer registers an encoding of the track as it starts arriving and
+// lets every subscriber reconsider which layer it receives
+func (t *PublishedTrack) addLayer(rid string, keyframes *keyframeRequester, nacks *nackGenerator) *simulcastLayer {
+	layer := &simulcastLayer{
+		rid:       rid,
+		keyframes: keyframes,
+		buffer:    newPacketBuffer(t.bufferSize),
+		nacks:     nacks,
+	}
+
+	t.mutex.Lock()
+	t.layers = append(t.layers, layer)
+	downTracks := t.downTrackList()
+	t.mutex.Unlock()
+
+	for _, downTrack := range downTracks {
+		downTrack.selectLayer()
+	}
+	return layer
+}
+
+// layer returns the layer with the given RID, or nil
+func (t *PublishedTrack) layer(rid string) *simulcastLayer {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for _, layer := range t.layers {
+		if layer.rid == rid {
+			return layer
+		}
+	}
+	return nil
+}
+
+// Simulcast reports whether the track is published in several encodings
+func (t *PublishedTrack) Simulcast() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return len(t.layers) > 1 || (len(t.layers) == 1 && t.layers[0].rid != "")
+}
+
+// pickLayer returns the layer a subscriber should receive
+func (t *PublishedTrack) pickLayer(quality string, estimate uint64) *simulcastLayer {
+	t.mutex.RLock()
+	layers := append([]*simulcastLayer(nil), t.layers...)
+	t.mutex.RUnlock()
+
+	return pickLayer(layers, quality, estimate, time.Now())
+}
+
+// NewDownTrack creates the down track feeding this track to a subscriber,
+// replacing any previous one for the same subscriber
+func (t *PublishedTrack) NewDownTrack(subscriberID string) *DownTrack {
+	downTrack := &DownTrack{
+		track:   t,
+		quality: LayerAuto,
+	}
+	if t.bufferSize > 0 {
+		downTrack.history = make([]sentPacket, t.bufferSize)
+	}
+
+	t.mutex.Lock()
+	t.downTracks[subscriberID] = downTrack
+	t.mutex.Unlock()
+
+	downTrack.selectLayer()
+	return downTrack
+}
+
+// DownTrack returns the down track of a subscriber, or nil
+func (t *PublishedTrack) DownTrack(subscriberID string) *DownTrack {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.downTracks[subscriberID]
+}
+
+// RemoveDownTrack stops feeding this track to a subscriber
+func (t *PublishedTrack) RemoveDownTrack(subscriberID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.downTracks, subscriberID)
+}
+
+func (t *PublishedTrack) downTrackList() []*DownTrack {
+	downTracks := make([]*DownTrack, 0, len(t.downTracks))
+	for _, downTrack := range t.downTracks {
+		downTracks = append(downTracks, downTrack)
+	}
+	return downTracks
+}
+
+// forward writes a packet received on one layer to every subscriber; each
+// down track drops the layers it is not receiving
+func (t *PublishedTrack) forward(layer *simulcastLayer, packet *rtp.Packet) {
+	now := time.Now()
+	layer.record(len(packet.Payload), now)
+	layer.buffer.add(packet)
+	layer.nacks.received(packet.SequenceNumber, now)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.muted {
+		return
+	}
+	for _, downTrack := range t.downTracks {
+		downTrack.WriteRTP(layer, packet)
+	}
+}
+
+// DownTrackStats counts what a down track delivered to its subscriber
+type DownTrackStats struct {
+	SSRC           uint32 `json:"ssrc"`
+	PacketsSent    uint64 `json:"packets_sent"`
+	BytesSent      uint64 `json:"bytes_sent"`
+	PacketsDropped uint64 `json:"packets_dropped"`
+	Paused         bool   `json:"paused"`
+	Congested      bool   `json:"congested"`
+	Layer          string `json:"layer,omitempty"`
+	// PacketsRequested counts packets the subscriber NACKed; those not
+	// retransmitted had left the buffer
+	PacketsRequested      uint64 `json:"packets_requested"`
+	PacketsRetransmitted  uint64 `json:"packets_retransmitted"`
+	RetransmissionsMissed uint64 `json:"retransmissions_missed"`
+}
+
+// DownTrack is the per-subscriber leg of a PublishedTrack. It implements
+// webrtc.TrackLocal and rewrites every packet onto its own SSRC, payload
+// type, sequence number and timestamp space, so the subscriber sees one
+// continuous stream even when forwarding is paused and resumed or moved to
+// another simulcast layer.
+type DownTrack struct {
+	track *PublishedTrack
+	// sender carries this track on the subscriber's PeerConnection; guarded
+	// by the subscriber's mediaMutex
+	sender *webrtc.RTPSender
+
+	mutex       sync.Mutex
+	bound       bool
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	clockRate   uint32
+	writeStream webrtc.TrackLocalWriter
+
+	// quality is the layer the subscriber asked for; estimate is its
+	// latest bandwidth estimate in bits per second, used by LayerAuto
+	quality  string
+	estimate uint64
+	// currentLayer is being forwarded; targetLayer replaces it on its next
+	// keyframe
+	currentLayer string
+	targetLayer  string
+	switching    bool
+
+	paused bool
+	// congested pauses video the subscriber's bandwidth cannot carry
+	congested bool
+	// resync makes the next packet continue the outgoing sequence and
+	// timestamp spaces instead of following the source's
+	resync    bool
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+	// history maps recently sent sequence numbers to their source packets
+	history []sentPacket
+
+	stats DownTrackStats
+}
+
+// Bind is called by pion once the subscriber's connection has negotiated
+// the transceiver carrying this track
+func (d *DownTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := matchCodec(d.track.Codec, ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.bound = true
+	d.ssrc = ctx.SSRC()
+	d.payloadType = codec.PayloadType
+	d.clockRate = codec.ClockRate
+	d.writeStream = ctx.WriteStream()
+	d.stats.SSRC = uint32(ctx.SSRC())
+	// A rebind (renegotiation) continues the stream the subscriber has seen
+	d.resync = d.started
+
+	return codec, nil
+}
+
+func (d *DownTrack) Unbind(webrtc.TrackLocalContext) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.bound = false
+	d.writeStream = nil
+	return nil
+}
+
+func (d *DownTrack) ID() string                { return d.track.ID }
+func (d *DownTrack) RID() string               { return "" }
+func (d *DownTrack) StreamID() string          { return d.track.StreamID }
+func (d *DownTrack) Kind() webrtc.RTPCodecType { return d.track.Kind }
+
+// WriteRTP rewrites a source packet received on the given layer for this
+// subscriber and sends it. Packets are dropped while the track is unbound
+// or paused, and for layers other than the one being forwarded.
+func (d *DownTrack) WriteRTP(layer *simulcastLayer, packet *rtp.Packet) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	rid := layer.rid
+	if !d.bound {
+		return
+	}
+	if rid != d.currentLayer || d.switching && rid == d.targetLayer {
+		// Move to the target layer only where the subscriber's decoder
+		// can follow
+		if d.paused || d.congested || rid != d.targetLayer || !isKeyframe(d.track.Codec.MimeType, packet.Payload) {
+			return
+		}
+		d.currentLayer = rid
+		d.switching = false
+		d.stats.Layer = rid
+		d.resync = d.started
+	}
+	if d.paused || d.congested {
+		d.stats.PacketsDropped++
+		return
+	}
+
+	now := time.Now()
+	if d.resync {
+		d.resync = false
+		// Continue right after the last packet sent, advancing the
+		// timestamp by the wall-clock time since then
+		elapsed := uint32(now.Sub(d.lastWrite).Seconds() * float64(d.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		d.seqOffset = packet.SequenceNumber - (d.lastSeq + 1)
+		d.tsOffset = packet.Timestamp - (d.lastTS + elapsed)
+	}
+
+	header := d.rewriteHeader(packet)
+	header.SequenceNumber = packet.SequenceNumber - d.seqOffset
+	header.Timestamp = packet.Timestamp - d.tsOffset
+
+	if _, err := d.writeStream.WriteRTP(&header, packet.Payload); err != nil {
+		d.stats.PacketsDropped++
+		return
+	}
+	d.recordSent(layer, &header, packet.SequenceNumber)
+
+	d.started = true
+	d.lastSeq = header.SequenceNumber
+	d.lastTS = header.Timestamp
+	d.lastWrite = now
+	d.stats.PacketsSent++
+	d.stats.BytesSent += uint64(len(packet.Payload))
+}
+
+// rewriteHeader moves a source header onto this subscriber's SSRC and
+// payload type. The caller holds the mutex.
+func (d *DownTrack) rewriteHeader(packet *rtp.Packet) rtp.Header {
+	header := packet.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	// Extension IDs were negotiated with the publisher, not with us
+	header.Extension = false
+	header.Extensions = nil
+	return header
+}
+
+// SetLayer sets the simulcast layer the subscriber wants: LayerLow,
+// LayerMid, LayerHigh, or LayerAuto to follow its bandwidth estimate
+func (d *DownTrack) SetLayer(quality string) error {
+	if !validLayerQuality(quality) {
+		return fmt.Errorf("unknown layer %q", quality)
+	}
+
+	d.mutex.Lock()
+	d.quality = quality
+	d.mutex.Unlock()
+
+	d.selectLayer()
+	return nil
+}
+
+// SetEstimate records the subscriber's bandwidth estimate in bits per
+// second and, in LayerAuto, moves it to the layer that fits
+func (d *DownTrack) SetEstimate(bitrate uint64) {
+	d.mutex.Lock()
+	d.estimate = bitrate
+	auto := d.quality == LayerAuto
+	d.mutex.Unlock()
+
+	if auto {
+		d.selectLayer()
+	}
+}
+
+// selectLayer picks the layer to forward from the requested quality and
+// asks its publisher for the keyframe the switch waits for
+func (d *DownTrack) selectLayer() {
+	d.mutex.Lock()
+	quality, estimate := d.quality, d.estimate
+	d.mutex.Unlock()
+
+	layer := d.track.pickLayer(quality, estimate)
+	if layer == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	changed := layer.rid != d.targetLayer
+	d.targetLayer = layer.rid
+	d.switching = layer.rid != d.currentLayer || !d.started
+	if !d.started && layer.rid == "" {
+		// Without simulcast there is nothing to wait for
+		d.currentLayer = ""
+		d.switching = false
+	}
+	switching := d.switching
+	d.mutex.Unlock()
+
+	if changed && switching {
+		layer.keyframes.Request()
+	}
+}
+
+// RequestKeyframe asks the publisher for a keyframe on the layer this
+// subscriber receives, or is about to receive
+func (d *DownTrack) RequestKeyframe() {
+	d.mutex.Lock()
+	rid := d.currentLayer
+	if d.switching {
+		rid = d.targetLayer
+	}
+	d.mutex.Unlock()
+
+	if layer := d.track.layer(rid); layer != nil {
+		layer.keyframes.Request()
+	}
+}
+
+// Layer returns the RID of the layer being forwarded
+func (d *DownTrack) Layer() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.currentLayer
+}
+
+// Pause stops forwarding to this subscriber without renegotiating
+func (d *DownTrack) Pause() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.paused = true
+	d.stats.Paused = true
+}
+
+// Resume restarts forwarding. For video a keyframe is requested, since the
+// subscriber cannot decode anything before the next one.
+func (d *DownTrack) Resume() {
+	d.mutex.Lock()
+	wasPaused := d.paused
+	d.paused = false
+	d.stats.Paused = false
+	restarted := wasPaused && !d.congested
+	if restarted && d.started {
+		d.resync = true
+	}
+	d.mutex.Unlock()
+
+	if restarted {
+		d.RequestKeyframe()
+	}
+}
+
+// restart continues forwarding after the source was interrupted, as after
+// a host mute: packets continue the sequence sent so far instead of
+// exposing the gap, which subscribers would otherwise NACK
+func (d *DownTrack) restart() {
+	d.mutex.Lock()
+	if d.started {
+		d.resync = true
+	}
+	d.mutex.Unlock()
+
+	d.RequestKeyframe()
+}
+
+// setCongested pauses or resumes forwarding as the subscriber's bandwidth
+// allows, independently of Pause and Resume
+func (d *DownTrack) setCongested(congested bool) {
+	d.mutex.Lock()
+	restarted := d.congested && !congested && !d.paused
+	d.congested = congested
+	d.stats.Congested = congested
+	if restarted && d.started {
+		d.resync = true
+	}
+	d.mutex.Unlock()
+
+	if restarted {
+		d.RequestKeyframe()
+	}
+}
+
+// Paused reports whether forwarding is paused
+func (d *DownTrack) Paused() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.paused
+}
+
+// Stats returns a snapshot of the down track counters
+func (d *DownTrack) Stats() DownTrackStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.stats
+}
+
+// matchCodec picks the negotiated codec for a source codec: an exact match
+// including fmtp first, then any codec with the same MIME type
+func matchCodec(codec webrtc.RTPCodecCapability, negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	for _, candidate := range negotiated {
+		if strings.EqualFold(candidate.MimeType, codec.MimeType) && candidate.SDPFmtpLine == codec.SDPFmtpLine {
+			return candidate, true
+		}
+	}
+	for _, candidate := range negotiated {
+		if strings.EqualFold(candidate.MimeType, codec.MimeType) {
+			return candidate, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
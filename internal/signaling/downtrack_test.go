@@ -0,0 +1,167 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capturingWriter records the packets a down track writes
+type capturingWriter struct {
+	headers []rtp.Header
+}
+
+func (w *capturingWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.headers = append(w.headers, *header)
+	return len(payload), nil
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// bindContext is the part of webrtc.TrackLocalContext a down track uses
+type bindContext struct {
+	webrtc.TrackLocalContext
+	codecs []webrtc.RTPCodecParameters
+	ssrc   webrtc.SSRC
+	writer *capturingWriter
+}
+
+func (c *bindContext) CodecParameters() []webrtc.RTPCodecParameters { return c.codecs }
+func (c *bindContext) SSRC() webrtc.SSRC                            { return c.ssrc }
+func (c *bindContext) WriteStream() webrtc.TrackLocalWriter         { return c.writer }
+
+var vp8Parameters = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+	PayloadType:        96,
+}
+
+func newTestPublishedTrack(participantID, id string, kind webrtc.RTPCodecType, keyframes *keyframeRequester) *PublishedTrack {
+	return &PublishedTrack{
+		ID:            id,
+		StreamID:      participantID + "-stream",
+		Kind:          kind,
+		Codec:         webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		ParticipantID: participantID,
+		source:        defaultTrackSource(kind),
+		layers:        []*simulcastLayer{{keyframes: keyframes}},
+		downTracks:    make(map[string]*DownTrack),
+	}
+}
+
+func boundDownTrack(t *testing.T, track *PublishedTrack, subscriberID string, ssrc webrtc.SSRC) (*DownTrack, *capturingWriter) {
+	downTrack := track.NewDownTrack(subscriberID)
+	writer := &capturingWriter{}
+	codec, err := downTrack.Bind(&bindContext{
+		codecs: []webrtc.RTPCodecParameters{vp8Parameters},
+		ssrc:   ssrc,
+		writer: writer,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, webrtc.PayloadType(96), codec.PayloadType)
+	return downTrack, writer
+}
+
+func sourcePacket(seq uint16, ts uint32) *rtp.Packet {
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    100,
+			SequenceNumber: seq,
+			Timestamp:      ts,
+			SSRC:           1234,
+		},
+		Payload: []byte{0, 1, 2, 3},
+	}
+	// An extension negotiated with the publisher only
+	if err := packet.Header.SetExtension(3, []byte{1}); err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func TestDownTrackBindRejectsUnknownCodec(t *testing.T) {
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, nil)
+	downTrack := track.NewDownTrack("guest1")
+
+	_, err := downTrack.Bind(&bindContext{
+		codecs: []webrtc.RTPCodecParameters{{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+			PayloadType:        102,
+		}},
+		writer: &capturingWriter{},
+	})
+	assert.ErrorIs(t, err, webrtc.ErrUnsupportedCodec)
+}
+
+func TestDownTrackRewritesPackets(t *testing.T) {
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, nil)
+	first, firstWriter := boundDownTrack(t, track, "guest1", 1111)
+	_, secondWriter := boundDownTrack(t, track, "guest2", 2222)
+
+	track.forward(track.layers[0], sourcePacket(500, 9000))
+	track.forward(track.layers[0], sourcePacket(501, 12000))
+
+	require.Len(t, firstWriter.headers, 2)
+	require.Len(t, secondWriter.headers, 2)
+	for _, header := range firstWriter.headers {
+		assert.Equal(t, uint32(1111), header.SSRC)
+		assert.Equal(t, uint8(96), header.PayloadType)
+		assert.False(t, header.Extension)
+		assert.Empty(t, header.Extensions)
+	}
+	assert.Equal(t, uint32(2222), secondWriter.headers[0].SSRC)
+	assert.Equal(t, uint16(1), firstWriter.headers[1].SequenceNumber-firstWriter.headers[0].SequenceNumber)
+	assert.Equal(t, uint32(3000), firstWriter.headers[1].Timestamp-firstWriter.headers[0].Timestamp)
+
+	assert.Equal(t, DownTrackStats{SSRC: 1111, PacketsSent: 2, BytesSent: 8}, first.Stats())
+}
+
+func TestDownTrackPauseResume(t *testing.T) {
+	keyframes, sent := capturingRequester(1234, 0)
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, keyframes)
+	downTrack, writer := boundDownTrack(t, track, "guest1", 1111)
+
+	track.forward(track.layers[0], sourcePacket(500, 9000))
+
+	downTrack.Pause()
+	assert.True(t, downTrack.Paused())
+	for seq := uint16(501); seq < 511; seq++ {
+		track.forward(track.layers[0], sourcePacket(seq, uint32(seq)*3000))
+	}
+	require.Len(t, writer.headers, 1)
+	assert.Empty(t, *sent)
+
+	time.Sleep(10 * time.Millisecond)
+	downTrack.Resume()
+	assert.Len(t, *sent, 1, "resuming video asks the publisher for a keyframe")
+
+	track.forward(track.layers[0], sourcePacket(600, 600*3000))
+	require.Len(t, writer.headers, 2)
+
+	// The subscriber sees no gap in sequence numbers and time moves forward
+	assert.Equal(t, writer.headers[0].SequenceNumber+1, writer.headers[1].SequenceNumber)
+	assert.Greater(t, writer.headers[1].Timestamp-writer.headers[0].Timestamp, uint32(0))
+	assert.Less(t, writer.headers[1].Timestamp-writer.headers[0].Timestamp, uint32(90000))
+
+	stats := downTrack.Stats()
+	assert.Equal(t, uint64(2), stats.PacketsSent)
+	assert.Equal(t, uint64(10), stats.PacketsDropped)
+	assert.False(t, stats.Paused)
+}
+
+func TestDownTrackDropsUntilBound(t *testing.T) {
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, nil)
+	downTrack := track.NewDownTrack("guest1")
+
+	track.forward(track.layers[0], sourcePacket(500, 9000))
+	assert.Zero(t, downTrack.Stats().PacketsSent)
+
+	track.RemoveDownTrack("guest1")
+	assert.Nil(t, track.DownTrack("guest1"))
+}
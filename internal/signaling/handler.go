@@ -1,6 +1,8 @@
 package signaling
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
@@ -16,6 +18,8 @@ func (s *Server) handleMessage(slug string, participant *Participant, message *M
 		return
 	}
 
+	room.Touch(time.Now(), s.config.RoomIdleTimeout)
+
 	switch message.Type {
 	case MessageTypeAllow:
 		s.handleAllow(room, participant, message)
@@ -23,6 +27,20 @@ func (s *Server) handleMessage(slug string, participant *Participant, message *M
 		s.handleDeny(room, participant, message)
 	case MessageTypeOffer, MessageTypeAnswer, MessageTypeICECandidate:
 		s.handleWebRTCMessage(room, participant, message)
+	case MessageTypeSetLayer:
+		s.handleSetLayer(room, participant, message)
+	case MessageTypeTrackSource:
+		s.handleTrackSource(room, participant, message)
+	case MessageTypeSubscribe, MessageTypeUnsubscribe:
+		s.handleSubscription(room, participant, message)
+	case MessageTypeKick:
+		s.handleKick(room, participant, message)
+	case MessageTypeMute:
+		s.handleMute(room, participant, message)
+	case MessageTypeLockRoom:
+		s.handleLockRoom(room, participant, message)
+	case MessageTypeTransferHost:
+		s.handleTransferHost(room, participant, message)
 	case MessageTypeKeyExchange:
 		s.handleKeyExchange(room, participant, message)
 	case MessageTypeEncrypted:
@@ -32,6 +50,17 @@ func (s *Server) handleMessage(slug string, participant *Participant, message *M
 	}
 }
 
+func sendError(conn WebSocketConnInterface, code, message string) {
+	conn.WriteJSON(&Message{
+		Type: MessageTypeError,
+		Data: ErrorData{
+			Code:    code,
+			Message: message,
+		},
+		Timestamp: time.Now(),
+	})
+}
+
 func (s *Server) handleKeyExchange(room *Room, participant *Participant, message *Message) {
 	data, ok := message.Data.(map[string]interface{})
 	if !ok {
@@ -48,15 +77,7 @@ func (s *Server) handleKeyExchange(room *Room, participant *Participant, message
 	if err := room.SavePublicKey(participant.ID, publicKey); err != nil {
 		log.Printf("Failed to save public key for %s: %v", participant.ID, err)
 
-		errorMsg := &Message{
-			Type: MessageTypeError,
-			Data: ErrorData{
-				Code:    "INVALID_PUBLIC_KEY",
-				Message: "Invalid public key format",
-			},
-			Timestamp: time.Now(),
-		}
-		participant.Conn.WriteJSON(errorMsg)
+		sendError(participant.Conn, "INVALID_PUBLIC_KEY", "Invalid public key format")
 		return
 	}
 
@@ -99,7 +120,7 @@ func (s *Server) handleEncryptedData(room *Room, participant *Participant, messa
 
 func (s *Server) handleAllow(room *Room, participant *Participant, message *Message) {
 	// Only the host can allow
-	if participant.Role != RoleHost {
+	if !room.IsHost(participant) {
 		return
 	}
 
@@ -109,6 +130,10 @@ func (s *Server) handleAllow(room *Room, participant *Participant, message *Mess
 	}
 
 	err := room.AllowGuest(guestID)
+	if errors.Is(err, ErrRoomFull) {
+		sendError(participant.Conn, "ROOM_FULL", "Room has reached its participant limit")
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to allow guest: %v", err)
 		return
@@ -123,20 +148,23 @@ func (s *Server) handleAllow(room *Room, participant *Participant, message *Mess
 		Timestamp: time.Now(),
 	}
 	room.BroadcastToGuest(guestID, allowMessage)
-
-	// Notify all participants about the updated participant list
-	participantsMessage := &Message{
-		Type:      MessageTypeParticipants,
+	room.BroadcastToGuest(guestID, &Message{
+		Type:      MessageTypeTracks,
 		RoomID:    room.Slug,
-		Data:      room.GetParticipantsData(),
+		Data:      room.TracksData(),
 		Timestamp: time.Now(),
+	})
+	if guest := room.GetParticipant(guestID); guest != nil {
+		s.subscribeToRoom(room, guest)
 	}
-	room.BroadcastToAll(participantsMessage, "")
+
+	// Notify all participants about the updated participant list
+	broadcastParticipants(room)
 }
 
 func (s *Server) handleDeny(room *Room, participant *Participant, message *Message) {
 	// Only the host can deny
-	if participant.Role != RoleHost {
+	if !room.IsHost(participant) {
 		return
 	}
 
@@ -165,53 +193,161 @@ func (s *Server) handleDeny(room *Room, participant *Participant, message *Messa
 	guest.Conn.Close()
 }
 
-func (s *Server) handleWebRTCMessage(room *Room, participant *Participant, message *Message) {
-	if participant.PC == nil {
+func (s *Server) handleSetLayer(room *Room, participant *Participant, message *Message) {
+	data, ok := message.Data.(map[string]interface{})
+	if !ok {
+		log.Printf("Invalid set_layer data format")
+		return
+	}
+
+	publisherID, _ := data["participant_id"].(string)
+	trackID, _ := data["track_id"].(string)
+	layer, _ := data["layer"].(string)
+
+	var downTrack *DownTrack
+	if publisher := room.GetParticipant(publisherID); publisher != nil {
+		for _, track := range publisher.PublishedTracks() {
+			if track.ID == trackID {
+				downTrack = participant.Subscription(track)
+				break
+			}
+		}
+	}
+	if downTrack == nil {
+		sendError(participant.Conn, "TRACK_NOT_FOUND", "Not subscribed to this track")
 		return
 	}
 
+	if err := downTrack.SetLayer(layer); err != nil {
+		sendError(participant.Conn, "INVALID_LAYER", "Layer must be one of auto, low, mid, high")
+	}
+}
+
+// handleTrackSource records what one of the sender's tracks captures. A
+// track that is already published is updated and the room is told; otherwise
+// the source is applied when the track arrives.
+func (s *Server) handleTrackSource(room *Room, participant *Participant, message *Message) {
 	data, ok := message.Data.(map[string]interface{})
 	if !ok {
-		log.Printf("Invalid data for WebRTC message")
+		log.Printf("Invalid track_source data format")
 		return
 	}
 
-	switch message.Type {
-	case MessageTypeOffer:
-		sdpStr, _ := data["sdp"].(string)
-		if err := participant.PC.SetRemoteDescription(webrtc.SessionDescription{
-			Type: webrtc.SDPTypeOffer,
-			SDP:  sdpStr,
-		}); err != nil {
-			log.Printf("Failed to set remote description: %v", err)
-			return
+	trackID, _ := data["track_id"].(string)
+	source, _ := data["source"].(string)
+	if trackID == "" || !validTrackSource(TrackSource(source)) {
+		sendError(participant.Conn, "INVALID_TRACK_SOURCE", "Source must be one of camera, microphone, screen, screen_audio")
+		return
+	}
+
+	participant.mediaMutex.Lock()
+	track := participant.publishedTrack(trackID)
+	if track == nil {
+		if participant.announcedSources == nil {
+			participant.announcedSources = make(map[string]TrackSource)
 		}
+		participant.announcedSources[trackID] = TrackSource(source)
+	}
+	participant.mediaMutex.Unlock()
 
-		answer, err := participant.PC.CreateAnswer(nil)
-		if err != nil {
-			log.Printf("Failed to create answer: %v", err)
-			return
+	if track == nil {
+		// The policy is enforced when the track arrives; checking now only
+		// tells the publisher early
+		if err := room.CheckScreenShare(participant.ID, TrackSource(source)); err != nil {
+			sendError(participant.Conn, screenShareErrorCode(err), err.Error())
+		}
+		return
+	}
+
+	if err := room.SetTrackSource(track, TrackSource(source)); err != nil {
+		sendError(participant.Conn, screenShareErrorCode(err), err.Error())
+		return
+	}
+	s.broadcastTracks(room)
+}
+
+// handleSubscription starts or stops forwarding the listed tracks to the
+// sender. The choice sticks until changed, so it also holds when automatic
+// subscription would say otherwise. All changes share one renegotiation.
+func (s *Server) handleSubscription(room *Room, participant *Participant, message *Message) {
+	if participant.PC == nil || participant.negotiator == nil {
+		return
+	}
+	if !room.IsAdmitted(participant) {
+		sendError(participant.Conn, "NOT_ADMITTED", "Wait for the host to let you in")
+		return
+	}
+
+	data, ok := message.Data.(map[string]interface{})
+	if !ok {
+		log.Printf("Invalid %s data format", message.Type)
+		return
+	}
+	refs, _ := data["tracks"].([]interface{})
+	if len(refs) == 0 {
+		sendError(participant.Conn, "INVALID_SUBSCRIPTION", "No tracks listed")
+		return
+	}
+
+	subscribe := message.Type == MessageTypeSubscribe
+	changed := false
+	for _, raw := range refs {
+		ref, _ := raw.(map[string]interface{})
+		publisherID, _ := ref["participant_id"].(string)
+		trackID, _ := ref["track_id"].(string)
+
+		track := room.PublishedTrack(publisherID, trackID)
+		if track == nil || publisherID == participant.ID {
+			sendError(participant.Conn, "TRACK_NOT_FOUND", fmt.Sprintf("Track %s of %s is not published", trackID, publisherID))
+			continue
+		}
+		if subscribe && !participant.Profile.receives(track.Kind) {
+			sendError(participant.Conn, "SUBSCRIBE_NOT_ALLOWED", fmt.Sprintf("Media profile %s does not receive %s", participant.Profile, track.Kind))
+			continue
 		}
 
-		if err := participant.PC.SetLocalDescription(answer); err != nil {
-			log.Printf("Failed to set local description: %v", err)
-			return
+		participant.setSubscribed(track, subscribe)
+		if !subscribe {
+			if len(participant.removeForwardedTracks([]*PublishedTrack{track})) > 0 {
+				changed = true
+			}
+			continue
+		}
+		added, err := participant.addForwardedTrack(room, track)
+		if err != nil {
+			log.Printf("Failed to subscribe %s to track %s: %v", participant.ID, track.ID, err)
+			continue
 		}
+		changed = changed || added
+	}
+
+	if changed {
+		participant.negotiator.Negotiate()
+	}
+}
+
+func (s *Server) handleWebRTCMessage(room *Room, participant *Participant, message *Message) {
+	if participant.PC == nil || participant.negotiator == nil {
+		return
+	}
+
+	data, ok := message.Data.(map[string]interface{})
+	if !ok {
+		log.Printf("Invalid data for WebRTC message")
+		return
+	}
 
-		participant.Conn.WriteJSON(&Message{
-			Type:      MessageTypeAnswer,
-			RoomID:    room.Slug,
-			Data:      map[string]interface{}{"sdp": answer.SDP, "type": answer.Type.String()},
-			Timestamp: time.Now(),
-		})
+	switch message.Type {
+	case MessageTypeOffer:
+		sdpStr, _ := data["sdp"].(string)
+		if err := participant.negotiator.HandleOffer(sdpStr); err != nil {
+			log.Printf("Failed to handle offer from %s: %v", participant.ID, err)
+		}
 
 	case MessageTypeAnswer:
 		sdpStr, _ := data["sdp"].(string)
-		if err := participant.PC.SetRemoteDescription(webrtc.SessionDescription{
-			Type: webrtc.SDPTypeAnswer,
-			SDP:  sdpStr,
-		}); err != nil {
-			log.Printf("Failed to set remote description (answer): %v", err)
+		if err := participant.negotiator.HandleAnswer(sdpStr); err != nil {
+			log.Printf("Failed to handle answer from %s: %v", participant.ID, err)
 		}
 
 	case MessageTypeICECandidate:
@@ -228,7 +364,7 @@ func (s *Server) handleWebRTCMessage(room *Room, participant *Participant, messa
 			SDPMLineIndex: &lineIndex,
 		}
 
-		if err := participant.PC.AddICECandidate(candidate); err != nil {
+		if err := participant.negotiator.AddICECandidate(candidate); err != nil {
 			log.Printf("Failed to add ICE candidate: %v", err)
 		}
 	}
@@ -6,10 +6,12 @@ import (
 	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHandleWebRTCMessageSFU(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
+	defer server.Shutdown()
 	room := NewRoom("test-room")
 
 	mockGuestConn := &MockWebSocketConn{}
@@ -37,6 +39,7 @@ func TestHandleWebRTCMessageSFU(t *testing.T) {
 
 	room.AddParticipant(host)
 	room.AddParticipant(guest)
+	guest.negotiator = server.newParticipantNegotiator(room, guest)
 
 	// Create a valid SDP offer
 	// offer, err := pc.CreateOffer(nil)
@@ -83,7 +86,8 @@ func TestHandleWebRTCMessageSFU(t *testing.T) {
 }
 
 func TestHandleWebRTCMessageNoPC(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
+	defer server.Shutdown()
 	room := NewRoom("test-room")
 
 	mockGuestConn := &MockWebSocketConn{}
@@ -109,12 +113,16 @@ func TestHandleWebRTCMessageNoPC(t *testing.T) {
 }
 
 func TestHandleAllow(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
+	defer server.Shutdown()
 	room := NewRoom("test-room")
 	server.rooms["test-room"] = room
 
 	mockHostConn := &MockWebSocketConn{}
 	mockGuestConn := &MockWebSocketConn{}
+	// Shutdown closes them
+	mockHostConn.On("Close").Return(nil).Maybe()
+	mockGuestConn.On("Close").Return(nil).Maybe()
 
 	host := &Participant{
 		ID:     "host1",
@@ -138,7 +146,7 @@ func TestHandleAllow(t *testing.T) {
 		Data: "guest1",
 	}
 
-	mockGuestConn.On("WriteJSON", mock.Anything).Return(nil).Times(2) // Allow + Participants
+	mockGuestConn.On("WriteJSON", mock.Anything).Return(nil).Times(3) // Allow + Tracks + Participants
 	mockHostConn.On("WriteJSON", mock.Anything).Return(nil).Once()    // Participants
 
 	server.handleAllow(room, host, message)
@@ -149,7 +157,8 @@ func TestHandleAllow(t *testing.T) {
 }
 
 func TestHandleDeny(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
+	defer server.Shutdown()
 	room := NewRoom("test-room")
 
 	mockHostConn := &MockWebSocketConn{}
@@ -187,3 +196,141 @@ func TestHandleDeny(t *testing.T) {
 	assert.Equal(t, 0, len(room.Guests))
 	mockGuestConn.AssertExpectations(t)
 }
+
+func TestHandleTrackSource(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+	room.Policy.ScreenShareHostOnly = true
+
+	hostConn := &MockWebSocketConn{}
+	guestConn := &MockWebSocketConn{}
+	hostConn.On("WriteJSON", mock.Anything).Return(nil)
+	guestConn.On("WriteJSON", mock.Anything).Return(nil)
+
+	host := &Participant{ID: "host1", Role: RoleHost, Conn: hostConn}
+	guest := &Participant{ID: "guest1", Role: RoleGuest, Conn: guestConn}
+	room.AddParticipant(host)
+	room.AddParticipant(guest)
+
+	isError := func(code string) interface{} {
+		return mock.MatchedBy(func(msg *Message) bool {
+			data, ok := msg.Data.(ErrorData)
+			return msg.Type == MessageTypeError && ok && data.Code == code
+		})
+	}
+	announce := func(participant *Participant, trackID, source string) {
+		server.handleTrackSource(room, participant, &Message{
+			Type: MessageTypeTrackSource,
+			Data: map[string]interface{}{"track_id": trackID, "source": source},
+		})
+	}
+
+	announce(host, "screen", "window")
+	hostConn.AssertCalled(t, "WriteJSON", isError("INVALID_TRACK_SOURCE"))
+
+	// Announced before the track arrives
+	announce(host, "screen", "screen")
+	assert.Equal(t, TrackSourceScreen, host.announcedSources["screen"])
+
+	announce(guest, "screen", "screen")
+	guestConn.AssertCalled(t, "WriteJSON", isError("SCREEN_SHARE_NOT_ALLOWED"))
+
+	// Announced for a track that is already published
+	track := newTestPublishedTrack(host.ID, "video", webrtc.RTPCodecTypeVideo, nil)
+	host.Tracks = append(host.Tracks, track)
+	assert.NoError(t, room.AddTrack(track))
+
+	announce(host, "video", "screen")
+	assert.Equal(t, TrackSourceScreen, track.Source())
+	assert.NotContains(t, host.announcedSources, "video")
+	hostConn.AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(*TracksData)
+		return msg.Type == MessageTypeTracks && ok && len(data.Tracks) == 1 && data.Tracks[0].Source == TrackSourceScreen
+	}))
+}
+
+func TestHandleSubscription(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+
+	hostConn := &MockWebSocketConn{}
+	manualConn := &MockWebSocketConn{}
+	autoConn := &MockWebSocketConn{}
+	for _, conn := range []*MockWebSocketConn{hostConn, manualConn, autoConn} {
+		conn.On("WriteJSON", mock.Anything).Return(nil)
+	}
+
+	host := &Participant{ID: "host1", Role: RoleHost, Conn: hostConn}
+	manual := &Participant{ID: "guest1", Role: RoleGuest, Conn: manualConn, manualSubscribe: true}
+	auto := &Participant{ID: "guest2", Role: RoleGuest, Conn: autoConn}
+	for _, p := range []*Participant{host, manual, auto} {
+		require.NoError(t, room.AddParticipant(p))
+		if p.Role == RoleGuest {
+			require.NoError(t, room.AllowGuest(p.ID))
+		}
+		require.NoError(t, server.initSFU(room, p))
+		defer p.closeMedia()
+	}
+
+	audio := newTestPublishedTrack(host.ID, "audio", webrtc.RTPCodecTypeAudio, nil)
+	video := newTestPublishedTrack(host.ID, "video", webrtc.RTPCodecTypeVideo, nil)
+	host.Tracks = append(host.Tracks, audio, video)
+	for _, track := range host.Tracks {
+		require.NoError(t, room.AddTrack(track))
+		server.addTrackToParticipants(room, host.ID, track)
+	}
+
+	assert.Nil(t, manual.Subscription(audio))
+	assert.Nil(t, manual.Subscription(video))
+	assert.NotNil(t, auto.Subscription(audio))
+	assert.NotNil(t, auto.Subscription(video))
+
+	update := func(p *Participant, messageType MessageType, refs ...map[string]interface{}) {
+		tracks := make([]interface{}, len(refs))
+		for i, ref := range refs {
+			tracks[i] = ref
+		}
+		server.handleSubscription(room, p, &Message{
+			Type: messageType,
+			Data: map[string]interface{}{"tracks": tracks},
+		})
+	}
+	ref := func(participantID, trackID string) map[string]interface{} {
+		return map[string]interface{}{"participant_id": participantID, "track_id": trackID}
+	}
+
+	update(manual, MessageTypeSubscribe, ref("host1", "video"))
+	assert.NotNil(t, manual.Subscription(video))
+	assert.Nil(t, manual.Subscription(audio))
+
+	update(manual, MessageTypeUnsubscribe, ref("host1", "video"))
+	assert.Nil(t, manual.Subscription(video))
+	assert.Nil(t, video.DownTrack(manual.ID))
+
+	// An unsubscribe overrides automatic subscription for good
+	update(auto, MessageTypeUnsubscribe, ref("host1", "audio"))
+	assert.Nil(t, auto.Subscription(audio))
+	server.addTrackToParticipants(room, host.ID, audio)
+	assert.Nil(t, auto.Subscription(audio))
+	assert.NotNil(t, auto.Subscription(video))
+
+	isError := func(code string) interface{} {
+		return mock.MatchedBy(func(msg *Message) bool {
+			data, ok := msg.Data.(ErrorData)
+			return msg.Type == MessageTypeError && ok && data.Code == code
+		})
+	}
+	update(manual, MessageTypeSubscribe, ref("host1", "screen"))
+	manualConn.AssertCalled(t, "WriteJSON", isError("TRACK_NOT_FOUND"))
+	update(host, MessageTypeSubscribe, ref("host1", "audio"))
+	hostConn.AssertCalled(t, "WriteJSON", isError("TRACK_NOT_FOUND"))
+	update(manual, MessageTypeSubscribe)
+	manualConn.AssertCalled(t, "WriteJSON", isError("INVALID_SUBSCRIPTION"))
+
+	manual.Profile = MediaProfileAudioOnly
+	update(manual, MessageTypeSubscribe, ref("host1", "video"))
+	manualConn.AssertCalled(t, "WriteJSON", isError("SUBSCRIBE_NOT_ALLOWED"))
+	assert.Nil(t, manual.Subscription(video))
+}
@@ -0,0 +1,149 @@
+package signaling
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// requireHost answers moderation from anyone but the host with an error
+func requireHost(room *Room, participant *Participant) bool {
+	if room.IsHost(participant) {
+		return true
+	}
+	sendError(participant.Conn, "FORBIDDEN", "Only the host can moderate the room")
+	return false
+}
+
+// moderationTarget reads the participant_id a moderation message applies to
+func moderationTarget(message *Message) string {
+	data, ok := message.Data.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	targetID, _ := data["participant_id"].(string)
+	return targetID
+}
+
+// broadcastModeration tells the room about the outcome of a moderation action
+func broadcastModeration(room *Room, host *Participant, messageType MessageType, data interface{}) {
+	room.BroadcastToAll(&Message{
+		Type:      messageType,
+		From:      host.ID,
+		RoomID:    room.Slug,
+		Data:      data,
+		Timestamp: time.Now(),
+	}, "")
+}
+
+// handleKick removes an admitted guest from the room. Its media is torn down
+// right away, before its connection closes; leaving then completes as usual.
+func (s *Server) handleKick(room *Room, participant *Participant, message *Message) {
+	if !requireHost(room, participant) {
+		return
+	}
+
+	guest, err := room.KickGuest(moderationTarget(message))
+	if err != nil {
+		sendError(participant.Conn, "PARTICIPANT_NOT_FOUND", "No such guest in the room")
+		return
+	}
+	log.Printf("Participant %s kicked from room %s by %s", guest.ID, room.Slug, participant.ID)
+
+	data := ModerationTargetData{ParticipantID: guest.ID}
+	guest.Conn.WriteJSON(&Message{
+		Type:      MessageTypeKick,
+		From:      participant.ID,
+		RoomID:    room.Slug,
+		Data:      data,
+		Timestamp: time.Now(),
+	})
+	s.teardownMedia(room, guest)
+	guest.Conn.Close()
+
+	broadcastModeration(room, participant, MessageTypeKick, data)
+	broadcastParticipants(room)
+}
+
+// handleMute stops or restarts forwarding a participant's audio, video or
+// both at the SFU, whatever its client does
+func (s *Server) handleMute(room *Room, participant *Participant, message *Message) {
+	if !requireHost(room, participant) {
+		return
+	}
+
+	data, _ := message.Data.(map[string]interface{})
+	kind, _ := data["kind"].(string)
+	muted, ok := data["muted"].(bool)
+	if !ok {
+		muted = true
+	}
+
+	var kinds []webrtc.RTPCodecType
+	switch kind {
+	case "":
+		kinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+	case "audio", "video":
+		kinds = []webrtc.RTPCodecType{webrtc.NewRTPCodecType(kind)}
+	default:
+		sendError(participant.Conn, "INVALID_MUTE", "Kind must be audio, video or empty for both")
+		return
+	}
+
+	target := room.GetParticipant(moderationTarget(message))
+	if target == nil || !room.IsAdmitted(target) {
+		sendError(participant.Conn, "PARTICIPANT_NOT_FOUND", "No such participant in the room")
+		return
+	}
+
+	changed := false
+	for _, kind := range kinds {
+		if target.setMuted(kind, muted) {
+			changed = true
+		}
+	}
+
+	broadcastModeration(room, participant, MessageTypeMute, MuteData{
+		ParticipantID: target.ID,
+		Kind:          kind,
+		Muted:         muted,
+	})
+	if changed {
+		s.broadcastTracks(room)
+	}
+}
+
+// handleLockRoom locks or unlocks the room; a locked room rejects joining
+// guests instead of letting them knock
+func (s *Server) handleLockRoom(room *Room, participant *Participant, message *Message) {
+	if !requireHost(room, participant) {
+		return
+	}
+
+	data, _ := message.Data.(map[string]interface{})
+	locked, ok := data["locked"].(bool)
+	if !ok {
+		locked = true
+	}
+
+	room.SetLocked(locked)
+	broadcastModeration(room, participant, MessageTypeLockRoom, LockRoomData{Locked: locked})
+}
+
+// handleTransferHost hands the host role to an admitted guest
+func (s *Server) handleTransferHost(room *Room, participant *Participant, message *Message) {
+	if !requireHost(room, participant) {
+		return
+	}
+
+	targetID := moderationTarget(message)
+	if err := room.TransferHost(targetID); err != nil {
+		sendError(participant.Conn, "PARTICIPANT_NOT_FOUND", "No such guest in the room")
+		return
+	}
+	log.Printf("Host of room %s transferred from %s to %s", room.Slug, participant.ID, targetID)
+
+	broadcastModeration(room, participant, MessageTypeTransferHost, ModerationTargetData{ParticipantID: targetID})
+	broadcastParticipants(room)
+}
@@ -0,0 +1,199 @@
+package signaling
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// moderatedRoom returns a room with a host and an admitted guest whose
+// connections accept any message
+func moderatedRoom(t *testing.T) (*Room, *Participant, *Participant) {
+	room := NewRoom("test-room")
+
+	hostConn := &MockWebSocketConn{}
+	guestConn := &MockWebSocketConn{}
+	hostConn.On("WriteJSON", mock.Anything).Return(nil)
+	guestConn.On("WriteJSON", mock.Anything).Return(nil)
+
+	host := &Participant{ID: "host1", Role: RoleHost, Conn: hostConn}
+	guest := &Participant{ID: "guest1", Role: RoleGuest, Conn: guestConn}
+	require.NoError(t, room.AddParticipant(host))
+	require.NoError(t, room.AddParticipant(guest))
+	require.NoError(t, room.AllowGuest(guest.ID))
+	return room, host, guest
+}
+
+func isErrorCode(code string) interface{} {
+	return mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(ErrorData)
+		return msg.Type == MessageTypeError && ok && data.Code == code
+	})
+}
+
+func TestHandleKick(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, host, guest := moderatedRoom(t)
+	guest.Conn.(*MockWebSocketConn).On("Close").Return(nil)
+	require.NoError(t, server.initSFU(room, guest))
+
+	track := newTestPublishedTrack(guest.ID, "video", webrtc.RTPCodecTypeVideo, nil)
+	guest.Tracks = append(guest.Tracks, track)
+	require.NoError(t, room.AddTrack(track))
+
+	kick := &Message{Type: MessageTypeKick, Data: map[string]interface{}{"participant_id": "guest1"}}
+
+	server.handleKick(room, guest, kick)
+	guest.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isErrorCode("FORBIDDEN"))
+	require.NotNil(t, room.GetParticipant(guest.ID))
+
+	server.handleKick(room, host, kick)
+	assert.Nil(t, room.GetParticipant(guest.ID))
+	assert.Empty(t, room.Tracks)
+	assert.Equal(t, webrtc.PeerConnectionStateClosed, guest.PC.ConnectionState())
+	guest.Conn.(*MockWebSocketConn).AssertCalled(t, "Close")
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(ModerationTargetData)
+		return msg.Type == MessageTypeKick && ok && data.ParticipantID == "guest1"
+	}))
+
+	server.handleKick(room, host, kick)
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isErrorCode("PARTICIPANT_NOT_FOUND"))
+}
+
+func TestHandleMute(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, host, guest := moderatedRoom(t)
+
+	track := newTestPublishedTrack(guest.ID, "video", webrtc.RTPCodecTypeVideo, nil)
+	guest.Tracks = append(guest.Tracks, track)
+	require.NoError(t, room.AddTrack(track))
+	_, writer := boundDownTrack(t, track, host.ID, 1111)
+
+	mute := func(muted bool) {
+		server.handleMute(room, host, &Message{
+			Type: MessageTypeMute,
+			Data: map[string]interface{}{"participant_id": "guest1", "kind": "video", "muted": muted},
+		})
+	}
+
+	track.forward(track.layers[0], sourcePacket(100, 3000))
+	mute(true)
+	assert.True(t, track.Muted())
+	track.forward(track.layers[0], sourcePacket(101, 6000))
+	track.forward(track.layers[0], sourcePacket(102, 9000))
+	require.Len(t, writer.headers, 1)
+
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(MuteData)
+		return msg.Type == MessageTypeMute && ok && data.ParticipantID == "guest1" && data.Kind == "video" && data.Muted
+	}))
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(*TracksData)
+		return msg.Type == MessageTypeTracks && ok && len(data.Tracks) == 1 && data.Tracks[0].Muted
+	}))
+
+	// Tracks published while muted start muted
+	guest.mediaMutex.Lock()
+	assert.True(t, guest.muted[webrtc.RTPCodecTypeVideo])
+	assert.False(t, guest.muted[webrtc.RTPCodecTypeAudio])
+	guest.mediaMutex.Unlock()
+
+	// Forwarding resumes without exposing the muted packets as a gap
+	mute(false)
+	track.forward(track.layers[0], sourcePacket(103, 12000))
+	require.Len(t, writer.headers, 2)
+	assert.Equal(t, writer.headers[0].SequenceNumber+1, writer.headers[1].SequenceNumber)
+
+	server.handleMute(room, guest, &Message{
+		Type: MessageTypeMute,
+		Data: map[string]interface{}{"participant_id": "host1"},
+	})
+	guest.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isErrorCode("FORBIDDEN"))
+
+	server.handleMute(room, host, &Message{
+		Type: MessageTypeMute,
+		Data: map[string]interface{}{"participant_id": "guest1", "kind": "data"},
+	})
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isErrorCode("INVALID_MUTE"))
+}
+
+func TestHandleLockRoom(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, host, _ := moderatedRoom(t)
+
+	server.handleLockRoom(room, host, &Message{Type: MessageTypeLockRoom, Data: map[string]interface{}{}})
+	assert.True(t, room.GetStats().Locked)
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(LockRoomData)
+		return msg.Type == MessageTypeLockRoom && ok && data.Locked
+	}))
+	assert.ErrorIs(t, room.AddParticipant(&Participant{ID: "guest2", Role: RoleGuest}), ErrRoomLocked)
+
+	server.handleLockRoom(room, host, &Message{Type: MessageTypeLockRoom, Data: map[string]interface{}{"locked": false}})
+	assert.False(t, room.GetStats().Locked)
+	assert.NoError(t, room.AddParticipant(&Participant{ID: "guest2", Role: RoleGuest}))
+}
+
+func TestHandleTransferHost(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, host, guest := moderatedRoom(t)
+
+	transfer := func(from *Participant, to string) {
+		server.handleTransferHost(room, from, &Message{
+			Type: MessageTypeTransferHost,
+			Data: map[string]interface{}{"participant_id": to},
+		})
+	}
+
+	transfer(host, "nobody")
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isErrorCode("PARTICIPANT_NOT_FOUND"))
+
+	transfer(host, guest.ID)
+	assert.True(t, room.IsHost(guest))
+	assert.Equal(t, RoleHost, guest.Role)
+	assert.Equal(t, RoleGuest, host.Role)
+	assert.Same(t, host, room.Guests[host.ID])
+	assert.NotContains(t, room.Guests, guest.ID)
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(ModerationTargetData)
+		return msg.Type == MessageTypeTransferHost && ok && data.ParticipantID == "guest1"
+	}))
+
+	// The previous host lost its moderation rights
+	transfer(host, host.ID)
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isErrorCode("FORBIDDEN"))
+	assert.True(t, room.IsHost(guest))
+}
+
+func TestModerationChecksHostIdentity(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, host, guest := moderatedRoom(t)
+
+	// A connection claiming the host's ID is not the host
+	impostorConn := &MockWebSocketConn{}
+	impostorConn.On("WriteJSON", mock.Anything).Return(nil)
+	impostor := &Participant{ID: host.ID, Role: RoleHost, Status: StatusInRoom, Conn: impostorConn}
+	assert.False(t, room.IsHost(impostor))
+	assert.True(t, room.IsHost(host))
+
+	server.handleKick(room, impostor, &Message{Type: MessageTypeKick, Data: map[string]interface{}{"participant_id": guest.ID}})
+	impostorConn.AssertCalled(t, "WriteJSON", isErrorCode("FORBIDDEN"))
+	assert.NotNil(t, room.GetParticipant(guest.ID))
+
+	server.handleLockRoom(room, impostor, &Message{Type: MessageTypeLockRoom, Data: map[string]interface{}{}})
+	assert.False(t, room.GetStats().Locked)
+
+	knocking := &Participant{ID: "guest2", Role: RoleGuest, Conn: &MockWebSocketConn{}}
+	require.NoError(t, room.AddParticipant(knocking))
+	server.handleAllow(room, impostor, &Message{Type: MessageTypeAllow, Data: knocking.ID})
+	assert.Equal(t, StatusKnocking, knocking.Status)
+}
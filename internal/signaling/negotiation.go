@@ -0,0 +1,298 @@
+package signaling
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// negotiator serializes the SDP exchanges of one participant's
+// PeerConnection following the WebRTC "perfect negotiation" pattern.
+//
+// The client always opens the session with its offer. After that either side
+// may offer: the server does so whenever tracks are added or removed. If both
+// offers cross (glare), the polite side rolls its own offer back and answers
+// the remote one, while the impolite side ignores the remote offer and waits
+// for its answer. pion cannot roll back a local offer, so the server is always
+// the impolite peer and clients are told to be polite in the join ack.
+//
+// Track changes made while an offer is outstanding are coalesced: they only
+// mark negotiation as pending, and a single follow-up offer is sent once the
+// signaling state returns to stable. ICE restarts are coalesced the same way,
+// and a restart offered by the client does away with a pending one of ours.
+// pion cannot restart ICE while it gathers candidates, so a restart also
+// waits for gathering to complete.
+//
+// A failed ICE connection is restarted right away. A disconnected one often
+// recovers by itself, so it is only restarted once it stays disconnected for
+// iceDisconnectedGrace.
+type negotiator struct {
+	pc *webrtc.PeerConnection
+	// send delivers an offer or answer to the client
+	send func(webrtc.SessionDescription) error
+	// onNegotiated, if set, runs after every completed exchange
+	onNegotiated func()
+
+	mutex sync.Mutex
+	// pending is set when the local tracks changed since the last offer
+	pending bool
+	// restartICE is set when the next offer has to gather fresh ICE
+	// credentials
+	restartICE bool
+	// awaitingGathering is set while an ICE restart waits for the current
+	// gathering to complete
+	awaitingGathering bool
+	// ignoringOffer is set while the last client offer lost a collision;
+	// candidates belonging to it are expected to fail
+	ignoringOffer bool
+	// candidates received before the remote description they belong to
+	candidates []webrtc.ICECandidateInit
+
+	// disconnectedGrace is how long a disconnected ICE connection gets to
+	// recover before it is restarted
+	disconnectedGrace time.Duration
+	// timerMutex guards disconnected. ICE states are reported by pion's
+	// agent, which must not wait for n.mutex.
+	timerMutex sync.Mutex
+	// disconnected restarts ICE when the grace period is over
+	disconnected *time.Timer
+}
+
+// iceDisconnectedGrace is how long an ICE connection may stay disconnected
+// before the server restarts it
+const iceDisconnectedGrace = 5 * time.Second
+
+func newNegotiator(pc *webrtc.PeerConnection, send func(webrtc.SessionDescription) error) *negotiator {
+	n := &negotiator{
+		pc:                pc,
+		send:              send,
+		disconnectedGrace: iceDisconnectedGrace,
+	}
+	pc.OnICEGatheringStateChange(n.gatheringStateChanged)
+	return n
+}
+
+// Negotiate requests a server offer reflecting the current senders. It offers
+// right away when the connection is stable and otherwise defers to the
+// exchange in flight.
+func (n *negotiator) Negotiate() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.pending = true
+	if err := n.offerIfPending(); err != nil {
+		log.Printf("Failed to renegotiate: %v", err)
+	}
+}
+
+// HandleOffer applies a client offer and answers it. An offer colliding with
+// our own is ignored: the polite client rolls back, answers ours and offers
+// again afterwards.
+func (n *negotiator) HandleOffer(sdp string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.ignoringOffer = n.pc.SignalingState() != webrtc.SignalingStateStable
+	if n.ignoringOffer {
+		log.Printf("Ignoring colliding offer in signaling state %s", n.pc.SignalingState())
+		return nil
+	}
+
+	if current := n.pc.RemoteDescription(); current != nil && iceUfrag(current.SDP) != iceUfrag(sdp) {
+		log.Printf("Client restarted ICE")
+		n.restartICE = false
+	}
+
+	if err := n.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  sdp,
+	}); err != nil {
+		return fmt.Errorf("failed to set remote offer: %w", err)
+	}
+	n.flushCandidates()
+
+	answer, err := n.pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+	if err := n.pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set local answer: %w", err)
+	}
+	if err := n.send(answer); err != nil {
+		return fmt.Errorf("failed to send answer: %w", err)
+	}
+	n.negotiated()
+
+	return n.offerIfPending()
+}
+
+// RestartICE requests a server offer with fresh ICE credentials, for when
+// the connection to the client broke. Before the client's first offer there
+// is nothing to restart.
+func (n *negotiator) RestartICE() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.pc.RemoteDescription() == nil || n.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+	n.restartICE = true
+	if err := n.offerIfPending(); err != nil {
+		log.Printf("Failed to restart ICE: %v", err)
+	}
+}
+
+// ICEStateChanged restarts ICE when the connection failed, or once it stayed
+// disconnected for the grace period. Any other state cancels a restart that
+// is still waiting.
+func (n *negotiator) ICEStateChanged(state webrtc.ICEConnectionState) {
+	n.timerMutex.Lock()
+	defer n.timerMutex.Unlock()
+
+	if n.disconnected != nil {
+		n.disconnected.Stop()
+		n.disconnected = nil
+	}
+	switch state {
+	case webrtc.ICEConnectionStateFailed:
+		go n.RestartICE()
+	case webrtc.ICEConnectionStateDisconnected:
+		n.disconnected = time.AfterFunc(n.disconnectedGrace, n.RestartICE)
+	}
+}
+
+// HandleAnswer completes a server offer and sends the next one if more
+// changes piled up in the meantime. Answers to offers that were rolled back
+// are dropped.
+func (n *negotiator) HandleAnswer(sdp string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		log.Printf("Ignoring answer in signaling state %s", n.pc.SignalingState())
+		return nil
+	}
+
+	if err := n.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  sdp,
+	}); err != nil {
+		return fmt.Errorf("failed to set remote answer: %w", err)
+	}
+	n.flushCandidates()
+	n.negotiated()
+
+	return n.offerIfPending()
+}
+
+// AddICECandidate adds a remote candidate, holding it back until a remote
+// description is in place
+func (n *negotiator) AddICECandidate(candidate webrtc.ICECandidateInit) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.pc.RemoteDescription() == nil {
+		n.candidates = append(n.candidates, candidate)
+		return nil
+	}
+
+	if err := n.pc.AddICECandidate(candidate); err != nil && !n.ignoringOffer {
+		return err
+	}
+	return nil
+}
+
+// offerIfPending sends an offer when changes or an ICE restart are pending,
+// the connection is stable and the client has already opened the session.
+// Caller must hold n.mutex.
+func (n *negotiator) offerIfPending() error {
+	if !(n.pending || n.restartICE) || n.pc.SignalingState() != webrtc.SignalingStateStable || n.pc.RemoteDescription() == nil {
+		return nil
+	}
+	// The state changes before the gatherer reports it, so a restart
+	// deferred here is picked up by gatheringStateChanged
+	if n.restartICE && n.pc.ICEGatheringState() == webrtc.ICEGatheringStateGathering {
+		n.awaitingGathering = true
+		return nil
+	}
+
+	var options *webrtc.OfferOptions
+	if n.restartICE {
+		options = &webrtc.OfferOptions{ICERestart: true}
+	}
+	offer, err := n.pc.CreateOffer(options)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err := n.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local offer: %w", err)
+	}
+	n.pending = false
+	n.restartICE = false
+	n.awaitingGathering = false
+
+	if err := n.send(offer); err != nil {
+		return fmt.Errorf("failed to send offer: %w", err)
+	}
+	return nil
+}
+
+// gatheringStateChanged sends an ICE restart that waited for gathering to
+// complete. The gatherer reports the change holding its own lock, which
+// n.mutex is taken before, so the offer goes out on its own goroutine.
+func (n *negotiator) gatheringStateChanged(state webrtc.ICEGatheringState) {
+	if state != webrtc.ICEGatheringStateComplete {
+		return
+	}
+	go func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+
+		if !n.awaitingGathering {
+			return
+		}
+		n.awaitingGathering = false
+		if err := n.offerIfPending(); err != nil {
+			log.Printf("Failed to restart ICE: %v", err)
+		}
+	}()
+}
+
+func (n *negotiator) negotiated() {
+	if n.onNegotiated != nil {
+		n.onNegotiated()
+	}
+}
+
+// flushCandidates applies candidates that arrived before the remote
+// description. Caller must hold n.mutex.
+func (n *negotiator) flushCandidates() {
+	for _, candidate := range n.candidates {
+		if err := n.pc.AddICECandidate(candidate); err != nil {
+			log.Printf("Failed to add buffered ICE candidate: %v", err)
+		}
+	}
+	n.candidates = nil
+}
+
+// iceUfrag returns the ICE username fragment of an SDP; a new one means the
+// sender restarted ICE
+func iceUfrag(raw string) string {
+	var desc sdp.SessionDescription
+	if err := desc.UnmarshalString(raw); err != nil {
+		return ""
+	}
+	if ufrag, ok := desc.Attribute("ice-ufrag"); ok {
+		return ufrag
+	}
+	for _, media := range desc.MediaDescriptions {
+		if ufrag, ok := media.Attribute("ice-ufrag"); ok {
+			return ufrag
+		}
+	}
+	return ""
+}
@@ -0,0 +1,289 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// negotiationPeers is a server-side PeerConnection driven by a negotiator and
+// a bare client PeerConnection standing in for the browser
+type negotiationPeers struct {
+	server     *webrtc.PeerConnection
+	client     *webrtc.PeerConnection
+	negotiator *negotiator
+	sent       []webrtc.SessionDescription
+}
+
+func newNegotiationPeers(t *testing.T) *negotiationPeers {
+	t.Helper()
+
+	server, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	peers := &negotiationPeers{server: server, client: client}
+	peers.negotiator = newNegotiator(server, func(desc webrtc.SessionDescription) error {
+		peers.sent = append(peers.sent, desc)
+		return nil
+	})
+	return peers
+}
+
+// clientOffer creates and applies a client offer, returning its SDP
+func (p *negotiationPeers) clientOffer(t *testing.T) string {
+	t.Helper()
+
+	offer, err := p.client.CreateOffer(nil)
+	require.NoError(t, err)
+	require.NoError(t, p.client.SetLocalDescription(offer))
+	return offer.SDP
+}
+
+// clientAnswer applies a server offer on the client and returns its answer
+func (p *negotiationPeers) clientAnswer(t *testing.T, offer webrtc.SessionDescription) string {
+	t.Helper()
+
+	require.Equal(t, webrtc.SDPTypeOffer, offer.Type)
+	require.NoError(t, p.client.SetRemoteDescription(offer))
+	answer, err := p.client.CreateAnswer(nil)
+	require.NoError(t, err)
+	require.NoError(t, p.client.SetLocalDescription(answer))
+	return answer.SDP
+}
+
+// connect performs the client-initiated opening exchange
+func (p *negotiationPeers) connect(t *testing.T) {
+	t.Helper()
+
+	_, err := p.client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, p.negotiator.HandleOffer(p.clientOffer(t)))
+	require.Len(t, p.sent, 1)
+	require.Equal(t, webrtc.SDPTypeAnswer, p.sent[0].Type)
+	require.NoError(t, p.client.SetRemoteDescription(p.sent[0]))
+	p.sent = nil
+}
+
+func (p *negotiationPeers) addServerTrack(t *testing.T, id string) {
+	t.Helper()
+
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, id, "stream-"+id)
+	require.NoError(t, err)
+	_, err = addSendTrack(p.server, track)
+	require.NoError(t, err)
+}
+
+func (p *negotiationPeers) assertStable(t *testing.T) {
+	t.Helper()
+
+	assert.Equal(t, webrtc.SignalingStateStable, p.server.SignalingState())
+	assert.Equal(t, webrtc.SignalingStateStable, p.client.SignalingState())
+}
+
+func TestNegotiatorWaitsForClientOffer(t *testing.T) {
+	peers := newNegotiationPeers(t)
+
+	// Tracks added before the client opened the session are offered after
+	// its first offer is answered
+	peers.addServerTrack(t, "a")
+	peers.negotiator.Negotiate()
+	assert.Empty(t, peers.sent)
+
+	_, err := peers.client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	require.NoError(t, err)
+	require.NoError(t, peers.negotiator.HandleOffer(peers.clientOffer(t)))
+
+	require.Len(t, peers.sent, 2)
+	assert.Equal(t, webrtc.SDPTypeAnswer, peers.sent[0].Type)
+	assert.Equal(t, webrtc.SDPTypeOffer, peers.sent[1].Type)
+
+	require.NoError(t, peers.client.SetRemoteDescription(peers.sent[0]))
+	require.NoError(t, peers.negotiator.HandleAnswer(peers.clientAnswer(t, peers.sent[1])))
+	peers.assertStable(t)
+	assert.Len(t, peers.client.GetTransceivers(), 2)
+}
+
+func TestNegotiatorCoalescesTrackChanges(t *testing.T) {
+	peers := newNegotiationPeers(t)
+	peers.connect(t)
+
+	peers.addServerTrack(t, "a")
+	peers.negotiator.Negotiate()
+	require.Len(t, peers.sent, 1)
+
+	// Changes made while the offer is outstanding wait for its answer
+	peers.addServerTrack(t, "b")
+	peers.negotiator.Negotiate()
+	peers.addServerTrack(t, "c")
+	peers.negotiator.Negotiate()
+	require.Len(t, peers.sent, 1)
+
+	require.NoError(t, peers.negotiator.HandleAnswer(peers.clientAnswer(t, peers.sent[0])))
+	require.Len(t, peers.sent, 2, "pending changes are sent as a single offer")
+
+	require.NoError(t, peers.negotiator.HandleAnswer(peers.clientAnswer(t, peers.sent[1])))
+	require.Len(t, peers.sent, 2)
+	peers.assertStable(t)
+	assert.Len(t, peers.client.GetTransceivers(), 4)
+}
+
+func TestNegotiatorIgnoresCollidingOffer(t *testing.T) {
+	peers := newNegotiationPeers(t)
+	peers.connect(t)
+
+	peers.addServerTrack(t, "a")
+	peers.negotiator.Negotiate()
+	require.Len(t, peers.sent, 1)
+
+	// A client offer crossing ours is dropped. It comes from a separate
+	// connection here because pion, unlike browsers, cannot roll it back.
+	other, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer other.Close()
+	_, err = other.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo)
+	require.NoError(t, err)
+	collidingOffer, err := other.CreateOffer(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, peers.negotiator.HandleOffer(collidingOffer.SDP))
+	assert.Len(t, peers.sent, 1, "colliding offer must not be answered")
+	assert.Equal(t, webrtc.SignalingStateHaveLocalOffer, peers.server.SignalingState())
+
+	// Candidates of the ignored offer do not surface as errors
+	mid := "5"
+	assert.NoError(t, peers.negotiator.AddICECandidate(webrtc.ICECandidateInit{
+		Candidate: "candidate:1 1 udp 2130706431 192.0.2.10 50000 typ host",
+		SDPMid:    &mid,
+	}))
+
+	// The polite client answers our offer instead
+	require.NoError(t, peers.negotiator.HandleAnswer(peers.clientAnswer(t, peers.sent[0])))
+	peers.assertStable(t)
+	assert.Len(t, peers.client.GetTransceivers(), 2)
+}
+
+func TestNegotiatorIgnoresStaleAnswer(t *testing.T) {
+	peers := newNegotiationPeers(t)
+	peers.connect(t)
+
+	answer, err := peers.server.CreateOffer(nil) // any SDP will do, it must not be applied
+	require.NoError(t, err)
+	assert.NoError(t, peers.negotiator.HandleAnswer(answer.SDP))
+	assert.Equal(t, webrtc.SignalingStateStable, peers.server.SignalingState())
+}
+
+func TestNegotiatorBuffersEarlyCandidates(t *testing.T) {
+	peers := newNegotiationPeers(t)
+
+	mid := "0"
+	index := uint16(0)
+	candidate := webrtc.ICECandidateInit{
+		Candidate:     "candidate:1 1 udp 2130706431 192.0.2.10 50000 typ host",
+		SDPMid:        &mid,
+		SDPMLineIndex: &index,
+	}
+	require.NoError(t, peers.negotiator.AddICECandidate(candidate))
+	assert.Len(t, peers.negotiator.candidates, 1)
+
+	peers.connect(t)
+	assert.Empty(t, peers.negotiator.candidates)
+}
+
+func TestNegotiatorReportsCompletedExchanges(t *testing.T) {
+	peers := newNegotiationPeers(t)
+	completed := 0
+	peers.negotiator.onNegotiated = func() { completed++ }
+
+	peers.connect(t)
+	assert.Equal(t, 1, completed)
+
+	peers.addServerTrack(t, "a")
+	peers.negotiator.Negotiate()
+	assert.Equal(t, 1, completed)
+
+	require.NoError(t, peers.negotiator.HandleAnswer(peers.clientAnswer(t, peers.sent[0])))
+	assert.Equal(t, 2, completed)
+}
+
+func TestNegotiatorRestartsICE(t *testing.T) {
+	peers := newNegotiationPeers(t)
+
+	// Nothing to restart before the client opened the session
+	peers.negotiator.RestartICE()
+	peers.connect(t)
+	assert.Empty(t, peers.sent)
+
+	ufrag := iceUfrag(peers.server.LocalDescription().SDP)
+	require.NotEmpty(t, ufrag)
+
+	// The restart goes out once the first gathering is over
+	peers.negotiator.RestartICE()
+	require.Eventually(t, func() bool {
+		peers.negotiator.mutex.Lock()
+		defer peers.negotiator.mutex.Unlock()
+		return len(peers.sent) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, ufrag, iceUfrag(peers.sent[0].SDP), "the offer carries fresh ICE credentials")
+
+	require.NoError(t, peers.negotiator.HandleAnswer(peers.clientAnswer(t, peers.sent[0])))
+	require.Len(t, peers.sent, 1)
+	peers.assertStable(t)
+}
+
+func TestNegotiatorICEDisconnectedGrace(t *testing.T) {
+	peers := newNegotiationPeers(t)
+	peers.negotiator.disconnectedGrace = 20 * time.Millisecond
+	peers.connect(t)
+	<-webrtc.GatheringCompletePromise(peers.server)
+
+	sent := func() int {
+		peers.negotiator.mutex.Lock()
+		defer peers.negotiator.mutex.Unlock()
+		return len(peers.sent)
+	}
+
+	// A connection that recovers within the grace period is left alone
+	peers.negotiator.ICEStateChanged(webrtc.ICEConnectionStateDisconnected)
+	peers.negotiator.ICEStateChanged(webrtc.ICEConnectionStateConnected)
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, sent())
+
+	peers.negotiator.ICEStateChanged(webrtc.ICEConnectionStateDisconnected)
+	require.Eventually(t, func() bool { return sent() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, webrtc.SDPTypeOffer, peers.sent[0].Type)
+}
+
+func TestNegotiatorAcceptsClientICERestart(t *testing.T) {
+	peers := newNegotiationPeers(t)
+	peers.connect(t)
+	// pion cannot apply a restart before its first gathering is over
+	<-webrtc.GatheringCompletePromise(peers.server)
+
+	// A restart of ours waiting behind an exchange is covered by the
+	// client's own
+	peers.negotiator.restartICE = true
+	offer, err := peers.client.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	require.NoError(t, err)
+	require.NoError(t, peers.client.SetLocalDescription(offer))
+
+	require.NoError(t, peers.negotiator.HandleOffer(offer.SDP))
+	require.Len(t, peers.sent, 1)
+	assert.Equal(t, webrtc.SDPTypeAnswer, peers.sent[0].Type)
+	assert.False(t, peers.negotiator.restartICE)
+
+	require.NoError(t, peers.client.SetRemoteDescription(peers.sent[0]))
+	peers.assertStable(t)
+}
@@ -0,0 +1,274 @@
+package signaling
+
+import (
+	"cmp"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// nackInterval is the minimum time between NACKs sent to a publisher
+	// for one layer
+	nackInterval = 20 * time.Millisecond
+	// nackReorderDelay leaves slightly reordered packets time to arrive
+	// before they are requested
+	nackReorderDelay = 10 * time.Millisecond
+	// maxNackAttempts is how often a lost packet is requested
+	maxNackAttempts = 5
+	// maxNackGap is the largest loss burst that is requested packet by
+	// packet; longer ones are left to keyframe requests
+	maxNackGap = 100
+)
+
+// packetBuffer keeps the most recent packets of one layer, indexed by their
+// sequence number, so every subscriber's retransmissions come from a single
+// copy. A nil buffer keeps nothing.
+type packetBuffer struct {
+	mutex   sync.Mutex
+	packets []*rtp.Packet
+}
+
+func newPacketBuffer(size int) *packetBuffer {
+	if size <= 0 {
+		return nil
+	}
+	return &packetBuffer{packets: make([]*rtp.Packet, size)}
+}
+
+func (b *packetBuffer) add(packet *rtp.Packet) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.packets[int(packet.SequenceNumber)%len(b.packets)] = packet
+}
+
+// get returns the packet with the given sequence number if it is still
+// buffered
+func (b *packetBuffer) get(seq uint16) *rtp.Packet {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	packet := b.packets[int(seq)%len(b.packets)]
+	if packet == nil || packet.SequenceNumber != seq {
+		return nil
+	}
+	return packet
+}
+
+// missingPacket is a gap in a publisher's sequence numbers
+type missingPacket struct {
+	since    time.Time
+	attempts int
+}
+
+// nackGenerator watches the sequence numbers of one layer as they arrive
+// from the publisher and asks it to retransmit the ones that went missing.
+// A nil generator never sends anything.
+type nackGenerator struct {
+	// writeRTCP sends RTCP on the publisher's PeerConnection
+	writeRTCP func([]rtcp.Packet) error
+	ssrc      uint32
+
+	mutex    sync.Mutex
+	started  bool
+	highest  uint16
+	missing  map[uint16]*missingPacket
+	lastSent time.Time
+	stats    upstreamNACKStats
+}
+
+// upstreamNACKStats counts the retransmissions requested from a publisher
+type upstreamNACKStats struct {
+	nacksSent        uint64
+	packetsNACKed    uint64
+	packetsRecovered uint64
+}
+
+func newNACKGenerator(pc *webrtc.PeerConnection, ssrc uint32) *nackGenerator {
+	return &nackGenerator{
+		writeRTCP: pc.WriteRTCP,
+		ssrc:      ssrc,
+		missing:   make(map[uint16]*missingPacket),
+	}
+}
+
+// received records an arriving sequence number and sends a NACK for the
+// packets that are overdue
+func (g *nackGenerator) received(seq uint16, now time.Time) {
+	if g == nil {
+		return
+	}
+
+	g.mutex.Lock()
+	if !g.started {
+		g.started = true
+		g.highest = seq
+		g.mutex.Unlock()
+		return
+	}
+
+	switch diff := seq - g.highest; {
+	case diff == 0:
+	case diff < 0x8000:
+		if diff-1 <= maxNackGap {
+			for missing := g.highest + 1; missing != seq; missing++ {
+				g.missing[missing] = &missingPacket{since: now}
+			}
+		}
+		g.highest = seq
+	default:
+		if _, ok := g.missing[seq]; ok {
+			delete(g.missing, seq)
+			g.stats.packetsRecovered++
+		}
+	}
+
+	nack := g.dueNACK(now)
+	g.mutex.Unlock()
+
+	if nack == nil {
+		return
+	}
+	if err := g.writeRTCP([]rtcp.Packet{nack}); err != nil {
+		log.Printf("Failed to send NACK for SSRC %d: %v", g.ssrc, err)
+	}
+}
+
+// dueNACK builds the NACK for the packets missing long enough, or nil. The
+// caller holds the mutex.
+func (g *nackGenerator) dueNACK(now time.Time) *rtcp.TransportLayerNack {
+	if len(g.missing) == 0 || now.Sub(g.lastSent) < nackInterval {
+		return nil
+	}
+
+	var seqs []uint16
+	for seq, missing := range g.missing {
+		if now.Sub(missing.since) < nackReorderDelay {
+			continue
+		}
+		seqs = append(seqs, seq)
+		if missing.attempts++; missing.attempts >= maxNackAttempts {
+			delete(g.missing, seq)
+		}
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+	// NACK pairs are built from ascending sequence numbers
+	slices.SortFunc(seqs, func(a, b uint16) int {
+		return cmp.Compare(int16(a-g.highest), int16(b-g.highest))
+	})
+
+	g.lastSent = now
+	g.stats.nacksSent++
+	g.stats.packetsNACKed += uint64(len(seqs))
+	return &rtcp.TransportLayerNack{
+		MediaSSRC: g.ssrc,
+		Nacks:     rtcp.NackPairsFromSequenceNumbers(seqs),
+	}
+}
+
+func (g *nackGenerator) Stats() upstreamNACKStats {
+	if g == nil {
+		return upstreamNACKStats{}
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.stats
+}
+
+// sentPacket maps a packet sent to a subscriber back to its source
+type sentPacket struct {
+	valid     bool
+	seq       uint16
+	timestamp uint32
+	layer     *simulcastLayer
+	sourceSeq uint16
+}
+
+// recordSent remembers where an outgoing packet came from. The caller holds
+// the down track's mutex.
+func (d *DownTrack) recordSent(layer *simulcastLayer, header *rtp.Header, sourceSeq uint16) {
+	if len(d.history) == 0 {
+		return
+	}
+	d.history[int(header.SequenceNumber)%len(d.history)] = sentPacket{
+		valid:     true,
+		seq:       header.SequenceNumber,
+		timestamp: header.Timestamp,
+		layer:     layer,
+		sourceSeq: sourceSeq,
+	}
+}
+
+// handleNACK answers a subscriber's NACK from the layer buffers, resending
+// each packet with the sequence number and timestamp it was first sent with
+func (d *DownTrack) handleNACK(nack *rtcp.TransportLayerNack) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			d.stats.PacketsRequested++
+
+			var sent sentPacket
+			var packet *rtp.Packet
+			if len(d.history) > 0 {
+				if sent = d.history[int(seq)%len(d.history)]; sent.valid && sent.seq == seq {
+					packet = sent.layer.buffer.get(sent.sourceSeq)
+				}
+			}
+			if packet == nil || !d.bound {
+				d.stats.RetransmissionsMissed++
+				continue
+			}
+
+			header := d.rewriteHeader(packet)
+			header.SequenceNumber = sent.seq
+			header.Timestamp = sent.timestamp
+			if _, err := d.writeStream.WriteRTP(&header, packet.Payload); err != nil {
+				d.stats.RetransmissionsMissed++
+				continue
+			}
+			d.stats.PacketsRetransmitted++
+		}
+	}
+}
+
+// retransmissionStats sums the NACK handling of all layers and subscribers
+// of a track
+func (t *PublishedTrack) retransmissionStats() RetransmissionStats {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var stats RetransmissionStats
+	for _, layer := range t.layers {
+		upstream := layer.nacks.Stats()
+		stats.NACKsSent += upstream.nacksSent
+		stats.PacketsNACKed += upstream.packetsNACKed
+		stats.PacketsRecovered += upstream.packetsRecovered
+	}
+	for _, downTrack := range t.downTracks {
+		downstream := downTrack.Stats()
+		stats.PacketsRequested += downstream.PacketsRequested
+		stats.PacketsRetransmitted += downstream.PacketsRetransmitted
+		stats.RetransmissionsMissed += downstream.RetransmissionsMissed
+	}
+	return stats
+}
@@ -0,0 +1,124 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketBuffer(t *testing.T) {
+	buffer := newPacketBuffer(4)
+
+	for seq := uint16(65534); seq != 3; seq++ {
+		buffer.add(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+	}
+	require.NotNil(t, buffer.get(2))
+	require.NotNil(t, buffer.get(65535))
+	assert.Nil(t, buffer.get(65534), "overwritten")
+	assert.Nil(t, buffer.get(7), "never buffered")
+
+	var disabled *packetBuffer
+	disabled.add(&rtp.Packet{})
+	assert.Nil(t, disabled.get(0))
+	assert.Nil(t, newPacketBuffer(0))
+}
+
+// capturingNACKs records the NACKs a generator would send to the publisher
+func capturingNACKs(ssrc uint32) (*nackGenerator, *[]*rtcp.TransportLayerNack) {
+	var sent []*rtcp.TransportLayerNack
+	return &nackGenerator{
+		writeRTCP: func(packets []rtcp.Packet) error {
+			for _, packet := range packets {
+				sent = append(sent, packet.(*rtcp.TransportLayerNack))
+			}
+			return nil
+		},
+		ssrc:    ssrc,
+		missing: make(map[uint16]*missingPacket),
+	}, &sent
+}
+
+func TestNACKGeneratorRequestsGaps(t *testing.T) {
+	nacks, sent := capturingNACKs(1234)
+	start := time.Now()
+
+	nacks.received(65533, start)
+	nacks.received(65534, start)
+	nacks.received(1, start) // 65535 and 0 are missing
+	assert.Empty(t, *sent, "reordered packets get a moment to arrive")
+
+	nacks.received(2, start.Add(15*time.Millisecond))
+	require.Len(t, *sent, 1)
+	assert.Equal(t, uint32(1234), (*sent)[0].MediaSSRC)
+	assert.Equal(t, []uint16{65535, 0}, (*sent)[0].Nacks[0].PacketList())
+
+	// The retransmission arrives
+	nacks.received(65535, start.Add(20*time.Millisecond))
+	stats := nacks.Stats()
+	assert.Equal(t, uint64(1), stats.nacksSent)
+	assert.Equal(t, uint64(2), stats.packetsNACKed)
+	assert.Equal(t, uint64(1), stats.packetsRecovered)
+
+	// The other one is requested again, a limited number of times
+	now := start.Add(20 * time.Millisecond)
+	for range 2 * maxNackAttempts {
+		now = now.Add(nackInterval)
+		nacks.received(3, now)
+	}
+	assert.Len(t, *sent, maxNackAttempts)
+	assert.Empty(t, nacks.missing)
+
+	var disabled *nackGenerator
+	disabled.received(1, now)
+	assert.Zero(t, disabled.Stats())
+}
+
+func TestNACKGeneratorIgnoresLongBursts(t *testing.T) {
+	nacks, sent := capturingNACKs(1234)
+	start := time.Now()
+
+	nacks.received(1, start)
+	nacks.received(2+maxNackGap+1, start)
+	nacks.received(2+maxNackGap+2, start.Add(time.Second))
+	assert.Empty(t, *sent)
+}
+
+func TestDownTrackAnswersNACK(t *testing.T) {
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, nil)
+	track.bufferSize = 64
+	track.layers[0].buffer = newPacketBuffer(track.bufferSize)
+	downTrack, writer := boundDownTrack(t, track, "guest1", 1111)
+
+	for seq := uint16(100); seq < 104; seq++ {
+		track.forward(track.layers[0], sourcePacket(seq, uint32(seq)*3000))
+	}
+	require.Len(t, writer.headers, 4)
+	lost := writer.headers[1]
+
+	downTrack.handleNACK(&rtcp.TransportLayerNack{
+		MediaSSRC: 1111,
+		Nacks:     rtcp.NackPairsFromSequenceNumbers([]uint16{lost.SequenceNumber, lost.SequenceNumber + 40}),
+	})
+
+	require.Len(t, writer.headers, 5)
+	resent := writer.headers[4]
+	assert.Equal(t, lost.SequenceNumber, resent.SequenceNumber)
+	assert.Equal(t, lost.Timestamp, resent.Timestamp)
+	assert.Equal(t, uint32(1111), resent.SSRC)
+
+	stats := downTrack.Stats()
+	assert.Equal(t, uint64(2), stats.PacketsRequested)
+	assert.Equal(t, uint64(1), stats.PacketsRetransmitted)
+	assert.Equal(t, uint64(1), stats.RetransmissionsMissed)
+
+	room := NewRoom("test-room")
+	room.AddTrack(track)
+	retransmissions := room.GetStats().Retransmissions
+	assert.Equal(t, uint64(2), retransmissions.PacketsRequested)
+	assert.Equal(t, uint64(1), retransmissions.PacketsRetransmitted)
+}
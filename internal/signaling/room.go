@@ -2,15 +2,60 @@ package signaling
 
 import (
 	"fmt"
+	"slices"
 	"time"
 )
 
 func NewRoom(slug string) *Room {
+	now := time.Now()
 	return &Room{
-		Slug:       slug,
-		Guests:     make(map[string]*Participant),
-		PublicKeys: make(map[string]string),
-		CreatedAt:  time.Now(),
+		Slug:           slug,
+		Guests:         make(map[string]*Participant),
+		PublicKeys:     make(map[string]string),
+		speakers:       newSpeakerDetector(),
+		CreatedAt:      now,
+		LastActivityAt: now,
+	}
+}
+
+// newRoomFromMetadata builds the live room for a room loaded from the store
+func newRoomFromMetadata(meta *RoomMetadata) *Room {
+	room := NewRoom(meta.Slug)
+	room.CreatorUserID = meta.CreatorUserID
+	room.CreatedAt = meta.CreatedAt
+	room.ExpiresAt = meta.ExpiresAt
+	room.LastActivityAt = meta.LastActivityAt
+	room.Policy = meta.Policy
+	if room.LastActivityAt.IsZero() {
+		room.LastActivityAt = room.CreatedAt
+	}
+	return room
+}
+
+// Metadata returns the durable part of the room for the room store
+func (r *Room) Metadata() *RoomMetadata {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return &RoomMetadata{
+		Slug:           r.Slug,
+		CreatorUserID:  r.CreatorUserID,
+		CreatedAt:      r.CreatedAt,
+		ExpiresAt:      r.ExpiresAt,
+		LastActivityAt: r.LastActivityAt,
+		Policy:         r.Policy,
+	}
+}
+
+// Touch records activity in the room and keeps it alive for at least
+// idleTimeout from now. Rooms without ExpiresAt never expire.
+func (r *Room) Touch(now time.Time, idleTimeout time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.LastActivityAt = now
+	if !r.ExpiresAt.IsZero() && r.ExpiresAt.Before(now.Add(idleTimeout)) {
+		r.ExpiresAt = now.Add(idleTimeout)
 	}
 }
 
@@ -87,27 +132,341 @@ func (r *Room) RemovePublicKey(participantID string) {
 }
 
 func (r *Room) AddParticipant(participant *Participant) error {
+	_, _, err := r.admit(participant)
+	return err
+}
+
+// hostAbsence is the seat of a host who dropped out, held for its token
+// identity until the grace period ends
+type hostAbsence struct {
+	participantID string
+	tokenID       string
+	until         time.Time
+}
+
+// admit adds a joining participant. A participant with the token identity
+// of the host takes the host seat whatever its role: it reclaims a seat held
+// during the grace period, or replaces a session that has not noticed its
+// connection is gone, which admit returns.
+func (r *Room) admit(participant *Participant) (replaced *Participant, reclaimed bool, err error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if participant.Role == RoleHost {
-		if r.Host != nil {
-			return fmt.Errorf("room already has a host")
-		}
+	role, status, err := r.admission(participant)
+	if err != nil {
+		return nil, false, err
+	}
+	participant.Role = role
+	participant.Status = status
+
+	switch {
+	case role == RoleHost && r.Host != nil:
+		replaced = r.Host
+		replaced.replaced = true
+		replaced.Status = StatusDisconnected
+		r.speakers.remove(replaced.ID)
 		r.Host = participant
-		participant.Status = StatusInRoom
-	} else {
-		participant.Status = StatusKnocking
+	case role == RoleHost:
+		reclaimed = r.hostAway != nil
+		r.hostAway = nil
+		r.Host = participant
+	default:
 		r.Guests[participant.ID] = participant
 	}
+	return replaced, reclaimed, nil
+}
+
+// checkAdmission reports why admit would turn the participant away right
+// now, without admitting it
+func (r *Room) checkAdmission(participant *Participant) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	_, _, err := r.admission(participant)
+	return err
+}
+
+// admission decides the role and status admit gives a participant, or why
+// it cannot join. The caller holds the mutex.
+func (r *Room) admission(participant *Participant) (ParticipantRole, ParticipantStatus, error) {
+	if identity := participant.tokenID; identity != "" {
+		if (r.Host != nil && r.Host.tokenID == identity) || (r.hostAway != nil && r.hostAway.tokenID == identity) {
+			return RoleHost, StatusInRoom, nil
+		}
+	}
+
+	if r.Host != nil && r.Host.ID == participant.ID {
+		return "", "", ErrParticipantExists
+	}
+	if _, exists := r.Guests[participant.ID]; exists {
+		return "", "", ErrParticipantExists
+	}
+
+	if participant.Role == RoleHost {
+		if r.Host != nil || r.hostAway != nil {
+			return "", "", ErrHostAlreadyPresent
+		}
+		return RoleHost, StatusInRoom, nil
+	}
+
+	if r.Locked {
+		return "", "", ErrRoomLocked
+	}
+	status := StatusKnocking
+	// Guests are held while the host's seat is, whatever the policy
+	if r.Host == nil && r.hostAway == nil {
+		switch r.Policy.HostAbsence {
+		case HostAbsenceAutoAdmit:
+			status = StatusInRoom
+		case HostAbsenceReject:
+			return "", "", ErrHostAbsent
+		}
+	}
+	if status == StatusInRoom && r.isFull() {
+		return "", "", ErrRoomFull
+	}
+	if status == StatusKnocking && r.maxKnocking > 0 && r.count(StatusKnocking) >= r.maxKnocking {
+		return "", "", ErrWaitingRoomFull
+	}
+	return RoleGuest, status, nil
+}
+
+// beginJoin keeps the room loaded while a participant that passed
+// checkAdmission gets its media set up; endJoin releases it
+func (r *Room) beginJoin() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.joining++
+}
+
+func (r *Room) endJoin() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.joining--
+}
+
+// isFull reports whether the admitted guests took every slot but the one
+// kept for the host. Guests still knocking do not count. The caller holds
+// the mutex.
+func (r *Room) isFull() bool {
+	max := r.Policy.MaxParticipants
+	return max > 0 && r.count(StatusInRoom) >= max-1
+}
+
+// count counts the guests with a status. The caller holds the mutex.
+func (r *Room) count(status ParticipantStatus) int {
+	count := 0
+	for _, guest := range r.Guests {
+		if guest.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// departure describes what a participant leaving did to the room
+type departure struct {
+	// absent is set when the participant was no longer in the room, e.g.
+	// a new session had taken its place; nothing changed
+	absent   bool
+	hostLeft bool
+	// away holds the seat of a host who may still reclaim it
+	away *hostAbsence
+	// admitted and rejected are the waiting guests the host absence policy
+	// let in or turned away
+	admitted, rejected []*Participant
+}
+
+// leave removes a participant whose connection closed. A host that joined
+// with a token keeps its seat for grace; otherwise the host absence policy
+// applies to waiting guests right away.
+func (r *Room) leave(participant *Participant, grace time.Duration, now time.Time) departure {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	isHost := r.Host == participant
+	if participant.replaced || (!isHost && r.Guests[participant.ID] != participant) {
+		return departure{absent: true}
+	}
+
+	r.speakers.remove(participant.ID)
+	if !isHost {
+		delete(r.Guests, participant.ID)
+		return departure{}
+	}
+
+	r.Host = nil
+	if grace > 0 && participant.tokenID != "" {
+		r.hostAway = &hostAbsence{
+			participantID: participant.ID,
+			tokenID:       participant.tokenID,
+			until:         now.Add(grace),
+		}
+		return departure{hostLeft: true, away: r.hostAway}
+	}
+
+	admitted, rejected := r.applyHostAbsence()
+	return departure{hostLeft: true, admitted: admitted, rejected: rejected}
+}
+
+// endHostGrace gives up the seat of a host who did not return by now and
+// applies the host absence policy to waiting guests. ok is false while the
+// seat is still held or when none is.
+func (r *Room) endHostGrace(now time.Time) (absence *hostAbsence, admitted, rejected []*Participant, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	absence = r.hostAway
+	if absence == nil || now.Before(absence.until) {
+		return nil, nil, nil, false
+	}
+	r.hostAway = nil
+	admitted, rejected = r.applyHostAbsence()
+	return absence, admitted, rejected, true
+}
+
+// applyHostAbsence admits or removes knocking guests as the policy says.
+// Guests beyond the room's capacity keep knocking. The caller holds the
+// mutex.
+func (r *Room) applyHostAbsence() (admitted, rejected []*Participant) {
+	for id, guest := range r.Guests {
+		if guest.Status != StatusKnocking {
+			continue
+		}
+		switch r.Policy.HostAbsence {
+		case HostAbsenceAutoAdmit:
+			if r.isFull() {
+				continue
+			}
+			guest.Status = StatusInRoom
+			admitted = append(admitted, guest)
+		case HostAbsenceReject:
+			guest.Status = StatusDisconnected
+			delete(r.Guests, id)
+			rejected = append(rejected, guest)
+		}
+	}
+	return admitted, rejected
+}
+
+// AddTrack registers a published track with the room, unless the room's
+// screen share policy forbids it
+func (r *Room) AddTrack(track *PublishedTrack) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.checkScreenShare(track.ParticipantID, track.Source(), nil); err != nil {
+		return err
+	}
+	r.Tracks = append(r.Tracks, track)
+	return nil
+}
 
+// SetTrackSource changes the announced source of a published track under
+// the same policy as AddTrack
+func (r *Room) SetTrackSource(track *PublishedTrack, source TrackSource) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.checkScreenShare(track.ParticipantID, source, track); err != nil {
+		return err
+	}
+	track.setSource(source)
 	return nil
 }
 
+// CheckScreenShare reports whether a participant may currently publish a
+// track from source
+func (r *Room) CheckScreenShare(participantID string, source TrackSource) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.checkScreenShare(participantID, source, nil)
+}
+
+// checkScreenShare applies the screen share policy, not counting the track
+// being changed. The caller holds the mutex.
+func (r *Room) checkScreenShare(participantID string, source TrackSource, changed *PublishedTrack) error {
+	if !source.isScreenShare() {
+		return nil
+	}
+	if r.Policy.ScreenShareHostOnly && (r.Host == nil || r.Host.ID != participantID) {
+		return ErrScreenShareNotAllowed
+	}
+	if source != TrackSourceScreen || r.Policy.MaxScreenShares == 0 {
+		return nil
+	}
+
+	shares := 0
+	for _, track := range r.Tracks {
+		if track != changed && track.Source() == TrackSourceScreen {
+			shares++
+		}
+	}
+	if shares >= r.Policy.MaxScreenShares {
+		return ErrScreenShareLimit
+	}
+	return nil
+}
+
+// PublishedTrack returns a participant's published track by ID, or nil
+func (r *Room) PublishedTrack(participantID, trackID string) *PublishedTrack {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, track := range r.Tracks {
+		if track.ParticipantID == participantID && track.ID == trackID {
+			return track
+		}
+	}
+	return nil
+}
+
+// TracksData lists the tracks published in the room
+func (r *Room) TracksData() *TracksData {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	data := &TracksData{Tracks: make([]TrackInfo, 0, len(r.Tracks))}
+	for _, track := range r.Tracks {
+		data.Tracks = append(data.Tracks, track.info())
+	}
+	return data
+}
+
+// RemoveTracks unregisters the tracks of a participant who left
+func (r *Room) RemoveTracks(tracks []*PublishedTrack) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Tracks = slices.DeleteFunc(r.Tracks, func(track *PublishedTrack) bool {
+		return slices.Contains(tracks, track)
+	})
+}
+
+// recordAudioLevel feeds a participant's audio level to the speaker
+// detection and announces a new dominant speaker to the room
+func (r *Room) recordAudioLevel(participantID string, level uint8, now time.Time) {
+	speaker, changed := r.speakers.record(participantID, level, now)
+	if !changed {
+		return
+	}
+
+	r.BroadcastToAll(&Message{
+		Type:      MessageTypeActiveSpeaker,
+		RoomID:    r.Slug,
+		Data:      ActiveSpeakerData{ParticipantID: speaker},
+		Timestamp: now,
+	}, "")
+}
+
 func (r *Room) RemoveParticipant(participantID string) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	r.speakers.remove(participantID)
 	if r.Host != nil && r.Host.ID == participantID {
 		r.Host = nil
 	} else {
@@ -134,6 +493,9 @@ func (r *Room) AllowGuest(guestID string) error {
 	if !exists {
 		return fmt.Errorf("guest not found")
 	}
+	if guest.Status != StatusInRoom && r.isFull() {
+		return ErrRoomFull
+	}
 
 	guest.Status = StatusInRoom
 	return nil
@@ -153,6 +515,70 @@ func (r *Room) DenyGuest(guestID string) error {
 	return nil
 }
 
+// IsHost reports whether participant currently hosts the room. Handlers
+// check this rather than Participant.Role, which changes with transfer_host,
+// or the ID, which another connection may share.
+func (r *Room) IsHost(participant *Participant) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return participant != nil && r.Host == participant
+}
+
+// IsAdmitted reports whether the participant is in the room and was let in
+func (r *Room) IsAdmitted(participant *Participant) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	present := r.Host == participant || r.Guests[participant.ID] == participant
+	return present && participant.Status == StatusInRoom
+}
+
+// SetLocked locks or unlocks the room for joining guests
+func (r *Room) SetLocked(locked bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Locked = locked
+}
+
+// KickGuest removes an admitted guest from the room and returns it
+func (r *Room) KickGuest(guestID string) (*Participant, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	guest, exists := r.Guests[guestID]
+	if !exists || guest.Status != StatusInRoom {
+		return nil, ErrParticipantNotFound
+	}
+
+	guest.Status = StatusDisconnected
+	delete(r.Guests, guestID)
+	r.speakers.remove(guestID)
+	return guest, nil
+}
+
+// TransferHost makes an admitted guest the host. The previous host stays in
+// the room as a guest.
+func (r *Room) TransferHost(guestID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	guest, exists := r.Guests[guestID]
+	if !exists || guest.Status != StatusInRoom {
+		return ErrParticipantNotFound
+	}
+
+	delete(r.Guests, guestID)
+	if previous := r.Host; previous != nil {
+		previous.Role = RoleGuest
+		r.Guests[previous.ID] = previous
+	}
+	guest.Role = RoleHost
+	r.Host = guest
+	return nil
+}
+
 func (r *Room) GetParticipantsData() *ParticipantsData {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
@@ -169,11 +595,82 @@ func (r *Room) GetParticipantsData() *ParticipantsData {
 	}
 }
 
+func (r *Room) GetStats() *RoomStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	stats := &RoomStats{
+		Slug:            r.Slug,
+		MaxParticipants: r.Policy.MaxParticipants,
+		GuestsCount:     len(r.Guests),
+		HasHost:         r.Host != nil,
+		CreatedAt:       r.CreatedAt,
+		ExpiresAt:       r.ExpiresAt,
+		LastActivityAt:  r.LastActivityAt,
+		Expired:         !r.ExpiresAt.IsZero() && !time.Now().Before(r.ExpiresAt),
+	}
+
+	if r.Host != nil && r.Host.Status == StatusInRoom {
+		stats.InRoomCount++
+	}
+	for _, guest := range r.Guests {
+		switch guest.Status {
+		case StatusInRoom:
+			stats.InRoomCount++
+		case StatusKnocking:
+			stats.KnockingCount++
+		}
+	}
+
+	// A copy: the stats are read after the room lock is released
+	stats.PublicKeys = make(map[string]string, len(r.PublicKeys))
+	for id, key := range r.PublicKeys {
+		stats.PublicKeys[id] = key
+	}
+
+	for _, track := range r.Tracks {
+		stats.Retransmissions.add(track.retransmissionStats())
+	}
+	stats.ActiveSpeaker = r.speakers.Current()
+	stats.Locked = r.Locked
+	if r.hostAway != nil {
+		stats.HostReturnBy = r.hostAway.until
+	}
+
+	return stats
+}
+
+// GetAllParticipants returns the host and every guest, whatever their status
+func (r *Room) GetAllParticipants() []*Participant {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	participants := make([]*Participant, 0, len(r.Guests)+1)
+	if r.Host != nil {
+		participants = append(participants, r.Host)
+	}
+	for _, guest := range r.Guests {
+		participants = append(participants, guest)
+	}
+	return participants
+}
+
 func (r *Room) IsEmpty() bool {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	return r.Host == nil && len(r.Guests) == 0
+	// A seat held for a host who dropped out keeps the room alive, and so
+	// do joins in progress
+	return r.Host == nil && r.hostAway == nil && len(r.Guests) == 0 && r.joining == 0
+}
+
+// IsExpired reports whether the room lifetime is over. Rooms without
+// ExpiresAt never expire.
+func (r *Room) IsExpired(now time.Time) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
 }
 
 func (r *Room) BroadcastToAll(message *Message, excludeID string) {
@@ -2,7 +2,9 @@ package signaling
 
 import (
 	"testing"
+	"time"
 
+	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
 )
 
@@ -30,6 +32,12 @@ func TestAddParticipant(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, guest, room.Guests["guest"])
 	require.Equal(t, StatusKnocking, guest.Status)
+
+	// An ID already in the room is refused rather than overwritten
+	require.ErrorIs(t, room.AddParticipant(&Participant{ID: "guest", Role: RoleGuest}), ErrParticipantExists)
+	require.ErrorIs(t, room.AddParticipant(&Participant{ID: "host", Role: RoleGuest}), ErrParticipantExists)
+	require.Same(t, guest, room.Guests["guest"])
+	require.Same(t, host, room.Host)
 }
 
 func TestRemoveParticipant(t *testing.T) {
@@ -46,3 +54,228 @@ func TestRemoveParticipant(t *testing.T) {
 	room.RemoveParticipant("host")
 	require.Nil(t, room.Host)
 }
+
+func TestGetStats(t *testing.T) {
+	room := NewRoom("test-room")
+	host := &Participant{ID: "host", Role: RoleHost}
+	knocking := &Participant{ID: "guest1", Role: RoleGuest}
+	admitted := &Participant{ID: "guest2", Role: RoleGuest}
+
+	room.AddParticipant(host)
+	room.AddParticipant(knocking)
+	room.AddParticipant(admitted)
+	room.AllowGuest("guest2")
+
+	stats := room.GetStats()
+	require.Equal(t, "test-room", stats.Slug)
+	require.True(t, stats.HasHost)
+	require.Equal(t, 2, stats.InRoomCount)
+	require.Equal(t, 1, stats.KnockingCount)
+	require.Equal(t, 2, stats.GuestsCount)
+
+	// Keys are copied out of the room
+	publicKey, _, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+	require.NoError(t, room.SavePublicKey("host", publicKey))
+	stats = room.GetStats()
+	require.Len(t, stats.PublicKeys, 1)
+	stats.PublicKeys["guest1"] = "changed"
+	_, exists := room.GetPublicKey("guest1")
+	require.False(t, exists)
+}
+
+func TestTouchExtendsExpiry(t *testing.T) {
+	room := NewRoom("test-room")
+	now := time.Now()
+	room.ExpiresAt = now.Add(time.Hour)
+
+	room.Touch(now, 24*time.Hour)
+	require.Equal(t, now, room.LastActivityAt)
+	require.Equal(t, now.Add(24*time.Hour), room.ExpiresAt)
+
+	// Activity never shortens the lifetime
+	room.Touch(now, time.Minute)
+	require.Equal(t, now.Add(24*time.Hour), room.ExpiresAt)
+	require.False(t, room.IsExpired(now.Add(23*time.Hour)))
+	require.True(t, room.IsExpired(now.Add(24*time.Hour)))
+}
+
+func TestTouchWithoutExpiry(t *testing.T) {
+	room := NewRoom("test-room")
+
+	room.Touch(time.Now(), time.Hour)
+	require.True(t, room.ExpiresAt.IsZero())
+	require.False(t, room.IsExpired(time.Now().Add(48*time.Hour)))
+}
+
+func TestAddParticipantRoomFull(t *testing.T) {
+	room := NewRoom("test-room")
+	room.Policy = RoomPolicy{MaxParticipants: 3, HostAbsence: HostAbsenceAutoAdmit}
+
+	require.NoError(t, room.AddParticipant(&Participant{ID: "guest1", Role: RoleGuest}))
+	require.NoError(t, room.AddParticipant(&Participant{ID: "guest2", Role: RoleGuest}))
+
+	// The last slot is reserved for the host
+	require.ErrorIs(t, room.AddParticipant(&Participant{ID: "guest3", Role: RoleGuest}), ErrRoomFull)
+	require.NoError(t, room.AddParticipant(&Participant{ID: "host", Role: RoleHost}))
+
+	// Knocking is still possible, but the host cannot let anyone else in
+	require.NoError(t, room.AddParticipant(&Participant{ID: "guest3", Role: RoleGuest}))
+	require.ErrorIs(t, room.AllowGuest("guest3"), ErrRoomFull)
+	room.RemoveParticipant("guest1")
+	require.NoError(t, room.AllowGuest("guest3"))
+}
+
+func TestAddParticipantWaitingRoomFull(t *testing.T) {
+	room := NewRoom("test-room")
+	room.Policy.MaxParticipants = 2
+	room.maxKnocking = 2
+
+	// Guests knocking do not take the slots of admitted ones
+	require.NoError(t, room.AddParticipant(&Participant{ID: "host", Role: RoleHost}))
+	require.NoError(t, room.AddParticipant(&Participant{ID: "guest1", Role: RoleGuest}))
+	require.NoError(t, room.AddParticipant(&Participant{ID: "guest2", Role: RoleGuest}))
+	require.ErrorIs(t, room.AddParticipant(&Participant{ID: "guest3", Role: RoleGuest}), ErrWaitingRoomFull)
+
+	require.NoError(t, room.AllowGuest("guest1"))
+	require.NoError(t, room.AddParticipant(&Participant{ID: "guest3", Role: RoleGuest}))
+	require.ErrorIs(t, room.AllowGuest("guest2"), ErrRoomFull)
+}
+
+func TestRoomScreenSharePolicy(t *testing.T) {
+	room := NewRoom("test-room")
+	room.Policy = RoomPolicy{ScreenShareHostOnly: true, MaxScreenShares: 1}
+	require.NoError(t, room.AddParticipant(&Participant{ID: "host1", Role: RoleHost}))
+	require.NoError(t, room.AddParticipant(&Participant{ID: "guest1", Role: RoleGuest}))
+
+	screenTrack := func(participantID, id string) *PublishedTrack {
+		track := newTestPublishedTrack(participantID, id, webrtc.RTPCodecTypeVideo, nil)
+		track.source = TrackSourceScreen
+		return track
+	}
+
+	require.ErrorIs(t, room.AddTrack(screenTrack("guest1", "screen")), ErrScreenShareNotAllowed)
+	require.NoError(t, room.AddTrack(newTestPublishedTrack("guest1", "camera", webrtc.RTPCodecTypeVideo, nil)))
+
+	first := screenTrack("host1", "screen1")
+	require.NoError(t, room.AddTrack(first))
+	require.ErrorIs(t, room.AddTrack(screenTrack("host1", "screen2")), ErrScreenShareLimit)
+
+	// Screen audio is host only but does not count towards the limit
+	audio := newTestPublishedTrack("host1", "screen-audio", webrtc.RTPCodecTypeAudio, nil)
+	require.NoError(t, room.SetTrackSource(audio, TrackSourceScreenAudio))
+	require.ErrorIs(t, room.CheckScreenShare("guest1", TrackSourceScreenAudio), ErrScreenShareNotAllowed)
+
+	// Re-announcing the shared track does not count it twice
+	require.NoError(t, room.SetTrackSource(first, TrackSourceScreen))
+
+	camera := newTestPublishedTrack("host1", "camera", webrtc.RTPCodecTypeVideo, nil)
+	require.NoError(t, room.AddTrack(camera))
+	require.ErrorIs(t, room.SetTrackSource(camera, TrackSourceScreen), ErrScreenShareLimit)
+	require.Equal(t, TrackSourceCamera, camera.Source())
+
+	room.RemoveTracks([]*PublishedTrack{first})
+	require.NoError(t, room.SetTrackSource(camera, TrackSourceScreen))
+
+	data := room.TracksData()
+	require.Len(t, data.Tracks, 2)
+	require.Equal(t, TrackInfo{
+		ParticipantID: "host1",
+		TrackID:       "camera",
+		StreamID:      "host1-stream",
+		Kind:          "video",
+		Source:        TrackSourceScreen,
+	}, data.Tracks[1])
+}
+
+func TestRoomHostAbsencePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy HostAbsencePolicy
+		status ParticipantStatus
+		err    error
+	}{
+		{HostAbsenceHold, StatusKnocking, nil},
+		{HostAbsenceAutoAdmit, StatusInRoom, nil},
+		{HostAbsenceReject, "", ErrHostAbsent},
+	} {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			room := NewRoom("test-room")
+			room.Policy.HostAbsence = tt.policy
+
+			guest := &Participant{ID: "guest", Role: RoleGuest}
+			err := room.AddParticipant(guest)
+			require.ErrorIs(t, err, tt.err)
+			if tt.err == nil {
+				require.Equal(t, tt.status, guest.Status)
+			}
+
+			// With a host present guests knock whatever the policy
+			require.NoError(t, room.AddParticipant(&Participant{ID: "host", Role: RoleHost}))
+			late := &Participant{ID: "late", Role: RoleGuest}
+			require.NoError(t, room.AddParticipant(late))
+			require.Equal(t, StatusKnocking, late.Status)
+		})
+	}
+}
+
+func TestRoomHostGracePeriod(t *testing.T) {
+	now := time.Now()
+	room := NewRoom("test-room")
+	room.Policy.HostAbsence = HostAbsenceAutoAdmit
+
+	host := &Participant{ID: "host", Role: RoleHost, tokenID: "host-token"}
+	require.NoError(t, room.AddParticipant(host))
+
+	left := room.leave(host, time.Minute, now)
+	require.True(t, left.hostLeft)
+	require.NotNil(t, left.away)
+	require.False(t, room.IsEmpty())
+	require.Equal(t, now.Add(time.Minute), room.GetStats().HostReturnBy)
+
+	// Guests are held and other hosts kept out while the seat is held
+	guest := &Participant{ID: "guest", Role: RoleGuest, tokenID: "guest-token"}
+	require.NoError(t, room.AddParticipant(guest))
+	require.Equal(t, StatusKnocking, guest.Status)
+	require.ErrorIs(t, room.AddParticipant(&Participant{ID: "other", Role: RoleHost, tokenID: "other-token"}), ErrHostAlreadyPresent)
+
+	_, _, _, ok := room.endHostGrace(now.Add(30 * time.Second))
+	require.False(t, ok)
+
+	// The same token reclaims the seat, even after a transfer made it a
+	// guest token
+	back := &Participant{ID: "host", Role: RoleGuest, tokenID: "host-token"}
+	replaced, reclaimed, err := room.admit(back)
+	require.NoError(t, err)
+	require.Nil(t, replaced)
+	require.True(t, reclaimed)
+	require.Same(t, back, room.Host)
+	require.Equal(t, RoleHost, back.Role)
+
+	// Once the grace period ends the policy applies to waiting guests
+	room.leave(back, time.Minute, now)
+	absence, admitted, rejected, ok := room.endHostGrace(now.Add(time.Minute))
+	require.True(t, ok)
+	require.Equal(t, "host", absence.participantID)
+	require.Equal(t, []*Participant{guest}, admitted)
+	require.Empty(t, rejected)
+	require.Equal(t, StatusInRoom, guest.Status)
+	require.True(t, room.GetStats().HostReturnBy.IsZero())
+}
+
+func TestRoomHostReconnectReplacesSession(t *testing.T) {
+	room := NewRoom("test-room")
+	stale := &Participant{ID: "host", Role: RoleHost, tokenID: "host-token"}
+	require.NoError(t, room.AddParticipant(stale))
+
+	fresh := &Participant{ID: "host", Role: RoleHost, tokenID: "host-token"}
+	replaced, reclaimed, err := room.admit(fresh)
+	require.NoError(t, err)
+	require.False(t, reclaimed)
+	require.Same(t, stale, replaced)
+	require.Same(t, fresh, room.Host)
+
+	// The stale session leaving later leaves the new one alone
+	left := room.leave(stale, time.Minute, time.Now())
+	require.True(t, left.absent)
+	require.Same(t, fresh, room.Host)
+}
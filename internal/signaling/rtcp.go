@@ -0,0 +1,94 @@
+package signaling
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyframeRequester asks a publisher for a keyframe on one of its video
+// tracks. Requests from all subscribers of the track funnel through it and
+// are rate limited, since every keyframe costs the publisher a bitrate spike.
+type keyframeRequester struct {
+	// writeRTCP sends RTCP on the publisher's PeerConnection
+	writeRTCP func([]rtcp.Packet) error
+	// ssrc is the publisher's SSRC of the track, as seen on its connection
+	ssrc     uint32
+	interval time.Duration
+
+	mutex sync.Mutex
+	last  time.Time
+}
+
+func newKeyframeRequester(pc *webrtc.PeerConnection, ssrc uint32, interval time.Duration) *keyframeRequester {
+	return &keyframeRequester{
+		writeRTCP: pc.WriteRTCP,
+		ssrc:      ssrc,
+		interval:  interval,
+	}
+}
+
+// Request sends a PLI to the publisher unless one went out less than the
+// configured interval ago. It reports whether a PLI was sent. A nil
+// requester (audio tracks) never sends anything.
+func (k *keyframeRequester) Request() bool {
+	if k == nil {
+		return false
+	}
+
+	k.mutex.Lock()
+	now := time.Now()
+	if !k.last.IsZero() && now.Sub(k.last) < k.interval {
+		k.mutex.Unlock()
+		return false
+	}
+	k.last = now
+	k.mutex.Unlock()
+
+	if err := k.writeRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: k.ssrc},
+	}); err != nil {
+		log.Printf("Failed to send PLI for SSRC %d: %v", k.ssrc, err)
+		return false
+	}
+	return true
+}
+
+// wantsKeyframe reports whether subscriber feedback asks for a keyframe. The
+// media SSRC in PLI and FIR refers to our outbound stream; it is not copied,
+// the requester addresses the publisher's own SSRC instead. FIR is answered
+// with a PLI as well, which every browser honours.
+func wantsKeyframe(packets []rtcp.Packet) bool {
+	for _, packet := range packets {
+		switch packet.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			return true
+		}
+	}
+	return false
+}
+
+// readSenderRTCP drains the RTCP a subscriber sends for one forwarded track,
+// relays keyframe requests to the publisher and answers NACKs from the
+// retransmission buffer. Reading is also what lets the sender's interceptors
+// (reports, congestion control) see the feedback. It returns once the sender
+// is stopped or its PeerConnection closed.
+func readSenderRTCP(sender *webrtc.RTPSender, downTrack *DownTrack) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if wantsKeyframe(packets) {
+			downTrack.RequestKeyframe()
+		}
+		for _, packet := range packets {
+			if nack, ok := packet.(*rtcp.TransportLayerNack); ok {
+				downTrack.handleNACK(nack)
+			}
+		}
+	}
+}
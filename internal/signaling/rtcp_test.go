@@ -0,0 +1,83 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capturingRequester records the PLIs it would send to the publisher
+func capturingRequester(ssrc uint32, interval time.Duration) (*keyframeRequester, *[]rtcp.Packet) {
+	var sent []rtcp.Packet
+	return &keyframeRequester{
+		writeRTCP: func(packets []rtcp.Packet) error {
+			sent = append(sent, packets...)
+			return nil
+		},
+		ssrc:     ssrc,
+		interval: interval,
+	}, &sent
+}
+
+func TestWantsKeyframe(t *testing.T) {
+	assert.True(t, wantsKeyframe([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: 1}}))
+	assert.True(t, wantsKeyframe([]rtcp.Packet{
+		&rtcp.ReceiverReport{},
+		&rtcp.FullIntraRequest{FIR: []rtcp.FIREntry{{SSRC: 1}}},
+	}))
+	assert.False(t, wantsKeyframe([]rtcp.Packet{&rtcp.TransportLayerNack{MediaSSRC: 1}}))
+	assert.False(t, wantsKeyframe([]rtcp.Packet{&rtcp.ReceiverReport{}}))
+}
+
+func TestKeyframeRequesterTranslatesSSRC(t *testing.T) {
+	keyframes, sent := capturingRequester(1234, 0)
+
+	assert.True(t, keyframes.Request())
+	require.Len(t, *sent, 1)
+	assert.Equal(t, &rtcp.PictureLossIndication{MediaSSRC: 1234}, (*sent)[0])
+}
+
+func TestKeyframeRequesterRateLimit(t *testing.T) {
+	keyframes, sent := capturingRequester(1234, time.Hour)
+
+	assert.True(t, keyframes.Request())
+	assert.False(t, keyframes.Request())
+	assert.Len(t, *sent, 1)
+
+	keyframes.last = time.Now().Add(-2 * time.Hour)
+	assert.True(t, keyframes.Request())
+	assert.Len(t, *sent, 2)
+
+	var audio *keyframeRequester
+	assert.False(t, audio.Request())
+}
+
+func TestNewSubscriptionRequestsKeyframe(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+
+	room := NewRoom("test-room")
+	require.NoError(t, room.AddParticipant(&Participant{ID: "host1", Role: RoleHost}))
+	subscriber := &Participant{ID: "guest1", Role: RoleGuest, PC: pc}
+	require.NoError(t, room.AddParticipant(subscriber))
+	require.NoError(t, room.AllowGuest(subscriber.ID))
+	defer subscriber.closeMedia()
+
+	keyframes, sent := capturingRequester(1234, time.Hour)
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, keyframes)
+
+	added, err := subscriber.addForwardedTrack(room, track)
+	require.NoError(t, err)
+	require.True(t, added)
+	assert.Empty(t, *sent, "no keyframe before the subscription is negotiated")
+
+	subscriber.requestPendingKeyframes()
+	assert.Len(t, *sent, 1)
+
+	subscriber.requestPendingKeyframes()
+	assert.Len(t, *sent, 1)
+}
@@ -2,39 +2,257 @@ package signaling
 
 import (
 	"crypto/rand"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	roomIDLength      = 10
+	roomIDAlphabet    = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	maxRoomIDAttempts = 5
+)
+
+var (
+	ErrRoomNotFound       = errors.New("room not found")
+	ErrHostAlreadyPresent = errors.New("room already has a host")
+	ErrParticipantExists  = errors.New("participant is already in the room")
+	ErrRoomFull           = errors.New("room is full")
+	ErrWaitingRoomFull    = errors.New("too many guests waiting to be let in")
+	ErrServerAtCapacity   = errors.New("server is at capacity")
+	ErrInvalidRoomPolicy  = errors.New("invalid room policy")
+
+	ErrRoomLocked            = errors.New("room is locked")
+	ErrParticipantNotFound   = errors.New("participant not found")
+	ErrScreenShareNotAllowed = errors.New("only the host may share the screen")
+	ErrScreenShareLimit      = errors.New("too many screen shares")
+	ErrHostAbsent            = errors.New("room has no host to let guests in")
+	ErrResumeFailed          = errors.New("session cannot be resumed")
+)
+
 type Server struct {
-	rooms    map[string]*Room
-	mutex    sync.RWMutex
-	upgrader websocket.Upgrader
-}
-
-func NewServer() *Server {
-	return &Server{
-		rooms: make(map[string]*Room),
-		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				// TODO : check origin in production
-				return true
-			},
-		},
+	rooms map[string]*Room
+	// participants indexes the participants of live rooms by ID
+	participants map[string]member
+	store        RoomStore
+	mutex        sync.RWMutex
+	// createMutex serializes room creation, which checks the room limit
+	// against the store, without holding up everything under mutex
+	createMutex  sync.Mutex
+	upgrader     websocket.Upgrader
+	config       Config
+	jwtSecret    []byte
+	done         chan struct{}
+	shutdownOnce sync.Once
+}
+
+// member locates a participant in its room
+type member struct {
+	room        *Room
+	participant *Participant
+}
+
+// NewServer creates a server with the default configuration that keeps room
+// metadata in memory
+func NewServer(jwtSecret string) (*Server, error) {
+	config := DefaultConfig()
+	config.JWTSecret = jwtSecret
+	return NewServerWithConfig(config, NewMemoryRoomStore())
+}
+
+// NewServerWithConfig creates a server that keeps room metadata in store.
+// Without config.API it builds one with the default settings. The caller
+// owns the store and closes it after Shutdown.
+func NewServerWithConfig(config Config, store RoomStore) (*Server, error) {
+	if config.API == nil {
+		api, err := NewWebRTCAPI(ICENetworkConfig{}, DefaultBandwidthEstimationConfig())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create WebRTC API: %w", err)
+		}
+		config.API = api
+	}
+
+	s := &Server{
+		rooms:        make(map[string]*Room),
+		participants: make(map[string]member),
+		store:        store,
+		config:       config,
+		jwtSecret:    []byte(config.JWTSecret),
+		done:         make(chan struct{}),
+	}
+
+	s.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    []string{TokenSubprotocol},
+		CheckOrigin:     s.checkOrigin,
 	}
+
+	go s.runJanitor(config.JanitorInterval)
+
+	return s, nil
+}
+
+// checkOrigin accepts requests without an Origin header (non-browser clients)
+// and browser requests from the configured origins
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(s.config.AllowedOrigins) == 0 {
+		return true
+	}
+
+	for _, allowed := range s.config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	log.Printf("Rejected WebSocket from origin %s", origin)
+	return false
 }
 
-func generateParticipantID() string {
-	bytes := make([]byte, 8)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
+// generateRoomID returns a random room identifier matching ^[a-zA-Z0-9]{10}$.
+// Random bytes past the last multiple of the alphabet size are skipped, so
+// that every character is equally likely.
+func generateRoomID() (string, error) {
+	limit := 256 - 256%len(roomIDAlphabet)
+	id := make([]byte, 0, roomIDLength)
+	bytes := make([]byte, roomIDLength)
+	for len(id) < roomIDLength {
+		if _, err := rand.Read(bytes); err != nil {
+			return "", err
+		}
+		for _, b := range bytes {
+			if int(b) < limit && len(id) < roomIDLength {
+				id = append(id, roomIDAlphabet[int(b)%len(roomIDAlphabet)])
+			}
+		}
+	}
+	return string(id), nil
+}
+
+// CreateRoom registers a new room that stays joinable until ttl elapses.
+// A zero policy.MaxParticipants takes the server-wide limit and an empty
+// policy.HostAbsence the server-wide policy.
+func (s *Server) CreateRoom(creatorUserID int64, ttl time.Duration, policy RoomPolicy) (*RoomMetadata, error) {
+	if policy.MaxParticipants == 0 {
+		policy.MaxParticipants = s.config.Limits.MaxParticipantsPerRoom
+	}
+	if policy.MaxParticipants < 2 || policy.MaxParticipants > s.config.Limits.MaxParticipantsPerRoom {
+		return nil, fmt.Errorf("%w: max_participants must be between 2 and %d",
+			ErrInvalidRoomPolicy, s.config.Limits.MaxParticipantsPerRoom)
+	}
+	if policy.MaxScreenShares < 0 {
+		return nil, fmt.Errorf("%w: max_screen_shares must not be negative", ErrInvalidRoomPolicy)
+	}
+	if policy.HostAbsence == "" {
+		policy.HostAbsence = s.config.HostAbsencePolicy
+	}
+	if !validHostAbsencePolicy(policy.HostAbsence) {
+		return nil, fmt.Errorf("%w: host_absence must be one of hold, auto_admit, reject", ErrInvalidRoomPolicy)
+	}
+
+	s.createMutex.Lock()
+	defer s.createMutex.Unlock()
+
+	count, err := s.countActiveRooms(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if count >= s.config.Limits.MaxRooms {
+		return nil, ErrServerAtCapacity
+	}
+
+	for attempt := 0; attempt < maxRoomIDAttempts; attempt++ {
+		slug, err := generateRoomID()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate room id: %w", err)
+		}
+
+		now := time.Now()
+		meta := &RoomMetadata{
+			Slug:           slug,
+			CreatorUserID:  creatorUserID,
+			CreatedAt:      now,
+			ExpiresAt:      now.Add(ttl),
+			LastActivityAt: now,
+			Policy:         policy,
+		}
+
+		err = s.store.Create(meta)
+		if errors.Is(err, ErrRoomExists) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to store room: %w", err)
+		}
+
+		log.Printf("Room %s created by user %d", slug, creatorUserID)
+		return meta, nil
+	}
+
+	return nil, fmt.Errorf("failed to allocate a unique room id")
+}
+
+// countActiveRooms counts unexpired rooms, live or stored. The store is read
+// without holding s.mutex; the caller must hold s.createMutex.
+func (s *Server) countActiveRooms(now time.Time) (int, error) {
+	live := make(map[string]bool)
+	s.mutex.RLock()
+	for slug, room := range s.rooms {
+		if !room.IsExpired(now) {
+			live[slug] = true
+		}
+	}
+	s.mutex.RUnlock()
+
+	stored, err := s.store.List()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list rooms: %w", err)
+	}
+
+	count := len(live)
+	for _, meta := range stored {
+		if !live[meta.Slug] && now.Before(meta.ExpiresAt) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// loadRoom returns the live room for slug, materializing it from the store
+// on first use. The caller must hold s.mutex for writing.
+func (s *Server) loadRoom(slug string) (*Room, error) {
+	if room, exists := s.rooms[slug]; exists {
+		return room, nil
+	}
+
+	meta, err := s.store.Get(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.rooms) >= s.config.Limits.MaxRooms {
+		return nil, ErrServerAtCapacity
+	}
+
+	room := newRoomFromMetadata(meta)
+	if room.Policy.MaxParticipants == 0 {
+		room.Policy.MaxParticipants = s.config.Limits.MaxParticipantsPerRoom
+	}
+	if room.Policy.HostAbsence == "" {
+		room.Policy.HostAbsence = s.config.HostAbsencePolicy
+	}
+	room.maxKnocking = s.config.Limits.MaxKnockingPerRoom
+	s.rooms[slug] = room
+	return room, nil
 }
 
 func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
@@ -58,6 +276,17 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A token passed with the upgrade request is checked before upgrading,
+	// otherwise it must arrive in the join payload.
+	token := tokenFromRequest(r)
+	if token != "" {
+		if _, err := s.verifyToken(token, roomID); err != nil {
+			log.Printf("Rejected WebSocket for room %s: %v", roomID, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
@@ -65,12 +294,17 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Wait for Join message
-	var joinMsg Message
+	conn.SetReadDeadline(time.Now().Add(s.config.JoinTimeout))
+	var joinMsg struct {
+		Type MessageType     `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
 	if err := conn.ReadJSON(&joinMsg); err != nil {
 		log.Printf("Failed to read join message: %v", err)
 		conn.Close()
 		return
 	}
+	conn.SetReadDeadline(time.Time{})
 
 	if joinMsg.Type != MessageTypeJoin {
 		log.Printf("Expected join message, got: %s", joinMsg.Type)
@@ -78,59 +312,157 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract user_id from join message
-	// The spec says: { "type": "join", "room_id": "...", "user_id": "..." }
-	// We map this to our internal structures.
-	// joinMsg.Data might be a map[string]interface{} because of JSON unmarshaling
+	// The participant ID comes from the token, never from the join payload
+	var data JoinData
+	if len(joinMsg.Data) > 0 {
+		if err := json.Unmarshal(joinMsg.Data, &data); err != nil {
+			log.Printf("Rejected join for room %s: %v", roomID, err)
+			sendError(conn, "INVALID_JOIN", "Join data must be an object")
+			conn.Close()
+			return
+		}
+	}
+
+	if token == "" {
+		token = data.Token
+	}
+
+	claims, err := s.verifyToken(token, roomID)
+	if err != nil {
+		log.Printf("Rejected join for room %s: %v", roomID, err)
+		sendError(conn, "UNAUTHORIZED", "Missing or invalid access token")
+		conn.Close()
+		return
+	}
 
-	// Let's parse the data manually or assume it's in the message fields if we update Message struct?
-	// The Message struct has `Data interface{}`.
-	// Let's check `types.go`. Message has `Data interface{}`.
-	// We need to cast it.
+	// A client whose connection dropped picks its session up where it was
+	if data.ResumeToken != "" {
+		wrapped := NewWebSocketConnWrapper(conn)
+		// A client that stops reading cannot stall the replay
+		wrapped.SetWriteDeadline(time.Now().Add(s.config.JoinTimeout))
+		participant, err := s.resumeSession(roomID, data.ResumeToken, tokenIdentity(token, claims), data.LastSeq, wrapped)
+		if err != nil {
+			log.Printf("Failed to resume session in room %s: %v", roomID, err)
+			sendError(wrapped, "RESUME_FAILED", "Session cannot be resumed, join again")
+			wrapped.Close()
+			return
+		}
+		wrapped.SetWriteDeadline(time.Time{})
+		go s.handleConnection(roomID, participant, wrapped)
+		return
+	}
 
-	data, ok := joinMsg.Data.(map[string]interface{})
+	profile, ok := parseMediaProfile(string(data.Profile))
 	if !ok {
-		// Try to re-marshal and unmarshal if needed, or just use the map
-		// But wait, ReadJSON unmarshals into interface{}.
-		// If we want strict typing we should define a JoinRequest struct.
+		sendError(conn, "INVALID_MEDIA_PROFILE", "Media profile must be full, audio_only or receive_only")
+		conn.Close()
+		return
 	}
 
-	userID, _ := data["user_id"].(string)
-	if userID == "" {
-		// Fallback or error? Spec says user_id is sent.
-		userID = generateParticipantID()
+	wrapped := NewWebSocketConnWrapper(conn)
+	session, err := newSession(wrapped)
+	if err != nil {
+		log.Printf("Rejected join for room %s: %v", roomID, err)
+		wrapped.Close()
+		return
 	}
 
+	identity := tokenIdentity(token, claims)
 	participant := &Participant{
-		ID:       userID,
-		Conn:     NewWebSocketConnWrapper(conn),
+		ID:       participantID(identity),
+		Conn:     session,
+		Role:     claims.Role,
 		Status:   StatusConnected,
 		JoinedAt: time.Now(),
+		Profile:  profile,
+		tokenID:  identity,
+		session:  session,
+	}
+	// Tracks are forwarded automatically unless the client opts out
+	if data.AutoSubscribe != nil && !*data.AutoSubscribe {
+		participant.manualSubscribe = true
+	}
+	participant.ICEServers = s.iceServersFor(participant.ID, participant.JoinedAt)
+
+	if err := s.joinRoom(roomID, participant); err != nil {
+		log.Printf("Participant %s failed to join room %s: %v", participant.ID, roomID, err)
+		switch {
+		case errors.Is(err, ErrRoomNotFound):
+			sendError(participant.Conn, "ROOM_NOT_FOUND", "Room does not exist or has expired")
+		case errors.Is(err, ErrHostAlreadyPresent):
+			sendError(participant.Conn, "HOST_ALREADY_PRESENT", "Room already has a host")
+		case errors.Is(err, ErrParticipantExists):
+			sendError(participant.Conn, "PARTICIPANT_EXISTS", "This token is already in use in the room")
+		case errors.Is(err, ErrRoomFull):
+			sendError(participant.Conn, "ROOM_FULL", "Room has reached its participant limit")
+		case errors.Is(err, ErrWaitingRoomFull):
+			sendError(participant.Conn, "WAITING_ROOM_FULL", "Too many guests are waiting to be let in")
+		case errors.Is(err, ErrRoomLocked):
+			sendError(participant.Conn, "ROOM_LOCKED", "The host has locked the room")
+		case errors.Is(err, ErrHostAbsent):
+			sendError(participant.Conn, "HOST_ABSENT", "Room has no host to let guests in")
+		case errors.Is(err, ErrServerAtCapacity):
+			sendError(participant.Conn, "SERVER_AT_CAPACITY", "Server cannot host more rooms right now")
+		}
+		participant.Conn.Close()
+		return
 	}
 
-	s.joinRoom(roomID, participant)
-
-	go s.handleConnection(roomID, participant)
+	go s.handleConnection(roomID, participant, wrapped)
 }
 
-func (s *Server) joinRoom(slug string, participant *Participant) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	if _, exists := s.rooms[slug]; !exists {
-		s.rooms[slug] = NewRoom(slug)
+// joinRoom admits the participant and sets up its media. The peer
+// connection is only built for a participant the room would take, and
+// without holding s.mutex.
+func (s *Server) joinRoom(slug string, participant *Participant) error {
+	room, err := s.prepareJoin(slug, participant)
+	if err != nil {
+		return err
 	}
 
-	room := s.rooms[slug]
-
-	// Initialize SFU for the participant
 	if err := s.initSFU(room, participant); err != nil {
-		log.Printf("Failed to init SFU: %v", err)
-		participant.Conn.Close()
-		return
+		s.mutex.Lock()
+		room.endJoin()
+		unloaded := s.unloadIfEmpty(room)
+		s.mutex.Unlock()
+		if unloaded {
+			s.storeUnloaded(room)
+		}
+		participant.closeMedia()
+		return fmt.Errorf("failed to init SFU: %w", err)
+	}
+
+	s.mutex.Lock()
+	room.endJoin()
+	var replaced *Participant
+	var reclaimed, unloaded bool
+	if s.rooms[slug] != room {
+		// The janitor closed the room meanwhile
+		err = ErrRoomNotFound
+	} else {
+		replaced, reclaimed, err = room.admit(participant)
+	}
+	if err != nil {
+		unloaded = s.unloadIfEmpty(room)
+	} else {
+		s.participants[participant.ID] = member{room: room, participant: participant}
+		room.Touch(time.Now(), s.config.RoomIdleTimeout)
 	}
+	s.mutex.Unlock()
 
-	room.AddParticipant(participant)
+	if err != nil {
+		if unloaded {
+			s.storeUnloaded(room)
+		}
+		participant.closeMedia()
+		return err
+	}
+	if replaced != nil {
+		// The old session leaves quietly once its read loop notices
+		log.Printf("Host %s of room %s reconnected, replacing its previous session", participant.ID, slug)
+		s.teardownMedia(room, replaced)
+		replaced.Conn.Close()
+	}
 
 	// Notify others?
 	// For SFU, we might not need to broadcast "join" in the same way as P2P,
@@ -145,17 +477,79 @@ func (s *Server) joinRoom(slug string, participant *Participant) {
 	participant.Conn.WriteJSON(&Message{
 		Type:      MessageTypeJoin, // Ack
 		RoomID:    slug,
+		Data:      joinAck(participant, false),
 		Timestamp: time.Now(),
 	})
+	// Guests get the list once the host lets them in
+	if participant.Status == StatusInRoom {
+		participant.Conn.WriteJSON(&Message{
+			Type:      MessageTypeTracks,
+			RoomID:    slug,
+			Data:      room.TracksData(),
+			Timestamp: time.Now(),
+		})
+	}
+	s.subscribeToRoom(room, participant)
+	if reclaimed {
+		log.Printf("Host %s reclaimed room %s", participant.ID, slug)
+		broadcastHostStatus(room, HostStatusData{ParticipantID: participant.ID, Status: HostStatusReturned})
+		broadcastParticipants(room)
+	}
+
+	return nil
 }
 
-func (s *Server) handleConnection(slug string, participant *Participant) {
-	defer s.leaveRoom(slug, participant)
+// prepareJoin loads the room and checks that it would take the participant.
+// The room stays loaded until the caller ends the join.
+func (s *Server) prepareJoin(slug string, participant *Participant) (*Room, error) {
+	s.mutex.Lock()
+	room, err := s.loadRoom(slug)
+	if err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	if room.IsExpired(time.Now()) {
+		err = ErrRoomNotFound
+	} else {
+		err = room.checkAdmission(participant)
+	}
+	if err == nil {
+		room.beginJoin()
+		s.mutex.Unlock()
+		return room, nil
+	}
+	unloaded := s.unloadIfEmpty(room)
+	s.mutex.Unlock()
+
+	if unloaded {
+		s.storeUnloaded(room)
+	}
+	return nil, err
+}
 
+// joinAck confirms a join or a resumed session to the participant
+func joinAck(participant *Participant, resumed bool) *JoinAckData {
+	ack := &JoinAckData{
+		ParticipantID: participant.ID,
+		ICEServers:    participant.ICEServers,
+		Polite:        true,
+		Profile:       participant.Profile,
+		AutoSubscribe: !participant.manualSubscribe,
+		Resumed:       resumed,
+	}
+	if participant.session != nil {
+		ack.ResumeToken = participant.session.token
+	}
+	return ack
+}
+
+// handleConnection reads the participant's messages from conn until it
+// closes. A resumed session reads from its new connection in a new call.
+func (s *Server) handleConnection(slug string, participant *Participant, conn WebSocketConnInterface) {
+	var err error
 	for {
 		var message Message
-		err := participant.Conn.ReadJSON(&message)
-		if err != nil {
+		if err = conn.ReadJSON(&message); err != nil {
 			log.Printf("Read message error: %v", err)
 			break
 		}
@@ -166,67 +560,402 @@ func (s *Server) handleConnection(slug string, participant *Participant) {
 
 		s.handleMessage(slug, participant, &message)
 	}
+
+	s.connectionLost(slug, participant, conn, err)
+}
+
+// connectionLost makes the participant leave once conn is gone. A
+// connection that dropped without a close handshake keeps the session, and
+// the participant with its media, for the reconnect window instead.
+func (s *Server) connectionLost(slug string, participant *Participant, conn WebSocketConnInterface, err error) {
+	if session := participant.session; session != nil {
+		dropped := !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+		if dropped && s.config.ReconnectWindow > 0 && s.isLive(slug) && session.detach(conn, time.Now().Add(s.config.ReconnectWindow)) {
+			log.Printf("Participant %s dropped out of room %s, keeping its session for %s", participant.ID, slug, s.config.ReconnectWindow)
+			conn.Close()
+			return
+		}
+		if session.supersedes(conn) {
+			// The session was resumed on a newer connection
+			conn.Close()
+			return
+		}
+	}
+	s.leaveRoom(slug, participant)
 }
 
+// leaveRoom removes the participant from the room, then tears down its media
+// and tells everyone once s.mutex is released
 func (s *Server) leaveRoom(slug string, participant *Participant) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	room, exists := s.rooms[slug]
 	if !exists {
+		s.forget(participant)
+		s.mutex.Unlock()
+		participant.Conn.Close()
 		return
 	}
+	left, unloaded := s.leave(room, participant)
+	s.mutex.Unlock()
+
+	if unloaded {
+		s.storeUnloaded(room)
+	}
+	s.departed(room, participant, left)
+}
+
+// forget drops the participant from the index, unless a new session of the
+// same participant took its place. The caller must hold s.mutex for writing.
+func (s *Server) forget(participant *Participant) {
+	if s.participants[participant.ID].participant == participant {
+		delete(s.participants, participant.ID)
+	}
+}
+
+// leave removes the participant from the room and unloads the room once it
+// is empty. The caller must hold s.mutex for writing; after releasing it,
+// the caller passes the departure to departed and stores an unloaded room.
+func (s *Server) leave(room *Room, participant *Participant) (left departure, unloaded bool) {
+	s.forget(participant)
+	now := time.Now()
+	left = room.leave(participant, s.config.HostGracePeriod, now)
+	if left.absent {
+		return left, false
+	}
 
 	room.RemovePublicKey(participant.ID)
+	room.Touch(now, s.config.RoomIdleTimeout)
+	return left, s.unloadIfEmpty(room)
+}
+
+// departed closes the media and connection of a participant that left and
+// tells everyone in the room
+func (s *Server) departed(room *Room, participant *Participant, left departure) {
+	if left.absent {
+		// Its media went with the takeover or an earlier leave
+		participant.Conn.Close()
+		return
+	}
 
-	room.RemoveParticipant(participant.ID)
+	s.teardownMedia(room, participant)
 	participant.Conn.Close()
 
 	leaveMessage := &Message{
 		Type:      MessageTypeLeave,
 		From:      participant.ID,
-		RoomID:    slug,
+		RoomID:    room.Slug,
 		Timestamp: time.Now(),
 	}
 	room.BroadcastToAll(leaveMessage, participant.ID)
 
 	room.BroadcastPublicKeys(participant.ID)
 
-	if room.IsEmpty() {
-		delete(s.rooms, slug)
-		log.Printf("Room %s deleted (empty)", slug)
+	switch {
+	case left.away != nil:
+		log.Printf("Host %s dropped out of room %s, holding its seat until %s", participant.ID, room.Slug, left.away.until.Format(time.RFC3339))
+		broadcastHostStatus(room, HostStatusData{
+			ParticipantID: participant.ID,
+			Status:        HostStatusAway,
+			ReturnBy:      left.away.until,
+		})
+	case left.hostLeft:
+		s.hostGone(room, participant.ID, left.admitted, left.rejected)
+	}
+}
+
+// resumeSession attaches conn to the session with resumeToken and replays
+// the messages the client missed. The token only works with the access token
+// the session was started with.
+func (s *Server) resumeSession(slug, resumeToken, tokenID string, lastSeq uint64, conn WebSocketConnInterface) (*Participant, error) {
+	room, participant, err := s.findSession(slug, resumeToken, tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := participant.session.resume(conn, lastSeq, &Message{
+		Type:      MessageTypeJoin,
+		RoomID:    slug,
+		Data:      joinAck(participant, true),
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		// The client starts over with a fresh join
+		s.leaveRoom(slug, participant)
+		return nil, err
+	}
+	if previous != nil {
+		previous.Close()
 	}
+
+	room.Touch(time.Now(), s.config.RoomIdleTimeout)
+	log.Printf("Participant %s resumed its session in room %s from message %d", participant.ID, slug, lastSeq)
+	return participant, nil
 }
 
-func (s *Server) GetRoomStats(slug string) map[string]interface{} {
+// findSession looks up the participant whose session has resumeToken
+func (s *Server) findSession(slug, resumeToken, tokenID string) (*Room, *Participant, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	room, exists := s.rooms[slug]
 	if !exists {
-		return nil
+		return nil, nil, fmt.Errorf("%w: room is not live", ErrResumeFailed)
 	}
 
-	return map[string]interface{}{
-		"slug":         room.Slug,
-		"participants": room.GetParticipantsData(),
-		"created_at":   room.CreatedAt,
-		"has_host":     room.Host != nil,
-		"guests_count": len(room.Guests),
+	for _, participant := range room.GetAllParticipants() {
+		if participant.session != nil && participant.session.matches(resumeToken) && participant.tokenID == tokenID {
+			return room, participant, nil
+		}
 	}
+	return nil, nil, fmt.Errorf("%w: unknown resume token", ErrResumeFailed)
 }
 
-func (s *Server) Shutdown() {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// hostGone tells the room its host is not coming back and lets in or turns
+// away the waiting guests the host absence policy picked
+func (s *Server) hostGone(room *Room, hostID string, admitted, rejected []*Participant) {
+	log.Printf("Room %s has no host; %d waiting guests admitted, %d rejected", room.Slug, len(admitted), len(rejected))
+	broadcastHostStatus(room, HostStatusData{ParticipantID: hostID, Status: HostStatusAbsent})
+
+	for _, guest := range rejected {
+		guest.Conn.WriteJSON(&Message{
+			Type:      MessageTypeDeny,
+			To:        guest.ID,
+			RoomID:    room.Slug,
+			Timestamp: time.Now(),
+		})
+		guest.Conn.Close()
+	}
+
+	for _, guest := range admitted {
+		guest.Conn.WriteJSON(&Message{
+			Type:      MessageTypeAllow,
+			To:        guest.ID,
+			RoomID:    room.Slug,
+			Timestamp: time.Now(),
+		})
+		guest.Conn.WriteJSON(&Message{
+			Type:      MessageTypeTracks,
+			RoomID:    room.Slug,
+			Data:      room.TracksData(),
+			Timestamp: time.Now(),
+		})
+		s.subscribeToRoom(room, guest)
+	}
+	if len(admitted) > 0 {
+		broadcastParticipants(room)
+	}
+}
+
+// broadcastHostStatus tells everyone in the room about its host
+func broadcastHostStatus(room *Room, data HostStatusData) {
+	room.BroadcastToAll(&Message{
+		Type:      MessageTypeHostStatus,
+		RoomID:    room.Slug,
+		Data:      data,
+		Timestamp: time.Now(),
+	}, "")
+}
+
+// broadcastParticipants sends the participant list to everyone in the room
+func broadcastParticipants(room *Room) {
+	room.BroadcastToAll(&Message{
+		Type:      MessageTypeParticipants,
+		RoomID:    room.Slug,
+		Data:      room.GetParticipantsData(),
+		Timestamp: time.Now(),
+	}, "")
+}
+
+// unloadIfEmpty drops an empty room from memory; its metadata stays in the
+// store until the room expires. The caller must hold s.mutex for writing
+// and pass an unloaded room to storeUnloaded after releasing it.
+func (s *Server) unloadIfEmpty(room *Room) bool {
+	if !room.IsEmpty() || s.rooms[room.Slug] != room {
+		return false
+	}
+
+	delete(s.rooms, room.Slug)
+	return true
+}
+
+// storeUnloaded records the activity of a room that was unloaded, or deletes
+// it once expired
+func (s *Server) storeUnloaded(room *Room) {
+	if room.IsExpired(time.Now()) {
+		if err := s.store.Delete(room.Slug); err != nil {
+			log.Printf("Failed to delete room %s from store: %v", room.Slug, err)
+		}
+		log.Printf("Room %s deleted (empty and expired)", room.Slug)
+		return
+	}
+
+	// Persist the activity-extended expiry so it survives a restart
+	if err := s.store.Update(room.Metadata()); err != nil && !errors.Is(err, ErrRoomNotFound) {
+		log.Printf("Failed to update room %s in store: %v", room.Slug, err)
+	}
+}
+
+func (s *Server) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expireRooms(time.Now())
+		case <-s.done:
+			return
+		}
+	}
+}
 
+// expireRooms closes live rooms past their expiry, removes participants who
+// did not resume their session in time, gives up the seats of hosts whose
+// grace period ended and purges expired rooms that nobody has
+// joined since the last restart from the store. Rooms are picked under
+// s.mutex; participants are told and the store is updated after releasing it.
+func (s *Server) expireRooms(now time.Time) {
+	s.mutex.Lock()
+	var expired, live []*Room
 	for _, room := range s.rooms {
-		if room.Host != nil {
-			room.Host.Conn.Close()
+		if room.IsExpired(now) {
+			delete(s.rooms, room.Slug)
+			for _, participant := range room.GetAllParticipants() {
+				s.forget(participant)
+			}
+			expired = append(expired, room)
+			continue
+		}
+		live = append(live, room)
+	}
+	s.mutex.Unlock()
+
+	for _, room := range expired {
+		s.closeRoom(room)
+	}
+
+	for _, room := range live {
+		for _, participant := range room.GetAllParticipants() {
+			if participant.session != nil && participant.session.expired(now) {
+				log.Printf("Participant %s did not resume its session in room %s", participant.ID, room.Slug)
+				s.leaveRoom(room.Slug, participant)
+			}
+		}
+		if absence, admitted, rejected, ok := room.endHostGrace(now); ok {
+			s.hostGone(room, absence.participantID, admitted, rejected)
+			s.mutex.Lock()
+			unloaded := s.unloadIfEmpty(room)
+			s.mutex.Unlock()
+			if unloaded {
+				s.storeUnloaded(room)
+			}
+		}
+	}
+
+	stored, err := s.store.List()
+	if err != nil {
+		log.Printf("Failed to list rooms for expiry: %v", err)
+		return
+	}
+
+	for _, meta := range stored {
+		// A room loaded from an expired record is expired too and cannot be
+		// joined, so the record can go even if it is loaded meanwhile
+		if now.Before(meta.ExpiresAt) || s.isLive(meta.Slug) {
+			continue
+		}
+		if err := s.store.Delete(meta.Slug); err != nil {
+			log.Printf("Failed to delete room %s from store: %v", meta.Slug, err)
+			continue
 		}
-		for _, guest := range room.Guests {
-			guest.Conn.Close()
+		log.Printf("Room %s deleted (expired)", meta.Slug)
+	}
+}
+
+// isLive reports whether the room is loaded in memory
+func (s *Server) isLive(slug string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, live := s.rooms[slug]
+	return live
+}
+
+// closeRoom tells every participant of a room the janitor already forgot
+// that it has expired, tears down their connections and deletes the room
+// from the store
+func (s *Server) closeRoom(room *Room) {
+	message := &Message{
+		Type:   MessageTypeRoomExpired,
+		RoomID: room.Slug,
+		Data: RoomExpiredData{
+			ExpiresAt: room.Metadata().ExpiresAt,
+		},
+		Timestamp: time.Now(),
+	}
+
+	for _, participant := range room.GetAllParticipants() {
+		participant.Conn.WriteJSON(message)
+		participant.closeMedia()
+		participant.Conn.Close()
+	}
+
+	if err := s.store.Delete(room.Slug); err != nil {
+		log.Printf("Failed to delete room %s from store: %v", room.Slug, err)
+	}
+
+	log.Printf("Room %s closed (expired)", room.Slug)
+}
+
+func (s *Server) GetRoomStats(slug string) *RoomStats {
+	s.mutex.RLock()
+	room, exists := s.rooms[slug]
+	s.mutex.RUnlock()
+
+	if exists {
+		return room.GetStats()
+	}
+
+	meta, err := s.store.Get(slug)
+	if err != nil {
+		if !errors.Is(err, ErrRoomNotFound) {
+			log.Printf("Failed to load room %s: %v", slug, err)
 		}
+		return nil
+	}
+
+	return newRoomFromMetadata(meta).GetStats()
+}
+
+// HasParticipant reports whether the participant with this ID was let into
+// a live room; guests still knocking are not. The embedded TURN relay
+// authorizes allocations with it.
+func (s *Server) HasParticipant(participantID string) bool {
+	s.mutex.RLock()
+	m, exists := s.participants[participantID]
+	s.mutex.RUnlock()
+
+	return exists && m.room.IsAdmitted(m.participant)
+}
+
+// Shutdown stops the janitor and closes the media and connections of every
+// participant
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.done)
+	})
+
+	s.mutex.Lock()
+	var participants []*Participant
+	for _, room := range s.rooms {
+		participants = append(participants, room.GetAllParticipants()...)
 	}
 	s.rooms = make(map[string]*Room)
+	s.participants = make(map[string]member)
+	s.mutex.Unlock()
+
+	for _, participant := range participants {
+		participant.closeMedia()
+		participant.Conn.Close()
+	}
 }
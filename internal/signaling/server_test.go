@@ -1,18 +1,68 @@
 package signaling
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
+const testJWTSecret = "test-secret"
+
+func testConfig() Config {
+	config := DefaultConfig()
+	config.JWTSecret = testJWTSecret
+	return config
+}
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	server, err := NewServer(testJWTSecret)
+	require.NoError(t, err)
+	return server
+}
+
+func signTestToken(t *testing.T, slug string, role ParticipantRole, expiresIn time.Duration) string {
+	t.Helper()
+
+	// Like the HTTP API, every token gets its own jti
+	tokenID := make([]byte, 16)
+	if _, err := rand.Read(tokenID); err != nil {
+		t.Fatalf("failed to generate token id: %v", err)
+	}
+
+	claims := TokenClaims{
+		Slug: slug,
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(tokenID),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatalf("failed to sign test token: %v", err)
+	}
+	return token
+}
+
 func TestShutdown(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
 	slug := "test-room"
 
 	mockHostConn := &MockWebSocketConn{}
@@ -37,21 +87,30 @@ func TestShutdown(t *testing.T) {
 
 	assert.Equal(t, 1, len(server.rooms))
 
-	// Wait for Close calls on both connections
-	mockHostConn.On("Close").Return(nil).Once()
+	// Wait for Close calls on both connections, made without the server
+	// lock
+	unlocked := false
+	mockHostConn.On("Close").Run(func(mock.Arguments) {
+		if unlocked = server.mutex.TryLock(); unlocked {
+			server.mutex.Unlock()
+		}
+	}).Return(nil).Once()
 	mockGuestConn.On("Close").Return(nil).Once()
 
 	server.Shutdown()
 
 	// Check that all rooms are cleared after shutdown
 	assert.Equal(t, 0, len(server.rooms))
+	assert.True(t, unlocked)
 
 	mockHostConn.AssertExpectations(t)
 	mockGuestConn.AssertExpectations(t)
 }
 
 func TestWebSocketConnection(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
+	defer server.Shutdown()
+	server.rooms["test-room"] = NewRoom("test-room")
 
 	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
 	defer testServer.Close()
@@ -69,7 +128,7 @@ func TestWebSocketConnection(t *testing.T) {
 	joinMsg := Message{
 		Type: MessageTypeJoin,
 		Data: map[string]interface{}{
-			"user_id": "user1",
+			"token": signTestToken(t, "test-room", RoleGuest, time.Hour),
 		},
 	}
 	err = conn.WriteJSON(joinMsg)
@@ -80,31 +139,484 @@ func TestWebSocketConnection(t *testing.T) {
 
 	stats := server.GetRoomStats("test-room")
 	assert.NotNil(t, stats)
-	assert.Equal(t, "test-room", stats["slug"])
-	// Since we didn't specify role in Join (it defaults to something or logic handles it),
-	// let's check if participant is added.
-	// Actually, the current implementation in server.go doesn't set role from Join message yet,
-	// it might default to Guest or Host depending on logic I wrote?
-	// Let's check server.go logic.
-	// It creates participant with ID from message.
-	// It calls joinRoom.
-	// joinRoom calls AddParticipant.
-	// AddParticipant checks Role. If RoleHost, sets Host. Else adds to Guests.
-	// Participant struct default Role is empty string.
-	// So it will be added as Guest (StatusKnocking).
-
-	assert.Equal(t, 1, stats["guests_count"])
+	assert.Equal(t, "test-room", stats.Slug)
+	// The guest token puts the participant in the waiting room (StatusKnocking).
+
+	assert.Equal(t, 1, stats.GuestsCount)
+	assert.Equal(t, 1, stats.KnockingCount)
+	assert.Equal(t, 0, stats.InRoomCount)
+}
+
+func TestWebSocketUnknownRoom(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/missing-room?token=" +
+		signTestToken(t, "missing-room", RoleGuest, time.Hour)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.WriteJSON(Message{Type: MessageTypeJoin})
+	assert.NoError(t, err)
+
+	var response struct {
+		Type MessageType `json:"type"`
+		Data ErrorData   `json:"data"`
+	}
+	err = conn.ReadJSON(&response)
+	assert.NoError(t, err)
+	assert.Equal(t, MessageTypeError, response.Type)
+	assert.Equal(t, "ROOM_NOT_FOUND", response.Data.Code)
+
+	assert.Nil(t, server.GetRoomStats("missing-room"))
+}
+
+func TestWebSocketMediaProfile(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+	server.rooms["test-room"] = room
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/test-room?token=" +
+		signTestToken(t, "test-room", RoleGuest, time.Hour)
+
+	join := func(profile string) (MessageType, map[string]interface{}) {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		require.NoError(t, conn.WriteJSON(Message{
+			Type: MessageTypeJoin,
+			Data: map[string]interface{}{"media_profile": profile},
+		}))
+
+		var response struct {
+			Type MessageType            `json:"type"`
+			Data map[string]interface{} `json:"data"`
+		}
+		require.NoError(t, conn.ReadJSON(&response))
+		return response.Type, response.Data
+	}
+
+	messageType, data := join("audio_only")
+	assert.Equal(t, MessageTypeJoin, messageType)
+	assert.Equal(t, "audio_only", data["media_profile"])
+	assert.Equal(t, true, data["auto_subscribe"])
+	participant := room.GetParticipant(data["participant_id"].(string))
+	require.NotNil(t, participant)
+	assert.Equal(t, MediaProfileAudioOnly, participant.Profile)
+
+	messageType, data = join("video_only")
+	assert.Equal(t, MessageTypeError, messageType)
+	assert.Equal(t, "INVALID_MEDIA_PROFILE", data["code"])
+	assert.Equal(t, 1, room.GetStats().GuestsCount)
+}
+
+func TestCreateRoom(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[a-zA-Z0-9]{10}$`, room.Slug)
+	assert.Equal(t, int64(42), room.CreatorUserID)
+	assert.Equal(t, room.CreatedAt.Add(time.Hour), room.ExpiresAt)
+
+	stored, err := server.store.Get(room.Slug)
+	assert.NoError(t, err)
+	assert.Equal(t, room.ExpiresAt, stored.ExpiresAt)
+
+	// The live room is only materialized on join
+	assert.Empty(t, server.rooms)
+	stats := server.GetRoomStats(room.Slug)
+	assert.NotNil(t, stats)
+	assert.Equal(t, room.Slug, stats.Slug)
+}
+
+// unlockedStore fails the test when room metadata is written or listed while
+// the server lock is held
+type unlockedStore struct {
+	RoomStore
+	t      *testing.T
+	server *Server
+}
+
+func (s *unlockedStore) assertUnlocked(operation string) {
+	if !s.server.mutex.TryLock() {
+		s.t.Errorf("store %s ran under the server lock", operation)
+		return
+	}
+	s.server.mutex.Unlock()
+}
+
+func (s *unlockedStore) Create(meta *RoomMetadata) error {
+	s.assertUnlocked("Create")
+	return s.RoomStore.Create(meta)
+}
+
+func (s *unlockedStore) Update(meta *RoomMetadata) error {
+	s.assertUnlocked("Update")
+	return s.RoomStore.Update(meta)
+}
+
+func (s *unlockedStore) Delete(slug string) error {
+	s.assertUnlocked("Delete")
+	return s.RoomStore.Delete(slug)
+}
+
+func (s *unlockedStore) List() ([]*RoomMetadata, error) {
+	s.assertUnlocked("List")
+	return s.RoomStore.List()
+}
+
+func newUnlockedStoreServer(t *testing.T, config Config) *Server {
+	t.Helper()
+
+	store := &unlockedStore{RoomStore: NewMemoryRoomStore(), t: t}
+	server, err := NewServerWithConfig(config, store)
+	require.NoError(t, err)
+	store.server = server
+	return server
+}
+
+func TestCreateRoomOutsideServerLock(t *testing.T) {
+	config := testConfig()
+	config.Limits.MaxRooms = 1
+	server := newUnlockedStoreServer(t, config)
+	defer server.Shutdown()
+
+	_, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	require.NoError(t, err)
+	_, err = server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.ErrorIs(t, err, ErrServerAtCapacity)
+}
+
+func TestGenerateRoomIDUniform(t *testing.T) {
+	counts := make(map[rune]int)
+	const ids = 20000
+	for i := 0; i < ids; i++ {
+		id, err := generateRoomID()
+		require.NoError(t, err)
+		require.Regexp(t, `^[a-zA-Z0-9]{10}$`, id)
+		for _, c := range id {
+			counts[c]++
+		}
+	}
+
+	// Each character is expected about 3226 times; a modulo bias shows the
+	// first ones about 25% more often
+	expected := float64(ids*roomIDLength) / float64(len(roomIDAlphabet))
+	assert.Len(t, counts, len(roomIDAlphabet))
+	for c, count := range counts {
+		assert.InDelta(t, expected, float64(count), expected*0.1, "character %q", c)
+	}
+}
+
+func TestCreateRoomPolicy(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultLimits().MaxParticipantsPerRoom, room.Policy.MaxParticipants)
+
+	room, err = server.CreateRoom(42, time.Hour, RoomPolicy{MaxParticipants: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, room.Policy.MaxParticipants)
+
+	_, err = server.CreateRoom(42, time.Hour, RoomPolicy{MaxParticipants: 1})
+	assert.ErrorIs(t, err, ErrInvalidRoomPolicy)
+	_, err = server.CreateRoom(42, time.Hour, RoomPolicy{MaxParticipants: 5})
+	assert.ErrorIs(t, err, ErrInvalidRoomPolicy)
+}
+
+func TestCreateRoomServerAtCapacity(t *testing.T) {
+	config := testConfig()
+	config.Limits = Limits{MaxRooms: 2, MaxParticipantsPerRoom: 4}
+	server, err := NewServerWithConfig(config, NewMemoryRoomStore())
+	require.NoError(t, err)
+	defer server.Shutdown()
+
+	_, err = server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+	_, err = server.CreateRoom(42, -time.Minute, RoomPolicy{}) // expired rooms do not count
+	assert.NoError(t, err)
+	_, err = server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+
+	_, err = server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.ErrorIs(t, err, ErrServerAtCapacity)
+}
+
+func TestWebSocketRoomFull(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	// Guests are admitted without a host, so the first one fills the room
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{MaxParticipants: 2, HostAbsence: HostAbsenceAutoAdmit})
+	assert.NoError(t, err)
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+
+	dial := func() (*websocket.Conn, Message) {
+		wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/" + room.Slug + "?token=" +
+			signTestToken(t, room.Slug, RoleGuest, time.Hour)
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.WriteJSON(Message{Type: MessageTypeJoin}))
+
+		var response Message
+		assert.NoError(t, conn.ReadJSON(&response))
+		return conn, response
+	}
+
+	first, response := dial()
+	defer first.Close()
+	assert.Equal(t, MessageTypeJoin, response.Type)
+
+	second, response := dial()
+	defer second.Close()
+	assert.Equal(t, MessageTypeError, response.Type)
+	assert.Equal(t, "ROOM_FULL", response.Data.(map[string]interface{})["code"])
+}
+
+func TestWebSocketParticipantIDFromToken(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+	server.rooms[room.Slug] = room
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/test-room?token="
+	hostToken := signTestToken(t, "test-room", RoleHost, time.Hour)
+	guestToken := signTestToken(t, "test-room", RoleGuest, time.Hour)
+
+	join := func(token string, data map[string]interface{}) Message {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+token, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		require.NoError(t, conn.WriteJSON(Message{Type: MessageTypeJoin, Data: data}))
+		var reply Message
+		require.NoError(t, conn.ReadJSON(&reply))
+		return reply
+	}
+
+	ack := join(hostToken, map[string]interface{}{})
+	require.Equal(t, MessageTypeJoin, ack.Type)
+	hostID, _ := ack.Data.(map[string]interface{})["participant_id"].(string)
+	claims, err := server.verifyToken(hostToken, "test-room")
+	require.NoError(t, err)
+	assert.Equal(t, participantID(tokenIdentity(hostToken, claims)), hostID)
+
+	// A guest asking for the host's ID gets one of its own
+	ack = join(guestToken, map[string]interface{}{"user_id": hostID})
+	require.Equal(t, MessageTypeJoin, ack.Type)
+	guestID, _ := ack.Data.(map[string]interface{})["participant_id"].(string)
+	assert.NotEqual(t, hostID, guestID)
+	assert.True(t, room.IsHost(room.GetParticipant(hostID)))
+
+	// The same guest token cannot join twice
+	reply := join(guestToken, map[string]interface{}{})
+	assert.Equal(t, MessageTypeError, reply.Type)
+	assert.Equal(t, "PARTICIPANT_EXISTS", reply.Data.(map[string]interface{})["code"])
+	assert.Equal(t, 1, room.GetStats().GuestsCount)
+}
+
+func TestRoomSurvivesServerRestart(t *testing.T) {
+	store, err := NewBoltRoomStore(filepath.Join(t.TempDir(), "rooms.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	server, err := NewServerWithConfig(testConfig(), store)
+	require.NoError(t, err)
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+	server.Shutdown()
+
+	restarted, err := NewServerWithConfig(testConfig(), store)
+	require.NoError(t, err)
+	defer restarted.Shutdown()
+	stats := restarted.GetRoomStats(room.Slug)
+	assert.NotNil(t, stats)
+	assert.True(t, room.ExpiresAt.Equal(stats.ExpiresAt))
+}
+
+func TestHasParticipant(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	meta, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	require.NoError(t, err)
+	host := &Participant{ID: "alice", Role: RoleHost, Conn: acceptingConn()}
+	guest := &Participant{ID: "bob", Role: RoleGuest, Conn: acceptingConn()}
+	require.NoError(t, server.joinRoom(meta.Slug, host))
+	require.NoError(t, server.joinRoom(meta.Slug, guest))
+
+	assert.True(t, server.HasParticipant("alice"))
+	assert.False(t, server.HasParticipant("mallory"))
+
+	// Guests get relays once they are let in
+	assert.False(t, server.HasParticipant("bob"))
+	require.NoError(t, server.rooms[meta.Slug].AllowGuest("bob"))
+	assert.True(t, server.HasParticipant("bob"))
+
+	server.leaveRoom(meta.Slug, guest)
+	assert.False(t, server.HasParticipant("bob"))
+	assert.NotContains(t, server.participants, "bob")
+}
+
+func TestLeaveRoomUnloadsEmptyRoom(t *testing.T) {
+	// The store is written once the server lock is released
+	server := newUnlockedStoreServer(t, testConfig())
+	defer server.Shutdown()
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+
+	mockConn := &MockWebSocketConn{}
+	mockConn.On("WriteJSON", mock.Anything).Return(nil)
+	mockConn.On("Close").Return(nil)
+	participant := &Participant{ID: "host1", Conn: mockConn, Role: RoleHost}
+
+	assert.NoError(t, server.joinRoom(room.Slug, participant))
+	defer participant.PC.Close()
+	assert.Contains(t, server.rooms, room.Slug)
+
+	server.leaveRoom(room.Slug, participant)
+	assert.NotContains(t, server.rooms, room.Slug)
+
+	// Metadata is kept until the room expires, so the room can be rejoined
+	_, err = server.store.Get(room.Slug)
+	assert.NoError(t, err)
+}
+
+func TestJoinExpiredRoom(t *testing.T) {
+	// The store is written once the server lock is released
+	server := newUnlockedStoreServer(t, testConfig())
+	defer server.Shutdown()
+
+	room, err := server.CreateRoom(42, -time.Minute, RoomPolicy{})
+	assert.NoError(t, err)
+
+	err = server.joinRoom(room.Slug, &Participant{ID: "user1", Conn: &MockWebSocketConn{}})
+	assert.ErrorIs(t, err, ErrRoomNotFound)
+}
+
+func TestJoinRoomChecksAdmissionFirst(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	meta, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	require.NoError(t, err)
+	host := &Participant{ID: "host1", Role: RoleHost, Conn: acceptingConn()}
+	require.NoError(t, server.joinRoom(meta.Slug, host))
+	room := server.rooms[meta.Slug]
+	room.SetLocked(true)
+
+	// No peer connection is built for a guest the room turns away
+	guest := &Participant{ID: "guest1", Role: RoleGuest, Conn: acceptingConn()}
+	assert.ErrorIs(t, server.joinRoom(meta.Slug, guest), ErrRoomLocked)
+	assert.Nil(t, guest.PC)
+
+	// A join in progress keeps the room loaded
+	room.beginJoin()
+	server.leaveRoom(meta.Slug, host)
+	assert.Contains(t, server.rooms, meta.Slug)
+	room.endJoin()
+}
+
+func TestExpireRoomsClosesLiveRoom(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+
+	mockConn := &MockWebSocketConn{}
+	mockConn.On("WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		return msg.Type == MessageTypeJoin
+	})).Return(nil).Once()
+	mockConn.On("WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		return msg.Type == MessageTypeTracks
+	})).Return(nil).Once()
+	participant := &Participant{ID: "host1", Conn: mockConn, Role: RoleHost}
+	assert.NoError(t, server.joinRoom(room.Slug, participant))
+
+	unlocked := false
+	mockConn.On("WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		return msg.Type == MessageTypeRoomExpired
+	})).Run(func(mock.Arguments) {
+		if unlocked = server.mutex.TryLock(); unlocked {
+			server.mutex.Unlock()
+		}
+	}).Return(nil).Once()
+	mockConn.On("Close").Return(nil).Once()
+
+	server.expireRooms(time.Now().Add(25 * time.Hour))
+
+	assert.True(t, unlocked, "participants are told without holding the server lock")
+	assert.NotContains(t, server.rooms, room.Slug)
+	assert.Equal(t, webrtc.PeerConnectionStateClosed, participant.PC.ConnectionState())
+	_, err = server.store.Get(room.Slug)
+	assert.ErrorIs(t, err, ErrRoomNotFound)
+	mockConn.AssertExpectations(t)
+}
+
+func TestExpireRoomsPurgesStore(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+
+	expired, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+	fresh, err := server.CreateRoom(42, 48*time.Hour, RoomPolicy{})
+	assert.NoError(t, err)
+
+	server.expireRooms(time.Now().Add(25 * time.Hour))
+
+	_, err = server.store.Get(expired.Slug)
+	assert.ErrorIs(t, err, ErrRoomNotFound)
+	_, err = server.store.Get(fresh.Slug)
+	assert.NoError(t, err)
+}
+
+func TestCheckOrigin(t *testing.T) {
+	config := testConfig()
+	config.AllowedOrigins = []string{"https://kaamos.example.com"}
+	server, err := NewServerWithConfig(config, NewMemoryRoomStore())
+	require.NoError(t, err)
+	defer server.Shutdown()
+
+	req := httptest.NewRequest(http.MethodGet, "/ws/room1", nil)
+	assert.True(t, server.checkOrigin(req))
+
+	req.Header.Set("Origin", "https://kaamos.example.com")
+	assert.True(t, server.checkOrigin(req))
+
+	req.Header.Set("Origin", "https://evil.example.com")
+	assert.False(t, server.checkOrigin(req))
 }
 
 func TestNewServer(t *testing.T) {
-	server := NewServer()
+	server, err := NewServer(testJWTSecret)
+	require.NoError(t, err)
+	defer server.Shutdown()
 	assert.NotNil(t, server)
 	assert.NotNil(t, server.rooms)
 	assert.Equal(t, 0, len(server.rooms))
 }
 
 func TestInvalidWebSocketParams(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
+	defer server.Shutdown()
 
 	// Missing room ID in path
 	req := httptest.NewRequest(http.MethodGet, "/ws/", nil)
@@ -113,3 +625,247 @@ func TestInvalidWebSocketParams(t *testing.T) {
 	server.HandleWebSocket(w, req)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
+
+func isHostStatus(status HostStatus) interface{} {
+	return mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(HostStatusData)
+		return msg.Type == MessageTypeHostStatus && ok && data.Status == status && data.ParticipantID == "host1"
+	})
+}
+
+func TestHostGracePeriod(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{HostAbsence: HostAbsenceReject})
+	require.NoError(t, err)
+
+	join := func(id string, role ParticipantRole, tokenID string) *Participant {
+		conn := &MockWebSocketConn{}
+		conn.On("WriteJSON", mock.Anything).Return(nil)
+		conn.On("Close").Return(nil)
+		participant := &Participant{ID: id, Conn: conn, Role: role, tokenID: tokenID}
+		require.NoError(t, server.joinRoom(room.Slug, participant))
+		return participant
+	}
+
+	host := join("host1", RoleHost, "host-token")
+	admitted := join("guest1", RoleGuest, "guest1-token")
+	live := server.rooms[room.Slug]
+	require.NoError(t, live.AllowGuest(admitted.ID))
+
+	server.leaveRoom(room.Slug, host)
+	require.Contains(t, server.rooms, room.Slug, "the room is kept for the host")
+	admitted.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isHostStatus(HostStatusAway))
+
+	// The host reclaims the room with the same token
+	host = join("host1", RoleHost, "host-token")
+	assert.True(t, live.IsHost(host))
+	admitted.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isHostStatus(HostStatusReturned))
+
+	// Waiting guests are held during the grace period and rejected after it
+	server.leaveRoom(room.Slug, host)
+	waiting := join("guest2", RoleGuest, "guest2-token")
+	assert.Equal(t, StatusKnocking, waiting.Status)
+
+	server.expireRooms(time.Now().Add(time.Second))
+	assert.NotNil(t, live.GetParticipant(waiting.ID))
+
+	server.expireRooms(time.Now().Add(server.config.HostGracePeriod))
+	assert.Nil(t, live.GetParticipant(waiting.ID))
+	waiting.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		return msg.Type == MessageTypeDeny
+	}))
+	waiting.Conn.(*MockWebSocketConn).AssertCalled(t, "Close")
+	admitted.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isHostStatus(HostStatusAbsent))
+
+	// Without a host new guests are turned away too
+	conn := &MockWebSocketConn{}
+	err = server.joinRoom(room.Slug, &Participant{ID: "guest3", Conn: conn, Role: RoleGuest})
+	assert.ErrorIs(t, err, ErrHostAbsent)
+
+	server.leaveRoom(room.Slug, admitted)
+	assert.NotContains(t, server.rooms, room.Slug)
+}
+
+func TestHostReconnectReplacesSession(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	require.NoError(t, err)
+
+	staleConn := &MockWebSocketConn{}
+	staleConn.On("WriteJSON", mock.Anything).Return(nil)
+	staleConn.On("Close").Return(nil)
+	stale := &Participant{ID: "host1", Conn: staleConn, Role: RoleHost, tokenID: "host-token"}
+	require.NoError(t, server.joinRoom(room.Slug, stale))
+
+	freshConn := &MockWebSocketConn{}
+	freshConn.On("WriteJSON", mock.Anything).Return(nil)
+	freshConn.On("Close").Return(nil)
+	fresh := &Participant{ID: "host1", Conn: freshConn, Role: RoleHost, tokenID: "host-token"}
+	require.NoError(t, server.joinRoom(room.Slug, fresh))
+
+	staleConn.AssertCalled(t, "Close")
+	assert.Equal(t, webrtc.PeerConnectionStateClosed, stale.PC.ConnectionState())
+
+	// The old read loop ending does not take the new session with it
+	server.leaveRoom(room.Slug, stale)
+	assert.True(t, server.rooms[room.Slug].IsHost(fresh))
+	freshConn.AssertNotCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		return msg.Type == MessageTypeLeave || msg.Type == MessageTypeHostStatus
+	}))
+}
+
+func TestLeaveRoomOutsideServerLock(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	require.NoError(t, err)
+
+	unlocked := false
+	leaves := 0
+	hostConn := &MockWebSocketConn{}
+	hostConn.On("WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		return msg.Type == MessageTypeLeave
+	})).Run(func(mock.Arguments) {
+		leaves++
+		if unlocked = server.mutex.TryLock(); unlocked {
+			server.mutex.Unlock()
+		}
+	}).Return(nil)
+	hostConn.On("WriteJSON", mock.Anything).Return(nil)
+	hostConn.On("Close").Return(nil)
+	host := &Participant{ID: "host1", Conn: hostConn, Role: RoleHost}
+	require.NoError(t, server.joinRoom(room.Slug, host))
+
+	guest := &Participant{ID: "guest1", Conn: acceptingConn(), Role: RoleGuest}
+	require.NoError(t, server.joinRoom(room.Slug, guest))
+	require.NoError(t, server.rooms[room.Slug].AllowGuest(guest.ID))
+
+	server.leaveRoom(room.Slug, guest)
+	assert.True(t, unlocked, "the room is told without holding the server lock")
+	assert.Equal(t, webrtc.PeerConnectionStateClosed, guest.PC.ConnectionState())
+
+	// Leaving twice tells the room once
+	server.leaveRoom(room.Slug, guest)
+	assert.Equal(t, 1, leaves)
+}
+
+func TestWebSocketResumeSession(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+	server.rooms[room.Slug] = room
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/test-room"
+	token := signTestToken(t, "test-room", RoleHost, time.Hour)
+
+	dial := func(data map[string]interface{}) (*websocket.Conn, Message) {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		require.NoError(t, err)
+		data["token"] = token
+		require.NoError(t, conn.WriteJSON(Message{Type: MessageTypeJoin, Data: data}))
+		var reply Message
+		require.NoError(t, conn.ReadJSON(&reply))
+		return conn, reply
+	}
+
+	conn, ack := dial(map[string]interface{}{})
+	require.Equal(t, MessageTypeJoin, ack.Type)
+	require.Equal(t, uint64(1), ack.Seq)
+	resumeToken, _ := ack.Data.(map[string]interface{})["resume_token"].(string)
+	require.NotEmpty(t, resumeToken)
+	hostID, _ := ack.Data.(map[string]interface{})["participant_id"].(string)
+
+	// Drop the connection without a close handshake
+	conn.UnderlyingConn().Close()
+	host := room.GetParticipant(hostID)
+	require.NotNil(t, host)
+	require.Eventually(t, func() bool { return host.session.expired(time.Now().Add(time.Hour)) }, time.Second, 10*time.Millisecond)
+	assert.Same(t, host, room.GetParticipant(hostID), "the participant is kept")
+
+	room.BroadcastToAll(&Message{Type: MessageTypeLockRoom, Data: LockRoomData{Locked: true}}, "")
+
+	_, reply := dial(map[string]interface{}{"resume_token": "guess", "last_seq": 1})
+	assert.Equal(t, MessageTypeError, reply.Type)
+
+	conn, ack = dial(map[string]interface{}{"resume_token": resumeToken, "last_seq": 1})
+	defer conn.Close()
+	require.Equal(t, MessageTypeJoin, ack.Type)
+	assert.Equal(t, true, ack.Data.(map[string]interface{})["resumed"])
+
+	// Missed messages follow in order
+	var missed Message
+	require.NoError(t, conn.ReadJSON(&missed))
+	assert.Equal(t, MessageTypeTracks, missed.Type)
+	assert.Equal(t, uint64(2), missed.Seq)
+	require.NoError(t, conn.ReadJSON(&missed))
+	assert.Equal(t, MessageTypeLockRoom, missed.Type)
+	assert.Equal(t, uint64(3), missed.Seq)
+
+	// Closing cleanly ends the session at once
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	require.Eventually(t, func() bool { return !room.GetStats().HasHost }, time.Second, 10*time.Millisecond)
+}
+
+func TestReconnectWindowExpires(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	require.NoError(t, err)
+
+	conn := acceptingConn()
+	session, err := newSession(conn)
+	require.NoError(t, err)
+	participant := &Participant{ID: "host1", Conn: session, Role: RoleHost, session: session}
+	require.NoError(t, server.joinRoom(room.Slug, participant))
+
+	server.connectionLost(room.Slug, participant, conn, io.ErrUnexpectedEOF)
+	live := server.rooms[room.Slug]
+	require.NotNil(t, live)
+	assert.Same(t, participant, live.GetParticipant(participant.ID))
+
+	server.expireRooms(time.Now().Add(server.config.ReconnectWindow / 2))
+	assert.NotNil(t, live.GetParticipant(participant.ID))
+
+	server.expireRooms(time.Now().Add(server.config.ReconnectWindow))
+	assert.Nil(t, live.GetParticipant(participant.ID))
+	assert.Equal(t, webrtc.PeerConnectionStateClosed, participant.PC.ConnectionState())
+	assert.NotContains(t, server.rooms, room.Slug)
+}
+
+func TestResumeSessionOutsideServerLock(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	require.NoError(t, err)
+
+	conn := acceptingConn()
+	session, err := newSession(conn)
+	require.NoError(t, err)
+	participant := &Participant{ID: "host1", Conn: session, Role: RoleHost, session: session, tokenID: "host-token"}
+	require.NoError(t, server.joinRoom(room.Slug, participant))
+	server.connectionLost(room.Slug, participant, conn, io.ErrUnexpectedEOF)
+
+	_, err = server.resumeSession(room.Slug, session.token, "other-token", 0, acceptingConn())
+	assert.ErrorIs(t, err, ErrResumeFailed)
+
+	unlocked := true
+	resumed := &MockWebSocketConn{}
+	resumed.On("WriteJSON", mock.Anything).Run(func(mock.Arguments) {
+		if server.mutex.TryLock() {
+			server.mutex.Unlock()
+		} else {
+			unlocked = false
+		}
+	}).Return(nil)
+	resumed.On("Close").Return(nil)
+
+	got, err := server.resumeSession(room.Slug, session.token, "host-token", 0, resumed)
+	require.NoError(t, err)
+	assert.Same(t, participant, got)
+	assert.True(t, unlocked, "missed messages are replayed without holding the server lock")
+	resumed.AssertCalled(t, "WriteJSON", mock.Anything)
+}
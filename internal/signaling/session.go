@@ -0,0 +1,203 @@
+package signaling
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// replayLimit bounds the messages kept for a client to resume from
+const replayLimit = 256
+
+// errSessionDetached is returned by reads while no connection is attached
+var errSessionDetached = errors.New("session has no connection")
+
+// session carries a participant's signaling across WebSocket reconnects. It
+// numbers every message it sends and keeps the latest ones, so that a client
+// resuming after a dropped connection gets the messages it missed.
+type session struct {
+	token string
+
+	mutex sync.Mutex
+	// conn is nil while the session waits for the client to resume
+	conn   WebSocketConnInterface
+	closed bool
+	// resumeBy is when a detached session is given up
+	resumeBy time.Time
+	seq      uint64
+	sent     []sentMessage
+}
+
+// sentMessage is a numbered message, encoded when it was sent so that
+// replaying it does not read room state again
+type sentMessage struct {
+	seq  uint64
+	data json.RawMessage
+}
+
+func newSession(conn WebSocketConnInterface) (*session, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate resume token: %w", err)
+	}
+	return &session{token: hex.EncodeToString(token), conn: conn}, nil
+}
+
+// matches compares a resume token in constant time
+func (s *session) matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(s.token), []byte(token)) == 1
+}
+
+// WriteJSON numbers and keeps signaling messages before sending them. While
+// detached they are only kept.
+func (s *session) WriteJSON(v interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return net.ErrClosed
+	}
+
+	if message, ok := v.(*Message); ok {
+		numbered := *message
+		numbered.Seq = s.seq + 1
+		data, err := json.Marshal(&numbered)
+		if err != nil {
+			return err
+		}
+		s.seq++
+		s.sent = append(s.sent, sentMessage{seq: s.seq, data: data})
+		if len(s.sent) > replayLimit {
+			s.sent = slices.Delete(s.sent, 0, len(s.sent)-replayLimit)
+		}
+		v = json.RawMessage(data)
+	}
+
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.WriteJSON(v)
+}
+
+func (s *session) WriteMessage(messageType int, data []byte) error {
+	conn, err := s.current()
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(messageType, data)
+}
+
+func (s *session) ReadJSON(v interface{}) error {
+	conn, err := s.current()
+	if err != nil {
+		return err
+	}
+	return conn.ReadJSON(v)
+}
+
+func (s *session) ReadMessage() (int, []byte, error) {
+	conn, err := s.current()
+	if err != nil {
+		return 0, nil, err
+	}
+	return conn.ReadMessage()
+}
+
+// Close ends the session for good; it cannot be resumed afterwards
+func (s *session) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *session) current() (WebSocketConnInterface, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	if s.conn == nil {
+		return nil, errSessionDetached
+	}
+	return s.conn, nil
+}
+
+// supersedes reports whether the session moved on from conn to another
+// connection, or to none while waiting to be resumed
+func (s *session) supersedes(conn WebSocketConnInterface) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return !s.closed && s.conn != conn
+}
+
+// detach keeps the session without a connection until resumeBy. It fails
+// once the session is closed or has moved on to another connection.
+func (s *session) detach(conn WebSocketConnInterface, resumeBy time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.conn != conn {
+		return false
+	}
+	s.conn = nil
+	s.resumeBy = resumeBy
+	return true
+}
+
+// expired reports whether a detached session was not resumed in time
+func (s *session) expired(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return !s.closed && s.conn == nil && !now.Before(s.resumeBy)
+}
+
+// resume attaches conn in place of the current connection, if any, which it
+// returns for the caller to close. The client gets ack, then every message
+// after lastSeq; resuming fails when some of them are no longer kept.
+func (s *session) resume(conn WebSocketConnInterface, lastSeq uint64, ack *Message) (WebSocketConnInterface, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, ErrResumeFailed
+	}
+	if lastSeq > s.seq || (lastSeq < s.seq && (len(s.sent) == 0 || s.sent[0].seq > lastSeq+1)) {
+		return nil, fmt.Errorf("%w: cannot replay from message %d", ErrResumeFailed, lastSeq)
+	}
+
+	previous := s.conn
+	s.conn = conn
+	s.resumeBy = time.Time{}
+
+	// Closing conn after a failed write, e.g. past its deadline, fails the
+	// next read on it, which detaches the session again
+	if err := conn.WriteJSON(ack); err != nil {
+		conn.Close()
+		return previous, nil
+	}
+	for _, message := range s.sent {
+		if message.seq <= lastSeq {
+			continue
+		}
+		if err := conn.WriteJSON(message.data); err != nil {
+			conn.Close()
+			break
+		}
+	}
+	return previous, nil
+}
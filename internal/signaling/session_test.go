@@ -0,0 +1,118 @@
+package signaling
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// sentMessages decodes what a session wrote to conn
+func sentMessages(t *testing.T, conn *MockWebSocketConn) []Message {
+	var messages []Message
+	for _, call := range conn.Calls {
+		if call.Method != "WriteJSON" {
+			continue
+		}
+		data, err := json.Marshal(call.Arguments.Get(0))
+		require.NoError(t, err)
+		var message Message
+		require.NoError(t, json.Unmarshal(data, &message))
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func acceptingConn() *MockWebSocketConn {
+	conn := &MockWebSocketConn{}
+	conn.On("WriteJSON", mock.Anything).Return(nil)
+	conn.On("Close").Return(nil)
+	return conn
+}
+
+func TestSessionResume(t *testing.T) {
+	first := acceptingConn()
+	session, err := newSession(first)
+	require.NoError(t, err)
+	assert.Len(t, session.token, 64)
+	assert.True(t, session.matches(session.token))
+	assert.False(t, session.matches("guess"))
+
+	require.NoError(t, session.WriteJSON(&Message{Type: MessageTypeTracks}))
+	require.NoError(t, session.WriteJSON(&Message{Type: MessageTypeParticipants}))
+	sent := sentMessages(t, first)
+	require.Len(t, sent, 2)
+	assert.Equal(t, uint64(1), sent[0].Seq)
+	assert.Equal(t, uint64(2), sent[1].Seq)
+
+	// Messages sent while detached are kept for the client
+	require.True(t, session.detach(first, time.Now().Add(time.Minute)))
+	assert.True(t, session.supersedes(first))
+	require.NoError(t, session.WriteJSON(&Message{Type: MessageTypeLeave}))
+	assert.False(t, session.expired(time.Now()))
+	assert.True(t, session.expired(time.Now().Add(time.Minute)))
+
+	// The client saw the first message only
+	second := acceptingConn()
+	previous, err := session.resume(second, 1, &Message{Type: MessageTypeJoin})
+	require.NoError(t, err)
+	assert.Nil(t, previous)
+	resumed := sentMessages(t, second)
+	require.Len(t, resumed, 3)
+	assert.Equal(t, MessageTypeJoin, resumed[0].Type)
+	assert.Zero(t, resumed[0].Seq)
+	assert.Equal(t, MessageTypeParticipants, resumed[1].Type)
+	assert.Equal(t, uint64(2), resumed[1].Seq)
+	assert.Equal(t, MessageTypeLeave, resumed[2].Type)
+	assert.Equal(t, uint64(3), resumed[2].Seq)
+
+	// Resuming over a live connection hands it back to be closed
+	third := acceptingConn()
+	previous, err = session.resume(third, 3, &Message{Type: MessageTypeJoin})
+	require.NoError(t, err)
+	assert.Same(t, second, previous)
+	assert.False(t, session.detach(second, time.Now()), "an old connection cannot detach the session")
+
+	require.NoError(t, session.Close())
+	third.AssertCalled(t, "Close")
+	_, err = session.resume(acceptingConn(), 3, &Message{Type: MessageTypeJoin})
+	assert.ErrorIs(t, err, ErrResumeFailed)
+}
+
+func TestSessionResumeGap(t *testing.T) {
+	session, err := newSession(acceptingConn())
+	require.NoError(t, err)
+	for i := 0; i < replayLimit+10; i++ {
+		require.NoError(t, session.WriteJSON(&Message{Type: MessageTypeTracks}))
+	}
+
+	_, err = session.resume(acceptingConn(), 5, &Message{Type: MessageTypeJoin})
+	assert.ErrorIs(t, err, ErrResumeFailed)
+	_, err = session.resume(acceptingConn(), replayLimit+11, &Message{Type: MessageTypeJoin})
+	assert.ErrorIs(t, err, ErrResumeFailed)
+
+	conn := acceptingConn()
+	_, err = session.resume(conn, 10, &Message{Type: MessageTypeJoin})
+	require.NoError(t, err)
+	assert.Len(t, sentMessages(t, conn), replayLimit+1)
+}
+
+func TestSessionResumeStalled(t *testing.T) {
+	session, err := newSession(acceptingConn())
+	require.NoError(t, err)
+	require.NoError(t, session.WriteJSON(&Message{Type: MessageTypeTracks}))
+
+	// A client that stops reading runs the replay past its write deadline
+	stalled := &MockWebSocketConn{}
+	stalled.On("WriteJSON", mock.Anything).Return(os.ErrDeadlineExceeded)
+	stalled.On("Close").Return(nil)
+	_, err = session.resume(stalled, 0, &Message{Type: MessageTypeJoin})
+	require.NoError(t, err)
+	stalled.AssertCalled(t, "Close")
+	stalled.AssertNumberOfCalls(t, "WriteJSON", 1)
+	assert.True(t, session.detach(stalled, time.Now().Add(time.Minute)), "the read loop ending detaches the session")
+}
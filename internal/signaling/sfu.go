@@ -1,6 +1,7 @@
 package signaling
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,18 +12,18 @@ import (
 
 func (s *Server) initSFU(room *Room, participant *Participant) error {
 	// Create PeerConnection
-	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	pc, estimator, err := s.config.API.NewPeerConnectionWithEstimator(webrtc.Configuration{
+		ICEServers: participant.ICEServers,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create peer connection: %w", err)
 	}
+	if estimator != nil {
+		estimator.OnTargetBitrateChange(participant.onBandwidthEstimate)
+	}
 
 	participant.PC = pc
+	participant.negotiator = s.newParticipantNegotiator(room, participant)
 
 	// Handle ICE candidates
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
@@ -39,25 +40,89 @@ func (s *Server) initSFU(room *Room, participant *Participant) error {
 		})
 	})
 
+	// The ICE handler runs on pion's agent; renegotiating there could
+	// deadlock, so the negotiator restarts ICE on its own
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateDisconnected || state == webrtc.ICEConnectionStateFailed {
+			log.Printf("ICE connection of %s is %s", participant.ID, state)
+		}
+		participant.negotiator.ICEStateChanged(state)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		s.reportConnectionState(room, participant, state)
+	})
+
 	// Handle incoming tracks
 	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("Track received from %s: %s %s", participant.ID, remoteTrack.ID(), remoteTrack.Kind())
+		rid := remoteTrack.RID()
+		log.Printf("Track received from %s: %s %s %s", participant.ID, remoteTrack.ID(), remoteTrack.Kind(), rid)
 
-		// Create a local track to forward to other participants
-		localTrack, err := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, remoteTrack.ID(), remoteTrack.StreamID())
-		if err != nil {
-			log.Printf("Failed to create local track: %v", err)
+		if !participant.Profile.publishes(remoteTrack.Kind()) {
+			log.Printf("Rejected %s track from %s: media profile %s", remoteTrack.Kind(), participant.ID, participant.Profile)
+			if err := receiver.Stop(); err != nil {
+				log.Printf("Failed to stop rejected track: %v", err)
+			}
+			sendError(participant.Conn, "PUBLISH_NOT_ALLOWED", fmt.Sprintf("Media profile %s cannot publish %s", participant.Profile, remoteTrack.Kind()))
 			return
 		}
 
-		participant.Tracks = append(participant.Tracks, localTrack)
-		room.Tracks = append(room.Tracks, localTrack)
+		var keyframes *keyframeRequester
+		var nacks *nackGenerator
+		var audioLevelID uint8
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
+			audioLevelID = audioLevelExtensionID(receiver)
+		}
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+			keyframes = newKeyframeRequester(pc, uint32(remoteTrack.SSRC()), s.config.KeyframeRequestInterval)
+			if s.config.NACKBufferSize > 0 {
+				nacks = newNACKGenerator(pc, uint32(remoteTrack.SSRC()))
+			}
+		}
+
+		// The participant may be leaving already; its tracks must not
+		// outlive the teardown
+		participant.mediaMutex.Lock()
+		if participant.mediaClosed {
+			participant.mediaMutex.Unlock()
+			return
+		}
+		// Simulcast layers arrive as separate remote tracks sharing an ID
+		var track *PublishedTrack
+		if rid != "" {
+			track = participant.publishedTrack(remoteTrack.ID())
+		}
+		isNew := track == nil
+		if isNew {
+			track = newPublishedTrack(participant.ID, remoteTrack, s.config.NACKBufferSize)
+			track.muted = participant.muted[track.Kind]
+			if source, ok := participant.announcedSources[track.ID]; ok {
+				track.source = source
+				delete(participant.announcedSources, track.ID)
+			}
+			// Registered while mediaMutex is held, so a concurrent
+			// teardown always finds the track in the room
+			if err := room.AddTrack(track); err != nil {
+				participant.mediaMutex.Unlock()
+				log.Printf("Rejected %s track from %s: %v", track.Source(), participant.ID, err)
+				if err := receiver.Stop(); err != nil {
+					log.Printf("Failed to stop rejected track: %v", err)
+				}
+				sendError(participant.Conn, screenShareErrorCode(err), err.Error())
+				return
+			}
+			participant.Tracks = append(participant.Tracks, track)
+		}
+		participant.forwarders.Add(1)
+		participant.mediaMutex.Unlock()
+
+		layer := track.addLayer(rid, keyframes, nacks)
 
-		// Forward media packets
+		// Forward media packets until the PeerConnection is closed
 		go func() {
-			rtpBuf := make([]byte, 1400)
+			defer participant.forwarders.Done()
+
 			for {
-				i, _, err := remoteTrack.Read(rtpBuf)
+				packet, _, err := remoteTrack.ReadRTP()
 				if err != nil {
 					if err != io.EOF {
 						log.Printf("Failed to read from remote track: %v", err)
@@ -65,83 +130,373 @@ func (s *Server) initSFU(room *Room, participant *Participant) error {
 					return
 				}
 
-				if _, err = localTrack.Write(rtpBuf[:i]); err != nil {
-					if err != io.ErrClosedPipe {
-						log.Printf("Failed to write to local track: %v", err)
+				if audioLevelID != 0 && !track.Muted() {
+					if level, ok := audioLevel(packet, audioLevelID); ok {
+						room.recordAudioLevel(participant.ID, level, time.Now())
 					}
-					return
 				}
+				track.forward(layer, packet)
 			}
 		}()
 
+		if !isNew {
+			return
+		}
+
 		// Add this new track to all OTHER participants
-		s.addTrackToParticipants(room, participant.ID, localTrack)
+		s.addTrackToParticipants(room, participant.ID, track)
+		s.broadcastTracks(room)
 	})
 
-	// Add existing tracks from other participants to this new participant
-	for _, otherParticipant := range room.Guests {
-		if otherParticipant.ID == participant.ID {
+	return nil
+}
+
+// subscribeToRoom forwards the tracks already published in the room to a
+// participant that was just admitted. They are offered by the server once the
+// client's first offer is answered. Knocking guests get nothing until the
+// host lets them in.
+func (s *Server) subscribeToRoom(room *Room, participant *Participant) {
+	if participant.negotiator == nil || !room.IsAdmitted(participant) {
+		return
+	}
+
+	added := false
+	for _, other := range room.GetAllParticipants() {
+		if other.ID == participant.ID {
 			continue
 		}
-		for _, track := range otherParticipant.Tracks {
-			if _, err := pc.AddTrack(track); err != nil {
-				log.Printf("Failed to add track to new participant: %v", err)
+		for _, track := range other.PublishedTracks() {
+			ok, err := participant.addForwardedTrack(room, track)
+			if err != nil {
+				log.Printf("Failed to add track of %s to new participant: %v", other.ID, err)
+				continue
 			}
+			added = added || ok
 		}
 	}
-	if room.Host != nil && room.Host.ID != participant.ID {
-		for _, track := range room.Host.Tracks {
-			if _, err := pc.AddTrack(track); err != nil {
-				log.Printf("Failed to add host track to new participant: %v", err)
-			}
-		}
+	if added {
+		participant.negotiator.Negotiate()
 	}
+}
 
-	return nil
+// reportConnectionState tells the room how a participant's media connection
+// is doing. Closing is left to the leave message.
+func (s *Server) reportConnectionState(room *Room, participant *Participant, state webrtc.PeerConnectionState) {
+	if state == webrtc.PeerConnectionStateNew || state == webrtc.PeerConnectionStateClosed {
+		return
+	}
+
+	room.BroadcastToAll(&Message{
+		Type:   MessageTypeConnectionState,
+		From:   participant.ID,
+		RoomID: room.Slug,
+		Data: ConnectionStateData{
+			ParticipantID: participant.ID,
+			State:         state.String(),
+		},
+		Timestamp: time.Now(),
+	}, "")
 }
 
-func (s *Server) addTrackToParticipants(room *Room, sourceID string, track *webrtc.TrackLocalStaticRTP) {
-	// Helper to add track to a participant
-	add := func(p *Participant) {
-		if p.ID == sourceID || p.PC == nil {
-			return
+// addSendTrack adds a forwarded track on its own send-only transceiver, so it
+// is never paired with one of the client's m-lines while answering its offer
+func addSendTrack(pc *webrtc.PeerConnection, track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	transceiver, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transceiver.Sender(), nil
+}
+
+// newParticipantNegotiator returns the negotiator for a participant's
+// PeerConnection; offers and answers are sent over its WebSocket
+func (s *Server) newParticipantNegotiator(room *Room, participant *Participant) *negotiator {
+	n := newNegotiator(participant.PC, func(desc webrtc.SessionDescription) error {
+		messageType := MessageTypeOffer
+		if desc.Type == webrtc.SDPTypeAnswer {
+			messageType = MessageTypeAnswer
+		}
+		return participant.Conn.WriteJSON(&Message{
+			Type:      messageType,
+			RoomID:    room.Slug,
+			Data:      map[string]interface{}{"sdp": desc.SDP, "type": desc.Type.String()},
+			Timestamp: time.Now(),
+		})
+	})
+	// Tracks subscribed to since the last exchange are live now; ask their
+	// publishers for a keyframe so the new subscriber does not stay frozen
+	n.onNegotiated = participant.requestPendingKeyframes
+	return n
+}
+
+func (s *Server) addTrackToParticipants(room *Room, sourceID string, track *PublishedTrack) {
+	for _, p := range room.GetAllParticipants() {
+		if p.ID == sourceID || p.PC == nil || p.negotiator == nil || !room.IsAdmitted(p) {
+			continue
 		}
 
-		if _, err := p.PC.AddTrack(track); err != nil {
+		added, err := p.addForwardedTrack(room, track)
+		if err != nil {
 			log.Printf("Failed to add track to participant %s: %v", p.ID, err)
-			return
+			continue
+		}
+		if !added {
+			continue
 		}
 
-		// Renegotiate?
-		// In a simple SFU, we might need to trigger a new Offer from the server side,
-		// or just let the client handle "negotiationneeded".
-		// For MVP, let's assume the client handles onnegotiationneeded or we send an offer.
-		// But Pion doesn't automatically trigger negotiation.
-		// We should create an Offer and send it to the participant.
+		// Queued behind any exchange in flight; several tracks arriving
+		// together end up in one offer
+		p.negotiator.Negotiate()
+	}
+}
 
-		offer, err := p.PC.CreateOffer(nil)
-		if err != nil {
-			log.Printf("Failed to create offer for renegotiation: %v", err)
-			return
+// teardownMedia releases everything a leaving participant published: its
+// PeerConnection and forwarding goroutines, its tracks in the room and the
+// down tracks forwarding them to everyone else, who are renegotiated and told
+// about each removed track.
+func (s *Server) teardownMedia(room *Room, participant *Participant) {
+	tracks := participant.closeMedia()
+	if len(tracks) == 0 {
+		return
+	}
+
+	room.RemoveTracks(tracks)
+
+	for _, p := range room.GetAllParticipants() {
+		if p.ID == participant.ID {
+			continue
 		}
 
-		if err := p.PC.SetLocalDescription(offer); err != nil {
-			log.Printf("Failed to set local description: %v", err)
-			return
+		removed := p.removeForwardedTracks(tracks)
+		if len(removed) == 0 {
+			continue
+		}
+		if p.negotiator != nil {
+			p.negotiator.Negotiate()
 		}
 
-		p.Conn.WriteJSON(&Message{
-			Type:      MessageTypeOffer,
-			RoomID:    room.Slug,
-			Data:      map[string]interface{}{"sdp": offer.SDP, "type": offer.Type.String()},
-			Timestamp: time.Now(),
-		})
+		for _, track := range removed {
+			p.Conn.WriteJSON(&Message{
+				Type:   MessageTypeTrackRemoved,
+				From:   participant.ID,
+				RoomID: room.Slug,
+				Data: TrackRemovedData{
+					ParticipantID: participant.ID,
+					TrackID:       track.ID,
+					StreamID:      track.StreamID,
+					Kind:          track.Kind.String(),
+				},
+				Timestamp: time.Now(),
+			})
+		}
+	}
+
+	s.broadcastTracks(room)
+}
+
+// broadcastTracks sends the list of published tracks to everyone in the
+// room after it changed
+func (s *Server) broadcastTracks(room *Room) {
+	room.BroadcastToAll(&Message{
+		Type:      MessageTypeTracks,
+		RoomID:    room.Slug,
+		Data:      room.TracksData(),
+		Timestamp: time.Now(),
+	}, "")
+}
+
+// screenShareErrorCode maps a screen share policy violation to its error code
+func screenShareErrorCode(err error) string {
+	if errors.Is(err, ErrScreenShareLimit) {
+		return "SCREEN_SHARE_LIMIT"
+	}
+	return "SCREEN_SHARE_NOT_ALLOWED"
+}
+
+// PublishedTracks returns a snapshot of the tracks this participant sends
+func (p *Participant) PublishedTracks() []*PublishedTrack {
+	p.mediaMutex.Lock()
+	defer p.mediaMutex.Unlock()
+
+	return append([]*PublishedTrack(nil), p.Tracks...)
+}
+
+// publishedTrack returns the track p publishes with the given ID, or nil.
+// The caller holds mediaMutex.
+func (p *Participant) publishedTrack(id string) *PublishedTrack {
+	for _, track := range p.Tracks {
+		if track.ID == id {
+			return track
+		}
+	}
+	return nil
+}
+
+// Subscription returns the down track forwarding a published track to p, or
+// nil if p does not receive it
+func (p *Participant) Subscription(track *PublishedTrack) *DownTrack {
+	p.mediaMutex.Lock()
+	defer p.mediaMutex.Unlock()
+
+	return p.subscriptions[track]
+}
+
+// setMuted stops or restarts forwarding p's tracks of a kind, including
+// tracks published later, and reports whether any published track changed
+func (p *Participant) setMuted(kind webrtc.RTPCodecType, muted bool) bool {
+	p.mediaMutex.Lock()
+	defer p.mediaMutex.Unlock()
+
+	if p.muted == nil {
+		p.muted = make(map[webrtc.RTPCodecType]bool)
+	}
+	p.muted[kind] = muted
+
+	changed := false
+	for _, track := range p.Tracks {
+		if track.Kind == kind && track.setMuted(muted) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// subscriptionKey identifies a track in p's subscription preferences
+func subscriptionKey(participantID, trackID string) string {
+	return participantID + "/" + trackID
+}
+
+// setSubscribed records whether p wants a track, overriding automatic
+// subscription for it
+func (p *Participant) setSubscribed(track *PublishedTrack, subscribed bool) {
+	p.mediaMutex.Lock()
+	defer p.mediaMutex.Unlock()
+
+	if p.subscribed == nil {
+		p.subscribed = make(map[string]bool)
+	}
+	p.subscribed[subscriptionKey(track.ParticipantID, track.ID)] = subscribed
+}
+
+// wantsTrack reports whether p should receive a track: p has to be admitted
+// to the room and its media profile has to allow it, then an explicit
+// subscribe or unsubscribe decides, and otherwise automatic subscription.
+// The caller holds mediaMutex.
+func (p *Participant) wantsTrack(room *Room, track *PublishedTrack) bool {
+	if !room.IsAdmitted(p) || !p.Profile.receives(track.Kind) {
+		return false
+	}
+	if subscribed, ok := p.subscribed[subscriptionKey(track.ParticipantID, track.ID)]; ok {
+		return subscribed
+	}
+	return !p.manualSubscribe
+}
+
+// addForwardedTrack starts sending another participant's track to p through
+// a down track of its own, if p wants it and does not receive it yet.
+// Keyframe requests for it are relayed to the publisher and bandwidth
+// estimates drive its simulcast layer.
+func (p *Participant) addForwardedTrack(room *Room, track *PublishedTrack) (bool, error) {
+	p.mediaMutex.Lock()
+	defer p.mediaMutex.Unlock()
+
+	if p.mediaClosed {
+		return false, fmt.Errorf("participant %s is leaving", p.ID)
+	}
+	if _, ok := p.subscriptions[track]; ok || !p.wantsTrack(room, track) {
+		return false, nil
+	}
+
+	downTrack := track.NewDownTrack(p.ID)
+	sender, err := addSendTrack(p.PC, downTrack)
+	if err != nil {
+		track.RemoveDownTrack(p.ID)
+		return false, err
+	}
+	downTrack.sender = sender
+
+	if p.subscriptions == nil {
+		p.subscriptions = make(map[*PublishedTrack]*DownTrack)
+	}
+	p.subscriptions[track] = downTrack
+	if track.Kind == webrtc.RTPCodecTypeVideo {
+		p.pendingKeyframes = append(p.pendingKeyframes, downTrack)
+	}
+
+	p.forwarders.Add(1)
+	go func() {
+		defer p.forwarders.Done()
+		readSenderRTCP(sender, downTrack)
+	}()
+
+	return true, nil
+}
+
+// requestPendingKeyframes asks for a keyframe on every video track p has
+// subscribed to since the last completed negotiation
+func (p *Participant) requestPendingKeyframes() {
+	p.mediaMutex.Lock()
+	pending := p.pendingKeyframes
+	p.pendingKeyframes = nil
+	p.mediaMutex.Unlock()
+
+	for _, downTrack := range pending {
+		downTrack.RequestKeyframe()
 	}
+}
+
+// removeForwardedTracks stops sending the given tracks to p and returns the
+// ones it was actually receiving
+func (p *Participant) removeForwardedTracks(tracks []*PublishedTrack) []*PublishedTrack {
+	p.mediaMutex.Lock()
+	defer p.mediaMutex.Unlock()
 
-	if room.Host != nil {
-		add(room.Host)
+	var removed []*PublishedTrack
+	for _, track := range tracks {
+		downTrack, ok := p.subscriptions[track]
+		if !ok {
+			continue
+		}
+		delete(p.subscriptions, track)
+		track.RemoveDownTrack(p.ID)
+
+		if !p.mediaClosed {
+			if err := p.PC.RemoveTrack(downTrack.sender); err != nil {
+				log.Printf("Failed to remove track %s from participant %s: %v", track.ID, p.ID, err)
+			}
+		}
+		removed = append(removed, track)
+	}
+	return removed
+}
+
+// closeMedia closes the PeerConnection, detaches p from the tracks it was
+// receiving, waits for the forwarding goroutines to exit and returns the
+// tracks the participant had published. It is safe to call more than once.
+func (p *Participant) closeMedia() []*PublishedTrack {
+	p.mediaMutex.Lock()
+	if p.mediaClosed {
+		p.mediaMutex.Unlock()
+		return nil
 	}
-	for _, guest := range room.Guests {
-		add(guest)
+	p.mediaClosed = true
+	tracks := p.Tracks
+	p.Tracks = nil
+	for track := range p.subscriptions {
+		track.RemoveDownTrack(p.ID)
 	}
+	p.subscriptions = nil
+	p.pendingKeyframes = nil
+	p.mediaMutex.Unlock()
+
+	if p.PC != nil {
+		if err := p.PC.Close(); err != nil {
+			log.Printf("Failed to close peer connection for %s: %v", p.ID, err)
+		}
+	}
+	p.forwarders.Wait()
+
+	return tracks
 }
@@ -2,12 +2,17 @@ package signaling
 
 import (
 	"testing"
+	"time"
 
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
 func TestInitSFU(t *testing.T) {
-	server := NewServer()
+	server := newTestServer(t)
+	defer server.Shutdown()
 	room := NewRoom("test-room")
 	participant := &Participant{ID: "user1"}
 
@@ -25,3 +30,213 @@ func TestInitSFU(t *testing.T) {
 		participant.PC.Close()
 	}
 }
+
+func TestTeardownMediaRemovesForwardedTracks(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+
+	hostConn := &MockWebSocketConn{}
+	guestConn := &MockWebSocketConn{}
+	guestConn.On("WriteJSON", mock.Anything).Return(nil)
+
+	host := &Participant{ID: "host1", Role: RoleHost, Conn: hostConn}
+	guest := &Participant{ID: "guest1", Role: RoleGuest, Conn: guestConn}
+	require.NoError(t, room.AddParticipant(host))
+	require.NoError(t, room.AddParticipant(guest))
+	require.NoError(t, room.AllowGuest(guest.ID))
+	require.NoError(t, server.initSFU(room, host))
+	require.NoError(t, server.initSFU(room, guest))
+	defer guest.closeMedia()
+
+	// Simulate the host publishing a track
+	track := newTestPublishedTrack(host.ID, "video", webrtc.RTPCodecTypeVideo, nil)
+	host.Tracks = append(host.Tracks, track)
+	room.AddTrack(track)
+	server.addTrackToParticipants(room, host.ID, track)
+
+	downTrack := guest.Subscription(track)
+	require.NotNil(t, downTrack)
+	assert.Same(t, downTrack, track.DownTrack(guest.ID))
+	sender := downTrack.sender
+	require.NotNil(t, sender)
+
+	room.RemoveParticipant(host.ID)
+	server.teardownMedia(room, host)
+
+	assert.Equal(t, webrtc.PeerConnectionStateClosed, host.PC.ConnectionState())
+	assert.Empty(t, host.Tracks)
+	assert.Empty(t, room.Tracks)
+	assert.Empty(t, guest.subscriptions)
+	assert.Nil(t, track.DownTrack(guest.ID))
+	assert.Nil(t, sender.Track())
+
+	guestConn.AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(TrackRemovedData)
+		return msg.Type == MessageTypeTrackRemoved && ok &&
+			data.ParticipantID == "host1" && data.TrackID == "video" && data.StreamID == "host1-stream" && data.Kind == "video"
+	}))
+
+	// A second teardown is a no-op
+	server.teardownMedia(room, host)
+}
+
+func TestTeardownMediaWaitsForForwarders(t *testing.T) {
+	participant := &Participant{ID: "user1"}
+
+	participant.forwarders.Add(1)
+	released := make(chan struct{})
+	go func() {
+		<-released
+		participant.forwarders.Done()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		participant.closeMedia()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("closeMedia returned before forwarding stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(released)
+	<-done
+	assert.True(t, participant.mediaClosed)
+	_, err := participant.addForwardedTrack(NewRoom("test-room"), nil)
+	assert.Error(t, err)
+}
+
+func TestMediaProfile(t *testing.T) {
+	tests := []struct {
+		profile        string
+		valid          bool
+		publishesAudio bool
+		publishesVideo bool
+		receivesVideo  bool
+	}{
+		{"", true, true, true, true},
+		{"full", true, true, true, true},
+		{"audio_only", true, true, false, false},
+		{"receive_only", true, false, false, true},
+		{"video_only", false, false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			profile, ok := parseMediaProfile(tt.profile)
+			assert.Equal(t, tt.valid, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, tt.publishesAudio, profile.publishes(webrtc.RTPCodecTypeAudio))
+			assert.Equal(t, tt.publishesVideo, profile.publishes(webrtc.RTPCodecTypeVideo))
+			assert.True(t, profile.receives(webrtc.RTPCodecTypeAudio))
+			assert.Equal(t, tt.receivesVideo, profile.receives(webrtc.RTPCodecTypeVideo))
+		})
+	}
+}
+
+func TestAudioOnlyParticipantSkipsVideo(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+
+	host := &Participant{ID: "host1", Role: RoleHost, Conn: &MockWebSocketConn{}}
+	guest := &Participant{ID: "guest1", Role: RoleGuest, Conn: &MockWebSocketConn{}, Profile: MediaProfileAudioOnly}
+	require.NoError(t, room.AddParticipant(host))
+	require.NoError(t, room.AddParticipant(guest))
+	require.NoError(t, room.AllowGuest(guest.ID))
+	require.NoError(t, server.initSFU(room, host))
+	require.NoError(t, server.initSFU(room, guest))
+	defer host.closeMedia()
+	defer guest.closeMedia()
+
+	audio := newTestPublishedTrack(host.ID, "audio", webrtc.RTPCodecTypeAudio, nil)
+	video := newTestPublishedTrack(host.ID, "video", webrtc.RTPCodecTypeVideo, nil)
+	host.Tracks = append(host.Tracks, audio, video)
+	for _, track := range host.Tracks {
+		room.AddTrack(track)
+		server.addTrackToParticipants(room, host.ID, track)
+	}
+
+	assert.NotNil(t, guest.Subscription(audio))
+	assert.Nil(t, guest.Subscription(video))
+	assert.Nil(t, video.DownTrack(guest.ID))
+
+	// Tracks published before the participant joined are filtered the same
+	late := &Participant{ID: "guest2", Role: RoleGuest, Conn: &MockWebSocketConn{}, Profile: MediaProfileAudioOnly}
+	require.NoError(t, room.AddParticipant(late))
+	require.NoError(t, room.AllowGuest(late.ID))
+	require.NoError(t, server.initSFU(room, late))
+	defer late.closeMedia()
+	server.subscribeToRoom(room, late)
+
+	assert.NotNil(t, late.Subscription(audio))
+	assert.Nil(t, late.Subscription(video))
+}
+
+func TestKnockingGuestGetsNoMedia(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+
+	hostConn := &MockWebSocketConn{}
+	guestConn := &MockWebSocketConn{}
+	hostConn.On("WriteJSON", mock.Anything).Return(nil).Maybe()
+	guestConn.On("WriteJSON", mock.Anything).Return(nil).Maybe()
+
+	host := &Participant{ID: "host1", Role: RoleHost, Conn: hostConn}
+	guest := &Participant{ID: "guest1", Role: RoleGuest, Conn: guestConn}
+	require.NoError(t, room.AddParticipant(host))
+	require.NoError(t, room.AddParticipant(guest))
+	require.Equal(t, StatusKnocking, guest.Status)
+	require.NoError(t, server.initSFU(room, host))
+	require.NoError(t, server.initSFU(room, guest))
+	defer host.closeMedia()
+	defer guest.closeMedia()
+
+	early := newTestPublishedTrack(host.ID, "early", webrtc.RTPCodecTypeAudio, nil)
+	host.Tracks = append(host.Tracks, early)
+	room.AddTrack(early)
+	server.subscribeToRoom(room, guest)
+
+	late := newTestPublishedTrack(host.ID, "late", webrtc.RTPCodecTypeAudio, nil)
+	host.Tracks = append(host.Tracks, late)
+	room.AddTrack(late)
+	server.addTrackToParticipants(room, host.ID, late)
+
+	assert.Nil(t, early.DownTrack(guest.ID))
+	assert.Nil(t, late.DownTrack(guest.ID))
+	added, err := guest.addForwardedTrack(room, early)
+	require.NoError(t, err)
+	assert.False(t, added, "a knocking guest cannot subscribe")
+
+	// Letting the guest in forwards everything published so far
+	server.handleAllow(room, host, &Message{Type: MessageTypeAllow, Data: guest.ID})
+	assert.NotNil(t, early.DownTrack(guest.ID))
+	assert.NotNil(t, late.DownTrack(guest.ID))
+}
+
+func TestReportConnectionState(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room, host, guest := moderatedRoom(t)
+
+	isState := func(state string) interface{} {
+		return mock.MatchedBy(func(msg *Message) bool {
+			data, ok := msg.Data.(ConnectionStateData)
+			return msg.Type == MessageTypeConnectionState && ok && data.ParticipantID == guest.ID && data.State == state
+		})
+	}
+
+	server.reportConnectionState(room, guest, webrtc.PeerConnectionStateDisconnected)
+	host.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isState("disconnected"))
+	guest.Conn.(*MockWebSocketConn).AssertCalled(t, "WriteJSON", isState("disconnected"))
+
+	server.reportConnectionState(room, guest, webrtc.PeerConnectionStateClosed)
+	host.Conn.(*MockWebSocketConn).AssertNotCalled(t, "WriteJSON", isState("closed"))
+}
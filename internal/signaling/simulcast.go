@@ -0,0 +1,263 @@
+package signaling
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Layer qualities a subscriber can ask for with set_layer
+const (
+	LayerAuto = "auto"
+	LayerLow  = "low"
+	LayerMid  = "mid"
+	LayerHigh = "high"
+)
+
+const (
+	// layerBitrateWindow is how often a layer's incoming bitrate is sampled
+	layerBitrateWindow = time.Second
+	// layerInactiveAfter marks a layer the publisher stopped sending, e.g.
+	// when the browser drops its top encoding under congestion
+	layerInactiveAfter = 2 * layerBitrateWindow
+)
+
+// simulcastLayer is one encoding of a published track. Tracks published
+// without simulcast have a single layer with an empty RID.
+type simulcastLayer struct {
+	rid string
+	// keyframes asks the publisher for a keyframe on this encoding; nil for
+	// audio
+	keyframes *keyframeRequester
+	// buffer keeps recent packets for retransmission and nacks requests
+	// the ones lost on the way from the publisher; both are nil for audio
+	buffer *packetBuffer
+	nacks  *nackGenerator
+
+	mutex       sync.Mutex
+	windowStart time.Time
+	windowBytes uint64
+	bitrate     uint64
+	lastPacket  time.Time
+}
+
+// record accounts a received packet towards the layer's bitrate
+func (l *simulcastLayer) record(size int, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	l.windowBytes += uint64(size)
+	l.lastPacket = now
+
+	if elapsed := now.Sub(l.windowStart); elapsed >= layerBitrateWindow {
+		l.bitrate = uint64(float64(l.windowBytes*8) / elapsed.Seconds())
+		l.windowBytes = 0
+		l.windowStart = now
+	}
+}
+
+// Bitrate returns the last sampled bitrate in bits per second, or 0 when the
+// layer has not been measured yet or stopped arriving
+func (l *simulcastLayer) Bitrate(now time.Time) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastPacket) > layerInactiveAfter {
+		return 0
+	}
+	return l.bitrate
+}
+
+// ridRank orders layers by their conventional RID before their bitrates are
+// known. Unknown RIDs rank in the middle.
+func ridRank(rid string) int {
+	switch strings.ToLower(rid) {
+	case "q", "l", "lo", "low", "0":
+		return 0
+	case "f", "hi", "high", "2":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// orderLayers sorts layers from the lowest to the highest quality. Layers
+// that are not being received are left out unless none is.
+func orderLayers(layers []*simulcastLayer, now time.Time) []*simulcastLayer {
+	type measured struct {
+		layer   *simulcastLayer
+		bitrate uint64
+	}
+
+	var active, all []measured
+	for _, layer := range layers {
+		m := measured{layer, layer.Bitrate(now)}
+		all = append(all, m)
+		if m.bitrate > 0 {
+			active = append(active, m)
+		}
+	}
+	if len(active) == 0 {
+		active = all
+	}
+
+	slices.SortStableFunc(active, func(a, b measured) int {
+		if c := cmp.Compare(a.bitrate, b.bitrate); c != 0 {
+			return c
+		}
+		return cmp.Compare(ridRank(a.layer.rid), ridRank(b.layer.rid))
+	})
+
+	ordered := make([]*simulcastLayer, len(active))
+	for i, m := range active {
+		ordered[i] = m.layer
+	}
+	return ordered
+}
+
+// pickLayer returns the layer matching a requested quality, or for
+// LayerAuto the best layer fitting the subscriber's bandwidth estimate. A
+// zero estimate means none is known yet and picks the highest layer.
+func pickLayer(layers []*simulcastLayer, quality string, estimate uint64, now time.Time) *simulcastLayer {
+	ordered := orderLayers(layers, now)
+	if len(ordered) == 0 {
+		return nil
+	}
+
+	switch quality {
+	case LayerLow:
+		return ordered[0]
+	case LayerMid:
+		return ordered[len(ordered)/2]
+	case LayerHigh:
+		return ordered[len(ordered)-1]
+	}
+
+	if estimate == 0 {
+		return ordered[len(ordered)-1]
+	}
+	best := ordered[0]
+	for _, layer := range ordered[1:] {
+		if layer.Bitrate(now) <= estimate {
+			best = layer
+		}
+	}
+	return best
+}
+
+func validLayerQuality(quality string) bool {
+	switch quality {
+	case LayerAuto, LayerLow, LayerMid, LayerHigh:
+		return true
+	}
+	return false
+}
+
+// isKeyframe reports whether an RTP payload starts a keyframe, which is the
+// only point a subscriber can be moved to another layer without corrupting
+// its decoder
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return isAV1Keyframe(payload)
+	}
+	return false
+}
+
+// isVP8Keyframe parses the VP8 payload descriptor (RFC 7741 section 4.2)
+// and checks the inverse key frame flag of the first partition
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// Only the start of partition 0 carries the frame header
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		extension := payload[1]
+		offset++
+		if extension&0x80 != 0 { // PictureID
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if extension&0x40 != 0 { // TL0PICIDX
+			offset++
+		}
+		if extension&0x30 != 0 { // TID/KEYIDX
+			offset++
+		}
+	}
+
+	return len(payload) > offset && payload[offset]&0x01 == 0
+}
+
+// isVP9Keyframe checks the VP9 payload descriptor for a non-inter-predicted
+// start of frame
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// P (inter-picture predicted) unset, B (start of frame) set
+	return payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+}
+
+// isH264Keyframe looks for an IDR slice or SPS in single NAL unit, STAP-A
+// and FU-A packets (RFC 6184)
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	isKey := func(nalType byte) bool { return nalType == 5 || nalType == 7 }
+
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if size == 0 || offset+size > len(payload) {
+				return false
+			}
+			if isKey(payload[offset] & 0x1F) {
+				return true
+			}
+			offset += size
+		}
+		return false
+	case 28: // FU-A
+		return len(payload) > 1 && payload[1]&0x80 != 0 && isKey(payload[1]&0x1F)
+	default:
+		return isKey(nalType)
+	}
+}
+
+// isAV1Keyframe checks the N flag of the AV1 aggregation header, which marks
+// the first packet of a new coded video sequence
+func isAV1Keyframe(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&0x08 != 0
+}
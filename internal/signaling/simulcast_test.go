@@ -0,0 +1,194 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{"vp8 key", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 inter", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 continuation", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 key with picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x85, 0x01, 0x00}, true},
+		{"vp8 inter with tl0picidx", webrtc.MimeTypeVP8, []byte{0x90, 0x40, 0x07, 0x01}, false},
+		{"vp9 key", webrtc.MimeTypeVP9, []byte{0x08}, true},
+		{"vp9 inter", webrtc.MimeTypeVP9, []byte{0x48}, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65}, true},
+		{"h264 non-idr", webrtc.MimeTypeH264, []byte{0x41}, false},
+		{"h264 stap-a sps", webrtc.MimeTypeH264, []byte{0x18, 0x00, 0x01, 0x67, 0x00, 0x01, 0x68}, true},
+		{"h264 fu-a idr start", webrtc.MimeTypeH264, []byte{0x7C, 0x85}, true},
+		{"h264 fu-a idr middle", webrtc.MimeTypeH264, []byte{0x7C, 0x05}, false},
+		{"opus", webrtc.MimeTypeOpus, []byte{0x10, 0x00}, false},
+		{"empty", webrtc.MimeTypeVP8, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isKeyframe(tt.mimeType, tt.payload))
+		})
+	}
+}
+
+func measuredLayer(rid string, bitrate uint64, now time.Time) *simulcastLayer {
+	return &simulcastLayer{rid: rid, bitrate: bitrate, lastPacket: now}
+}
+
+func TestPickLayer(t *testing.T) {
+	now := time.Now()
+	layers := []*simulcastLayer{
+		measuredLayer("f", 2_500_000, now),
+		measuredLayer("q", 150_000, now),
+		measuredLayer("h", 600_000, now),
+	}
+
+	assert.Equal(t, "q", pickLayer(layers, LayerLow, 0, now).rid)
+	assert.Equal(t, "h", pickLayer(layers, LayerMid, 0, now).rid)
+	assert.Equal(t, "f", pickLayer(layers, LayerHigh, 0, now).rid)
+
+	assert.Equal(t, "f", pickLayer(layers, LayerAuto, 0, now).rid, "no estimate yet")
+	assert.Equal(t, "h", pickLayer(layers, LayerAuto, 1_000_000, now).rid)
+	assert.Equal(t, "q", pickLayer(layers, LayerAuto, 50_000, now).rid, "lowest layer when nothing fits")
+
+	// The publisher stopped sending its top layer
+	layers[0].lastPacket = now.Add(-time.Minute)
+	assert.Equal(t, "h", pickLayer(layers, LayerHigh, 0, now).rid)
+
+	// Before any bitrate is known, the RIDs decide
+	unmeasured := []*simulcastLayer{{rid: "f"}, {rid: "q"}, {rid: "h"}}
+	assert.Equal(t, "q", pickLayer(unmeasured, LayerLow, 0, now).rid)
+	assert.Equal(t, "f", pickLayer(unmeasured, LayerHigh, 0, now).rid)
+
+	assert.Nil(t, pickLayer(nil, LayerAuto, 0, now))
+}
+
+func keyframePacket(seq uint16, ts uint32) *rtp.Packet {
+	packet := sourcePacket(seq, ts)
+	packet.Payload = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+	return packet
+}
+
+func TestDownTrackSwitchesLayersOnKeyframe(t *testing.T) {
+	now := time.Now()
+	lowKeyframes, lowSent := capturingRequester(1, 0)
+	highKeyframes, highSent := capturingRequester(2, 0)
+
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, nil)
+	track.layers = []*simulcastLayer{
+		{rid: "q", keyframes: lowKeyframes, bitrate: 150_000, lastPacket: now},
+		{rid: "f", keyframes: highKeyframes, bitrate: 2_500_000, lastPacket: now},
+	}
+	low, high := track.layers[0], track.layers[1]
+	downTrack, writer := boundDownTrack(t, track, "guest1", 1111)
+
+	// Without an estimate the subscriber starts on the top layer, once it
+	// sends a keyframe
+	assert.Len(t, *highSent, 1)
+	track.forward(low, keyframePacket(100, 1000))
+	track.forward(high, sourcePacket(5000, 90000))
+	assert.Empty(t, writer.headers)
+
+	track.forward(high, keyframePacket(5001, 93000))
+	track.forward(high, sourcePacket(5002, 96000))
+	require.Len(t, writer.headers, 2)
+	assert.Equal(t, "f", downTrack.Layer())
+
+	// Switching down waits for a keyframe on the low layer
+	require.NoError(t, downTrack.SetLayer(LayerLow))
+	assert.Len(t, *lowSent, 1)
+	track.forward(low, sourcePacket(101, 4000))
+	track.forward(high, sourcePacket(5003, 99000))
+	require.Len(t, writer.headers, 3)
+	assert.Equal(t, "f", downTrack.Layer())
+
+	track.forward(low, keyframePacket(102, 7000))
+	track.forward(high, sourcePacket(5004, 102000))
+	require.Len(t, writer.headers, 4)
+	assert.Equal(t, "q", downTrack.Layer())
+	assert.Equal(t, "q", downTrack.Stats().Layer)
+
+	// The subscriber sees one stream with consecutive sequence numbers
+	for i := 1; i < len(writer.headers); i++ {
+		assert.Equal(t, writer.headers[i-1].SequenceNumber+1, writer.headers[i].SequenceNumber)
+		assert.Equal(t, uint32(1111), writer.headers[i].SSRC)
+	}
+
+	assert.Error(t, downTrack.SetLayer("ultra"))
+}
+
+func TestDownTrackFollowsEstimate(t *testing.T) {
+	now := time.Now()
+	track := newTestPublishedTrack("host1", "video", webrtc.RTPCodecTypeVideo, nil)
+	track.layers = []*simulcastLayer{
+		measuredLayer("q", 150_000, now),
+		measuredLayer("f", 2_500_000, now),
+	}
+	downTrack := track.NewDownTrack("guest1")
+
+	downTrack.SetEstimate(300_000)
+	assert.Equal(t, "q", downTrack.targetLayer)
+
+	downTrack.SetEstimate(5_000_000)
+	assert.Equal(t, "f", downTrack.targetLayer)
+
+	// An explicit choice is kept regardless of the estimate
+	require.NoError(t, downTrack.SetLayer(LayerLow))
+	downTrack.SetEstimate(5_000_000)
+	assert.Equal(t, "q", downTrack.targetLayer)
+}
+
+func TestHandleSetLayer(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown()
+	room := NewRoom("test-room")
+
+	hostConn := &MockWebSocketConn{}
+	guestConn := &MockWebSocketConn{}
+	guestConn.On("WriteJSON", mock.Anything).Return(nil)
+
+	host := &Participant{ID: "host1", Role: RoleHost, Status: StatusInRoom, Conn: hostConn}
+	guest := &Participant{ID: "guest1", Role: RoleGuest, Status: StatusInRoom, Conn: guestConn}
+	room.AddParticipant(host)
+	room.AddParticipant(guest)
+
+	track := newTestPublishedTrack(host.ID, "video", webrtc.RTPCodecTypeVideo, nil)
+	host.Tracks = append(host.Tracks, track)
+	downTrack := track.NewDownTrack(guest.ID)
+	guest.subscriptions = map[*PublishedTrack]*DownTrack{track: downTrack}
+
+	server.handleSetLayer(room, guest, &Message{
+		Type: MessageTypeSetLayer,
+		Data: map[string]interface{}{"participant_id": "host1", "track_id": "video", "layer": "low"},
+	})
+	assert.Equal(t, LayerLow, downTrack.quality)
+	guestConn.AssertNotCalled(t, "WriteJSON", mock.Anything)
+
+	server.handleSetLayer(room, guest, &Message{
+		Type: MessageTypeSetLayer,
+		Data: map[string]interface{}{"participant_id": "host1", "track_id": "audio", "layer": "low"},
+	})
+	guestConn.AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(ErrorData)
+		return msg.Type == MessageTypeError && ok && data.Code == "TRACK_NOT_FOUND"
+	}))
+
+	server.handleSetLayer(room, guest, &Message{
+		Type: MessageTypeSetLayer,
+		Data: map[string]interface{}{"participant_id": "host1", "track_id": "video", "layer": "ultra"},
+	})
+	guestConn.AssertCalled(t, "WriteJSON", mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(ErrorData)
+		return msg.Type == MessageTypeError && ok && data.Code == "INVALID_LAYER"
+	}))
+}
@@ -0,0 +1,147 @@
+package signaling
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// speakerInterval is how often the dominant speaker is re-evaluated
+	speakerInterval = 300 * time.Millisecond
+	// speakerSilenceLevel is the audio level, in -dBov, from which a packet
+	// counts as silence; background noise usually stays below it
+	speakerSilenceLevel = 70
+	// speakerSmoothing is the weight of the latest interval in a
+	// participant's smoothed activity
+	speakerSmoothing = 0.3
+	// speakerMinActivity is the smoothed activity needed to take over as
+	// dominant speaker
+	speakerMinActivity = 10
+	// speakerSwitchMargin is how much louder than the current speaker a
+	// participant has to be to replace it, so short interjections and
+	// crosstalk do not flip the speaker back and forth
+	speakerSwitchMargin = 1.5
+)
+
+// speakerActivity accumulates the audio levels of one participant
+type speakerActivity struct {
+	smoothed float64
+	sum      float64
+	packets  int
+}
+
+// speakerDetector picks a room's dominant speaker from the RFC 6464 audio
+// levels of its published audio. The dominant speaker stays until someone
+// else clearly speaks louder, also through silence.
+type speakerDetector struct {
+	mutex      sync.Mutex
+	activity   map[string]*speakerActivity
+	current    string
+	lastUpdate time.Time
+}
+
+func newSpeakerDetector() *speakerDetector {
+	return &speakerDetector{activity: make(map[string]*speakerActivity)}
+}
+
+// record accounts an audio level of a participant and returns the dominant
+// speaker when it changed
+func (d *speakerDetector) record(participantID string, level uint8, now time.Time) (string, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	activity, ok := d.activity[participantID]
+	if !ok {
+		activity = &speakerActivity{}
+		d.activity[participantID] = activity
+	}
+	if level < speakerSilenceLevel {
+		activity.sum += float64(speakerSilenceLevel - level)
+	}
+	activity.packets++
+
+	if d.lastUpdate.IsZero() {
+		d.lastUpdate = now
+	}
+	if now.Sub(d.lastUpdate) < speakerInterval {
+		return "", false
+	}
+	d.lastUpdate = now
+	return d.update()
+}
+
+// update folds the interval's levels into the smoothed activities and
+// elects the dominant speaker. The caller holds the mutex.
+func (d *speakerDetector) update() (string, bool) {
+	best, bestActivity := "", 0.0
+	for participantID, activity := range d.activity {
+		var average float64
+		if activity.packets > 0 {
+			average = activity.sum / float64(activity.packets)
+		}
+		activity.smoothed += speakerSmoothing * (average - activity.smoothed)
+		activity.sum, activity.packets = 0, 0
+
+		if activity.smoothed > bestActivity || (activity.smoothed == bestActivity && participantID < best) {
+			best, bestActivity = participantID, activity.smoothed
+		}
+	}
+
+	if best == "" || best == d.current || bestActivity < speakerMinActivity {
+		return "", false
+	}
+	if current, ok := d.activity[d.current]; ok && bestActivity < current.smoothed*speakerSwitchMargin {
+		return "", false
+	}
+	d.current = best
+	return best, true
+}
+
+// remove forgets a participant that left. A departed dominant speaker is
+// replaced at the next evaluation.
+func (d *speakerDetector) remove(participantID string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.activity, participantID)
+	if d.current == participantID {
+		d.current = ""
+	}
+}
+
+// Current returns the dominant speaker, or "" when nobody spoke yet
+func (d *speakerDetector) Current() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.current
+}
+
+// audioLevelExtensionID returns the header extension ID negotiated for audio
+// levels on a receiver, or 0 when the publisher does not send them
+func audioLevelExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == sdp.AudioLevelURI {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+// audioLevel reads the level, in -dBov, from a packet's audio level
+// extension
+func audioLevel(packet *rtp.Packet, extensionID uint8) (uint8, bool) {
+	payload := packet.GetExtension(extensionID)
+	if payload == nil {
+		return 0, false
+	}
+	var extension rtp.AudioLevelExtension
+	if err := extension.Unmarshal(payload); err != nil {
+		return 0, false
+	}
+	return extension.Level, true
+}
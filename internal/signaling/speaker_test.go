@@ -0,0 +1,107 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// speak feeds 20ms audio packets with the given levels for a while and
+// returns the speakers elected on the way
+func speak(d *speakerDetector, levels map[string]uint8, start time.Time, duration time.Duration) []string {
+	var elected []string
+	for offset := time.Duration(0); offset < duration; offset += 20 * time.Millisecond {
+		for _, participantID := range []string{"host1", "guest1", "guest2"} {
+			level, ok := levels[participantID]
+			if !ok {
+				continue
+			}
+			if speaker, changed := d.record(participantID, level, start.Add(offset)); changed {
+				elected = append(elected, speaker)
+			}
+		}
+	}
+	return elected
+}
+
+func TestSpeakerDetector(t *testing.T) {
+	d := newSpeakerDetector()
+	now := time.Now()
+
+	elected := speak(d, map[string]uint8{"host1": 127, "guest1": 127}, now, time.Second)
+	assert.Empty(t, elected, "silence elects nobody")
+	assert.Empty(t, d.Current())
+
+	now = now.Add(time.Second)
+	elected = speak(d, map[string]uint8{"host1": 30, "guest1": 127}, now, time.Second)
+	assert.Equal(t, []string{"host1"}, elected)
+
+	now = now.Add(time.Second)
+	elected = speak(d, map[string]uint8{"host1": 30, "guest1": 25}, now, 2*time.Second)
+	assert.Empty(t, elected, "a slightly louder participant does not take over")
+
+	now = now.Add(2 * time.Second)
+	elected = speak(d, map[string]uint8{"host1": 127, "guest1": 30}, now, time.Second)
+	assert.Equal(t, []string{"guest1"}, elected)
+
+	now = now.Add(time.Second)
+	elected = speak(d, map[string]uint8{"host1": 127, "guest1": 127}, now, 2*time.Second)
+	assert.Empty(t, elected, "the speaker is kept through silence")
+	assert.Equal(t, "guest1", d.Current())
+
+	d.remove("guest1")
+	assert.Empty(t, d.Current())
+
+	now = now.Add(2 * time.Second)
+	elected = speak(d, map[string]uint8{"host1": 40, "guest2": 127}, now, time.Second)
+	assert.Equal(t, []string{"host1"}, elected)
+}
+
+func TestAudioLevel(t *testing.T) {
+	payload, err := rtp.AudioLevelExtension{Level: 42, Voice: true}.Marshal()
+	require.NoError(t, err)
+
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2}}
+	_, ok := audioLevel(packet, 1)
+	assert.False(t, ok)
+
+	require.NoError(t, packet.Header.SetExtension(1, payload))
+	level, ok := audioLevel(packet, 1)
+	assert.True(t, ok)
+	assert.Equal(t, uint8(42), level)
+}
+
+func TestRoomBroadcastsActiveSpeaker(t *testing.T) {
+	room := NewRoom("test-room")
+
+	hostConn := &MockWebSocketConn{}
+	guestConn := &MockWebSocketConn{}
+	hostConn.On("WriteJSON", mock.Anything).Return(nil)
+	guestConn.On("WriteJSON", mock.Anything).Return(nil)
+
+	guest := &Participant{ID: "guest1", Role: RoleGuest, Conn: guestConn}
+	room.AddParticipant(&Participant{ID: "host1", Role: RoleHost, Conn: hostConn})
+	room.AddParticipant(guest)
+	guest.Status = StatusInRoom
+
+	now := time.Now()
+	for offset := time.Duration(0); offset < time.Second; offset += 20 * time.Millisecond {
+		room.recordAudioLevel("guest1", 20, now.Add(offset))
+	}
+
+	isActiveSpeaker := mock.MatchedBy(func(msg *Message) bool {
+		data, ok := msg.Data.(ActiveSpeakerData)
+		return msg.Type == MessageTypeActiveSpeaker && ok && data.ParticipantID == "guest1"
+	})
+	hostConn.AssertCalled(t, "WriteJSON", isActiveSpeaker)
+	guestConn.AssertCalled(t, "WriteJSON", isActiveSpeaker)
+	hostConn.AssertNumberOfCalls(t, "WriteJSON", 1)
+	assert.Equal(t, "guest1", room.GetStats().ActiveSpeaker)
+
+	room.RemoveParticipant("guest1")
+	assert.Empty(t, room.GetStats().ActiveSpeaker)
+}
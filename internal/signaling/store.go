@@ -0,0 +1,119 @@
+package signaling
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRoomExists = errors.New("room already exists")
+
+// RoomPolicy holds the per-room settings chosen when the room is created
+type RoomPolicy struct {
+	// MaxParticipants caps the host plus the admitted guests; one slot is
+	// always kept for the host. Guests still knocking do not count, the
+	// server-wide waiting room limit bounds them. Zero means the server-wide
+	// limit applies.
+	MaxParticipants int `json:"max_participants,omitempty"`
+	// ScreenShareHostOnly lets only the host publish screen and screen
+	// audio tracks
+	ScreenShareHostOnly bool `json:"screen_share_host_only,omitempty"`
+	// MaxScreenShares caps the screen tracks published at the same time.
+	// Zero means no limit.
+	MaxScreenShares int `json:"max_screen_shares,omitempty"`
+	// HostAbsence decides what happens to waiting guests while the room has
+	// no host. Empty means the server-wide policy applies.
+	HostAbsence HostAbsencePolicy `json:"host_absence,omitempty"`
+}
+
+// RoomMetadata is the durable part of a room: everything that has to survive
+// a restart. Live state (participants, tracks) stays in Room.
+type RoomMetadata struct {
+	Slug           string     `json:"slug"`
+	CreatorUserID  int64      `json:"creator_user_id,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	LastActivityAt time.Time  `json:"last_activity_at"`
+	Policy         RoomPolicy `json:"policy"`
+}
+
+// RoomStore persists room metadata.
+// Get and Update return ErrRoomNotFound for unknown slugs, Create returns
+// ErrRoomExists when the slug is already taken.
+type RoomStore interface {
+	Create(meta *RoomMetadata) error
+	Get(slug string) (*RoomMetadata, error)
+	Update(meta *RoomMetadata) error
+	Delete(slug string) error
+	List() ([]*RoomMetadata, error)
+	Close() error
+}
+
+// MemoryRoomStore keeps room metadata in a map; rooms are lost on restart
+type MemoryRoomStore struct {
+	rooms map[string]RoomMetadata
+	mutex sync.RWMutex
+}
+
+func NewMemoryRoomStore() *MemoryRoomStore {
+	return &MemoryRoomStore{
+		rooms: make(map[string]RoomMetadata),
+	}
+}
+
+func (m *MemoryRoomStore) Create(meta *RoomMetadata) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.rooms[meta.Slug]; exists {
+		return ErrRoomExists
+	}
+	m.rooms[meta.Slug] = *meta
+	return nil
+}
+
+func (m *MemoryRoomStore) Get(slug string) (*RoomMetadata, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	meta, exists := m.rooms[slug]
+	if !exists {
+		return nil, ErrRoomNotFound
+	}
+	return &meta, nil
+}
+
+func (m *MemoryRoomStore) Update(meta *RoomMetadata) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.rooms[meta.Slug]; !exists {
+		return ErrRoomNotFound
+	}
+	m.rooms[meta.Slug] = *meta
+	return nil
+}
+
+func (m *MemoryRoomStore) Delete(slug string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.rooms, slug)
+	return nil
+}
+
+func (m *MemoryRoomStore) List() ([]*RoomMetadata, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	rooms := make([]*RoomMetadata, 0, len(m.rooms))
+	for _, meta := range m.rooms {
+		meta := meta
+		rooms = append(rooms, &meta)
+	}
+	return rooms, nil
+}
+
+func (m *MemoryRoomStore) Close() error {
+	return nil
+}
@@ -0,0 +1,117 @@
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var roomsBucket = []byte("rooms")
+
+// BoltRoomStore keeps room metadata in an embedded bbolt database so rooms
+// created ahead of a call survive a restart
+type BoltRoomStore struct {
+	db *bolt.DB
+}
+
+func NewBoltRoomStore(path string) (*BoltRoomStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open room store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(roomsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize room store: %w", err)
+	}
+
+	return &BoltRoomStore{db: db}, nil
+}
+
+func (b *BoltRoomStore) Create(meta *RoomMetadata) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode room %s: %w", meta.Slug, err)
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(roomsBucket)
+		if bucket.Get([]byte(meta.Slug)) != nil {
+			return ErrRoomExists
+		}
+		return bucket.Put([]byte(meta.Slug), value)
+	})
+}
+
+func (b *BoltRoomStore) Update(meta *RoomMetadata) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode room %s: %w", meta.Slug, err)
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(roomsBucket)
+		if bucket.Get([]byte(meta.Slug)) == nil {
+			return ErrRoomNotFound
+		}
+		return bucket.Put([]byte(meta.Slug), value)
+	})
+}
+
+func (b *BoltRoomStore) Get(slug string) (*RoomMetadata, error) {
+	var meta *RoomMetadata
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(roomsBucket).Get([]byte(slug))
+		if value == nil {
+			return ErrRoomNotFound
+		}
+
+		meta = &RoomMetadata{}
+		if err := json.Unmarshal(value, meta); err != nil {
+			return fmt.Errorf("failed to decode room %s: %w", slug, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func (b *BoltRoomStore) Delete(slug string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(roomsBucket).Delete([]byte(slug))
+	})
+}
+
+func (b *BoltRoomStore) List() ([]*RoomMetadata, error) {
+	var rooms []*RoomMetadata
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(roomsBucket).ForEach(func(key, value []byte) error {
+			meta := &RoomMetadata{}
+			if err := json.Unmarshal(value, meta); err != nil {
+				return fmt.Errorf("failed to decode room %s: %w", key, err)
+			}
+			rooms = append(rooms, meta)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rooms, nil
+}
+
+func (b *BoltRoomStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,70 @@
+package signaling
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testRoomStores(t *testing.T) map[string]RoomStore {
+	boltStore, err := NewBoltRoomStore(filepath.Join(t.TempDir(), "rooms.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { boltStore.Close() })
+
+	return map[string]RoomStore{
+		"memory": NewMemoryRoomStore(),
+		"bolt":   boltStore,
+	}
+}
+
+func TestRoomStore(t *testing.T) {
+	for name, store := range testRoomStores(t) {
+		t.Run(name, func(t *testing.T) {
+			createdAt := time.Now().UTC().Truncate(time.Second)
+			meta := &RoomMetadata{
+				Slug:          "abcDEF1234",
+				CreatorUserID: 123456789,
+				CreatedAt:     createdAt,
+				ExpiresAt:     createdAt.Add(24 * time.Hour),
+			}
+
+			require.NoError(t, store.Create(meta))
+			require.ErrorIs(t, store.Create(meta), ErrRoomExists)
+
+			loaded, err := store.Get(meta.Slug)
+			require.NoError(t, err)
+			require.Equal(t, meta, loaded)
+
+			rooms, err := store.List()
+			require.NoError(t, err)
+			require.Len(t, rooms, 1)
+
+			require.NoError(t, store.Delete(meta.Slug))
+			_, err = store.Get(meta.Slug)
+			require.ErrorIs(t, err, ErrRoomNotFound)
+
+			rooms, err = store.List()
+			require.NoError(t, err)
+			require.Empty(t, rooms)
+		})
+	}
+}
+
+func TestBoltRoomStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+
+	store, err := NewBoltRoomStore(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Create(&RoomMetadata{Slug: "abcDEF1234", CreatorUserID: 1}))
+	require.NoError(t, store.Close())
+
+	store, err = NewBoltRoomStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	meta, err := store.Get("abcDEF1234")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), meta.CreatorUserID)
+}
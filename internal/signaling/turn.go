@@ -0,0 +1,47 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// turnCredentials derives a TURN REST API credential pair: the username is
+// "<expiry unix time>:<participant id>" and the password is the base64
+// HMAC-SHA1 of the username keyed with the shared secret. Any relay that knows
+// the secret can verify it without talking to us.
+func turnCredentials(secret, participantID string, expiresAt time.Time) (username, credential string) {
+	username = fmt.Sprintf("%d:%s", expiresAt.Unix(), participantID)
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return username, credential
+}
+
+// iceServersFor returns the configured ICE servers plus, when TURN is
+// enabled, a relay entry with credentials minted for this participant. The
+// same list is used by the server-side PeerConnection and sent to the client
+// so both ends allocate on the same relay.
+func (s *Server) iceServersFor(participantID string, now time.Time) []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(s.config.ICEServers)+1)
+	servers = append(servers, s.config.ICEServers...)
+
+	turn := s.config.TURN
+	if len(turn.URLs) == 0 || turn.Secret == "" {
+		return servers
+	}
+
+	username, credential := turnCredentials(turn.Secret, participantID, now.Add(turn.CredentialTTL))
+	return append(servers, webrtc.ICEServer{
+		URLs:           turn.URLs,
+		Username:       username,
+		Credential:     credential,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	})
+}
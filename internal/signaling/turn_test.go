@@ -0,0 +1,96 @@
+package signaling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTurnCredentials(t *testing.T) {
+	// Reference values computed with:
+	// printf '1700000000:alice' | openssl dgst -sha1 -hmac secret -binary | base64
+	username, credential := turnCredentials("secret", "alice", time.Unix(1700000000, 0))
+	assert.Equal(t, "1700000000:alice", username)
+	assert.Equal(t, "d8soP47RbdIKLDUOpnJPVQyq5Ts=", credential)
+}
+
+func TestIceServersFor(t *testing.T) {
+	config := testConfig()
+	server, err := NewServerWithConfig(config, NewMemoryRoomStore())
+	require.NoError(t, err)
+	defer server.Shutdown()
+
+	now := time.Unix(1700000000, 0)
+	assert.Equal(t, config.ICEServers, server.iceServersFor("alice", now))
+
+	config.TURN = TURNConfig{
+		URLs:          []string{"turn:turn.example.com:3478?transport=udp", "turns:turn.example.com:5349"},
+		Secret:        "secret",
+		CredentialTTL: time.Hour,
+	}
+	server, err = NewServerWithConfig(config, NewMemoryRoomStore())
+	require.NoError(t, err)
+	defer server.Shutdown()
+
+	servers := server.iceServersFor("alice", now)
+	require.Len(t, servers, 2)
+	assert.Equal(t, config.ICEServers[0], servers[0])
+
+	relay := servers[1]
+	assert.Equal(t, config.TURN.URLs, relay.URLs)
+	assert.Equal(t, "1700003600:alice", relay.Username)
+	_, credential := turnCredentials("secret", "alice", now.Add(time.Hour))
+	assert.Equal(t, credential, relay.Credential)
+	assert.Equal(t, webrtc.ICECredentialTypePassword, relay.CredentialType)
+}
+
+func TestJoinAckCarriesIceServers(t *testing.T) {
+	config := testConfig()
+	config.TURN = TURNConfig{
+		URLs:          []string{"turn:turn.example.com:3478"},
+		Secret:        "secret",
+		CredentialTTL: time.Hour,
+	}
+	server, err := NewServerWithConfig(config, NewMemoryRoomStore())
+	require.NoError(t, err)
+	defer server.Shutdown()
+
+	room, err := server.CreateRoom(42, time.Hour, RoomPolicy{})
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws/" + room.Slug + "?token=" +
+		signTestToken(t, room.Slug, RoleHost, time.Hour)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteJSON(Message{
+		Type: MessageTypeJoin,
+		Data: map[string]interface{}{},
+	}))
+
+	var ack struct {
+		Type MessageType `json:"type"`
+		Data JoinAckData `json:"data"`
+	}
+	require.NoError(t, conn.ReadJSON(&ack))
+	require.Equal(t, MessageTypeJoin, ack.Type)
+	require.NotEmpty(t, ack.Data.ParticipantID)
+	assert.True(t, ack.Data.Polite)
+	require.Len(t, ack.Data.ICEServers, 2)
+
+	relay := ack.Data.ICEServers[1]
+	assert.Equal(t, []string{"turn:turn.example.com:3478"}, relay.URLs)
+	assert.True(t, strings.HasSuffix(relay.Username, ":"+ack.Data.ParticipantID))
+	assert.NotEmpty(t, relay.Credential)
+}
@@ -12,19 +12,56 @@ const (
 	RoleHost  ParticipantRole = "host"
 	RoleGuest ParticipantRole = "guest"
 
-	MessageTypeJoin         MessageType = "join"
-	MessageTypeLeave        MessageType = "leave"
-	MessageTypeKnock        MessageType = "knock"
-	MessageTypeAllow        MessageType = "allow"
-	MessageTypeDeny         MessageType = "deny"
-	MessageTypeOffer        MessageType = "offer"
-	MessageTypeAnswer       MessageType = "answer"
-	MessageTypeICECandidate MessageType = "ice_candidate"
-	MessageTypeParticipants MessageType = "participants"
-	MessageTypeError        MessageType = "error"
-	MessageTypeKeyExchange  MessageType = "key_exchange"
-	MessageTypePublicKeys   MessageType = "public_keys"
-	MessageTypeEncrypted    MessageType = "encrypted_data"
+	MessageTypeJoin            MessageType = "join"
+	MessageTypeLeave           MessageType = "leave"
+	MessageTypeKnock           MessageType = "knock"
+	MessageTypeAllow           MessageType = "allow"
+	MessageTypeDeny            MessageType = "deny"
+	MessageTypeOffer           MessageType = "offer"
+	MessageTypeAnswer          MessageType = "answer"
+	MessageTypeICECandidate    MessageType = "ice_candidate"
+	MessageTypeParticipants    MessageType = "participants"
+	MessageTypeError           MessageType = "error"
+	MessageTypeKeyExchange     MessageType = "key_exchange"
+	MessageTypePublicKeys      MessageType = "public_keys"
+	MessageTypeEncrypted       MessageType = "encrypted_data"
+	MessageTypeRoomExpired     MessageType = "room_expired"
+	MessageTypeTrackRemoved    MessageType = "track_removed"
+	MessageTypeSetLayer        MessageType = "set_layer"
+	MessageTypeActiveSpeaker   MessageType = "active_speaker"
+	MessageTypeTrackSource     MessageType = "track_source"
+	MessageTypeTracks          MessageType = "tracks"
+	MessageTypeSubscribe       MessageType = "subscribe"
+	MessageTypeUnsubscribe     MessageType = "unsubscribe"
+	MessageTypeKick            MessageType = "kick"
+	MessageTypeMute            MessageType = "mute"
+	MessageTypeLockRoom        MessageType = "lock_room"
+	MessageTypeTransferHost    MessageType = "transfer_host"
+	MessageTypeHostStatus      MessageType = "host_status"
+	MessageTypeConnectionState MessageType = "connection_state"
+
+	// MediaProfileFull publishes and receives audio and video
+	MediaProfileFull MediaProfile = "full"
+	// MediaProfileAudioOnly publishes and receives audio only, for poor links
+	MediaProfileAudioOnly MediaProfile = "audio_only"
+	// MediaProfileReceiveOnly receives everything and publishes nothing
+	MediaProfileReceiveOnly MediaProfile = "receive_only"
+
+	TrackSourceCamera      TrackSource = "camera"
+	TrackSourceMicrophone  TrackSource = "microphone"
+	TrackSourceScreen      TrackSource = "screen"
+	TrackSourceScreenAudio TrackSource = "screen_audio"
+
+	// HostAbsenceHold keeps waiting guests knocking until a host lets them in
+	HostAbsenceHold HostAbsencePolicy = "hold"
+	// HostAbsenceAutoAdmit lets guests in without a host
+	HostAbsenceAutoAdmit HostAbsencePolicy = "auto_admit"
+	// HostAbsenceReject turns guests away until a host is back
+	HostAbsenceReject HostAbsencePolicy = "reject"
+
+	HostStatusAway     HostStatus = "away"
+	HostStatusReturned HostStatus = "returned"
+	HostStatusAbsent   HostStatus = "absent"
 
 	StatusConnected    ParticipantStatus = "connected"
 	StatusKnocking     ParticipantStatus = "knocking"
@@ -37,25 +74,75 @@ type ParticipantKeys struct {
 }
 
 type Participant struct {
-	ID       string                        `json:"id"`
-	Conn     WebSocketConnInterface        `json:"-"`
-	Role     ParticipantRole               `json:"role"`
-	Status   ParticipantStatus             `json:"status"`
-	Name     string                        `json:"name,omitempty"`
-	Keys     ParticipantKeys               `json:"keys,omitempty"`
-	JoinedAt time.Time                     `json:"joined_at"`
-	PC       *webrtc.PeerConnection        `json:"-"`
-	Tracks   []*webrtc.TrackLocalStaticRTP `json:"-"`
+	ID       string                 `json:"id"`
+	Conn     WebSocketConnInterface `json:"-"`
+	Role     ParticipantRole        `json:"role"`
+	Status   ParticipantStatus      `json:"status"`
+	Name     string                 `json:"name,omitempty"`
+	Keys     ParticipantKeys        `json:"keys,omitempty"`
+	JoinedAt time.Time              `json:"joined_at"`
+	Profile  MediaProfile           `json:"media_profile,omitempty"`
+	PC       *webrtc.PeerConnection `json:"-"`
+	Tracks   []*PublishedTrack      `json:"-"`
+	// ICEServers is shared by the server-side PeerConnection and the client
+	ICEServers []webrtc.ICEServer `json:"-"`
+	negotiator *negotiator
+
+	// mediaMutex guards Tracks, the maps below and mediaClosed
+	mediaMutex  sync.Mutex
+	mediaClosed bool
+	// subscriptions forward other participants' tracks to this one
+	subscriptions map[*PublishedTrack]*DownTrack
+	// pendingKeyframes are requested once the next negotiation completes
+	pendingKeyframes []*DownTrack
+	// announcedSources holds track_source announcements, by track ID, for
+	// tracks that have not arrived yet
+	announcedSources map[string]TrackSource
+	// manualSubscribe turns off automatic subscription to every track in
+	// the room; only tracks subscribed to explicitly are received
+	manualSubscribe bool
+	// subscribed holds explicit subscribe (true) and unsubscribe (false)
+	// choices by publisher and track ID, surviving until the track appears
+	subscribed map[string]bool
+	// muted holds the kinds of media the host stopped forwarding from this
+	// participant, including tracks it publishes later
+	muted map[webrtc.RTPCodecType]bool
+	// tokenID identifies the token the participant joined with; a new
+	// session with the same identity takes over the host seat
+	tokenID string
+	// session is the participant's Conn when it can be resumed
+	session *session
+	// replaced is set, under the room mutex, once a new session of the same
+	// identity took this participant's place
+	replaced bool
+	// lastAllocation throttles bandwidth allocation over subscriptions
+	lastAllocation time.Time
+	// forwarders counts the goroutines copying this participant's tracks
+	// and reading RTCP from its senders
+	forwarders sync.WaitGroup
 }
 
 type Room struct {
-	Slug       string                        `json:"slug"`
-	Host       *Participant                  `json:"host,omitempty"`
-	Guests     map[string]*Participant       `json:"guests"`
-	PublicKeys map[string]string             `json:"public_keys"`
-	Tracks     []*webrtc.TrackLocalStaticRTP `json:"-"`
-	CreatedAt  time.Time                     `json:"created_at"`
-	mutex      sync.RWMutex
+	Slug           string                  `json:"slug"`
+	CreatorUserID  int64                   `json:"creator_user_id,omitempty"`
+	Host           *Participant            `json:"host,omitempty"`
+	Guests         map[string]*Participant `json:"guests"`
+	PublicKeys     map[string]string       `json:"public_keys"`
+	Tracks         []*PublishedTrack       `json:"-"`
+	CreatedAt      time.Time               `json:"created_at"`
+	ExpiresAt      time.Time               `json:"expires_at"`
+	LastActivityAt time.Time               `json:"last_activity_at"`
+	Policy         RoomPolicy              `json:"policy"`
+	Locked         bool                    `json:"locked"` // rejects joining guests
+	speakers       *speakerDetector
+	// hostAway holds the seat of a host who dropped out until its grace
+	// period ends
+	hostAway *hostAbsence
+	// maxKnocking bounds the guests waiting to be let in; 0 is unlimited
+	maxKnocking int
+	// joining counts participants setting up their media before admission
+	joining int
+	mutex   sync.RWMutex
 }
 
 type KeyExchangeData struct {
@@ -78,6 +165,80 @@ type ParticipantRole string
 
 type ParticipantStatus string
 
+// TrackSource is what a published track captures, as announced by its
+// publisher
+type TrackSource string
+
+func validTrackSource(source TrackSource) bool {
+	switch source {
+	case TrackSourceCamera, TrackSourceMicrophone, TrackSourceScreen, TrackSourceScreenAudio:
+		return true
+	}
+	return false
+}
+
+// defaultTrackSource is assumed for tracks published without an
+// announcement
+func defaultTrackSource(kind webrtc.RTPCodecType) TrackSource {
+	if kind == webrtc.RTPCodecTypeVideo {
+		return TrackSourceCamera
+	}
+	return TrackSourceMicrophone
+}
+
+// isScreenShare reports whether a source falls under the screen share policy
+func (s TrackSource) isScreenShare() bool {
+	return s == TrackSourceScreen || s == TrackSourceScreenAudio
+}
+
+// MediaProfile is the media a participant declared it sends and receives
+// when joining
+type MediaProfile string
+
+// parseMediaProfile validates a profile from a join message; an empty one
+// is MediaProfileFull
+func parseMediaProfile(profile string) (MediaProfile, bool) {
+	switch MediaProfile(profile) {
+	case "", MediaProfileFull:
+		return MediaProfileFull, true
+	case MediaProfileAudioOnly, MediaProfileReceiveOnly:
+		return MediaProfile(profile), true
+	}
+	return "", false
+}
+
+// publishes reports whether the profile allows sending media of kind
+func (m MediaProfile) publishes(kind webrtc.RTPCodecType) bool {
+	switch m {
+	case MediaProfileAudioOnly:
+		return kind == webrtc.RTPCodecTypeAudio
+	case MediaProfileReceiveOnly:
+		return false
+	}
+	return true
+}
+
+// receives reports whether the profile wants media of kind forwarded
+func (m MediaProfile) receives(kind webrtc.RTPCodecType) bool {
+	return m != MediaProfileAudioOnly || kind == webrtc.RTPCodecTypeAudio
+}
+
+// HostAbsencePolicy decides what happens to guests waiting to be let in
+// while the room has no host
+type HostAbsencePolicy string
+
+func validHostAbsencePolicy(policy HostAbsencePolicy) bool {
+	switch policy {
+	case HostAbsenceHold, HostAbsenceAutoAdmit, HostAbsenceReject:
+		return true
+	}
+	return false
+}
+
+// HostStatus tells the room whether its host dropped out, came back, or is
+// gone for good
+type HostStatus string
+
 type WebSocketConnInterface interface {
 	WriteJSON(v interface{}) error
 	ReadJSON(v interface{}) error
@@ -86,14 +247,40 @@ type WebSocketConnInterface interface {
 	WriteMessage(messageType int, data []byte) error
 }
 
+// WebSocketConnWrapper serializes writes: gorilla/websocket supports only one
+// concurrent writer, while pion callbacks and the room janitor write from
+// their own goroutines.
 type WebSocketConnWrapper struct {
 	*websocket.Conn
+	writeMutex sync.Mutex
 }
 
 func NewWebSocketConnWrapper(conn *websocket.Conn) *WebSocketConnWrapper {
 	return &WebSocketConnWrapper{Conn: conn}
 }
 
+func (w *WebSocketConnWrapper) WriteJSON(v interface{}) error {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+
+	return w.Conn.WriteJSON(v)
+}
+
+func (w *WebSocketConnWrapper) WriteMessage(messageType int, data []byte) error {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+
+	return w.Conn.WriteMessage(messageType, data)
+}
+
+// SetWriteDeadline is serialized with writes, which read the deadline
+func (w *WebSocketConnWrapper) SetWriteDeadline(t time.Time) error {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+
+	return w.Conn.SetWriteDeadline(t)
+}
+
 type Message struct {
 	Type      MessageType `json:"type"`
 	From      string      `json:"from,omitempty"`
@@ -101,11 +288,41 @@ type Message struct {
 	RoomID    string      `json:"room_id,omitempty"`
 	Data      interface{} `json:"data,omitempty"`
 	Timestamp time.Time   `json:"timestamp"`
+	// Seq numbers the messages the server sends to a participant, for
+	// resuming its session
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 type JoinData struct {
-	Name string          `json:"name"`
-	Role ParticipantRole `json:"role"`
+	Name    string          `json:"name"`
+	Role    ParticipantRole `json:"role"`
+	Profile MediaProfile    `json:"media_profile,omitempty"`
+	// Token is the access token, unless the WebSocket request carried it
+	Token string `json:"token,omitempty"`
+	// ResumeToken and LastSeq pick up a session that dropped
+	ResumeToken string `json:"resume_token,omitempty"`
+	LastSeq     uint64 `json:"last_seq,omitempty"`
+	// AutoSubscribe set to false leaves subscribing to tracks to the client
+	AutoSubscribe *bool `json:"auto_subscribe,omitempty"`
+}
+
+// JoinAckData confirms a join and hands the client the ICE servers, including
+// ephemeral TURN credentials, to configure its RTCPeerConnection with
+type JoinAckData struct {
+	ParticipantID string             `json:"participant_id"`
+	ICEServers    []webrtc.ICEServer `json:"ice_servers"`
+	// Polite is the perfect negotiation role the client has to play; the
+	// server never rolls back its own offers
+	Polite bool `json:"polite"`
+	// Profile is the media profile the server applies to the participant
+	Profile MediaProfile `json:"media_profile"`
+	// AutoSubscribe tells whether every track in the room is forwarded
+	// without an explicit subscribe
+	AutoSubscribe bool `json:"auto_subscribe"`
+	// ResumeToken resumes the session after a dropped connection
+	ResumeToken string `json:"resume_token,omitempty"`
+	// Resumed acknowledges a resumed session; missed messages follow
+	Resumed bool `json:"resumed,omitempty"`
 }
 
 type ParticipantsData struct {
@@ -114,6 +331,143 @@ type ParticipantsData struct {
 	Count  int                     `json:"count"`
 }
 
+// RoomStats is a point-in-time snapshot of a room's live state
+type RoomStats struct {
+	Slug            string    `json:"slug"`
+	InRoomCount     int       `json:"in_room_count"`
+	MaxParticipants int       `json:"max_participants,omitempty"`
+	KnockingCount   int       `json:"knocking_count"`
+	GuestsCount     int       `json:"guests_count"`
+	HasHost         bool      `json:"has_host"`
+	CreatedAt       time.Time `json:"created_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	LastActivityAt  time.Time `json:"last_activity_at"`
+	Expired         bool      `json:"expired"`
+	// PublicKeys holds the participants' public keys by participant ID
+	PublicKeys map[string]string `json:"public_keys"`
+	// Retransmissions sums the NACK handling of every published track
+	Retransmissions RetransmissionStats `json:"retransmissions"`
+	// ActiveSpeaker is the current dominant speaker, if anyone spoke yet
+	ActiveSpeaker string `json:"active_speaker,omitempty"`
+	Locked        bool   `json:"locked"`
+	// HostReturnBy is when the seat of a host who dropped out is given up
+	HostReturnBy time.Time `json:"host_return_by,omitzero"`
+}
+
+// RetransmissionStats counts packets requested from publishers (upstream)
+// and resent to subscribers from the SFU's buffers (downstream)
+type RetransmissionStats struct {
+	NACKsSent             uint64 `json:"nacks_sent"`
+	PacketsNACKed         uint64 `json:"packets_nacked"`
+	PacketsRecovered      uint64 `json:"packets_recovered"`
+	PacketsRequested      uint64 `json:"packets_requested"`
+	PacketsRetransmitted  uint64 `json:"packets_retransmitted"`
+	RetransmissionsMissed uint64 `json:"retransmissions_missed"`
+}
+
+func (s *RetransmissionStats) add(other RetransmissionStats) {
+	s.NACKsSent += other.NACKsSent
+	s.PacketsNACKed += other.PacketsNACKed
+	s.PacketsRecovered += other.PacketsRecovered
+	s.PacketsRequested += other.PacketsRequested
+	s.PacketsRetransmitted += other.PacketsRetransmitted
+	s.RetransmissionsMissed += other.RetransmissionsMissed
+}
+
+type RoomExpiredData struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TrackRemovedData tells a client that a forwarded track is gone
+type TrackRemovedData struct {
+	ParticipantID string `json:"participant_id"`
+	TrackID       string `json:"track_id"`
+	StreamID      string `json:"stream_id"`
+	Kind          string `json:"kind"`
+}
+
+// SetLayerData selects the simulcast layer a subscriber receives of
+// another participant's track
+type SetLayerData struct {
+	ParticipantID string `json:"participant_id"`
+	TrackID       string `json:"track_id"`
+	Layer         string `json:"layer"`
+}
+
+// ActiveSpeakerData announces a new dominant speaker in the room
+type ActiveSpeakerData struct {
+	ParticipantID string `json:"participant_id"`
+}
+
+// TrackSourceData announces the source of a track the sender publishes,
+// before or after the track arrives
+type TrackSourceData struct {
+	TrackID string      `json:"track_id"`
+	Source  TrackSource `json:"source"`
+}
+
+// TrackInfo describes a track published in the room. TrackID and StreamID
+// match the msid of the forwarded track in the server's offers.
+type TrackInfo struct {
+	ParticipantID string      `json:"participant_id"`
+	TrackID       string      `json:"track_id"`
+	StreamID      string      `json:"stream_id"`
+	Kind          string      `json:"kind"`
+	Source        TrackSource `json:"source"`
+	// Muted is set while the host stops the track from being forwarded
+	Muted bool `json:"muted"`
+}
+
+// TracksData lists every track published in the room
+type TracksData struct {
+	Tracks []TrackInfo `json:"tracks"`
+}
+
+// TrackRef names a track by its publisher and track ID
+type TrackRef struct {
+	ParticipantID string `json:"participant_id"`
+	TrackID       string `json:"track_id"`
+}
+
+// SubscriptionData lists the tracks a subscribe or unsubscribe applies to
+type SubscriptionData struct {
+	Tracks []TrackRef `json:"tracks"`
+}
+
+// ModerationTargetData names the participant a kick or transfer_host
+// applies to
+type ModerationTargetData struct {
+	ParticipantID string `json:"participant_id"`
+}
+
+// MuteData stops (Muted) or restarts forwarding a participant's audio,
+// video, or both when Kind is empty
+type MuteData struct {
+	ParticipantID string `json:"participant_id"`
+	Kind          string `json:"kind,omitempty"`
+	Muted         bool   `json:"muted"`
+}
+
+// LockRoomData locks or unlocks the room for joining guests
+type LockRoomData struct {
+	Locked bool `json:"locked"`
+}
+
+// HostStatusData tells the room about its host dropping out (away, until
+// ReturnBy), reclaiming the room (returned) or not coming back (absent)
+type HostStatusData struct {
+	ParticipantID string     `json:"participant_id,omitempty"`
+	Status        HostStatus `json:"status"`
+	ReturnBy      time.Time  `json:"return_by,omitzero"`
+}
+
+// ConnectionStateData reports a change in the state of a participant's
+// media connection to the SFU
+type ConnectionStateData struct {
+	ParticipantID string `json:"participant_id"`
+	State         string `json:"state"`
+}
+
 type ErrorData struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
@@ -0,0 +1,274 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// ICENetworkConfig controls how server-side peer connections gather local
+// candidates. The zero value keeps pion's defaults: a random UDP port per
+// connection on every interface and no ICE-TCP.
+type ICENetworkConfig struct {
+	// UDPMuxPort serves all peer connections from a single UDP port
+	UDPMuxPort int
+	// TCPMuxPort enables ICE-TCP on a single TCP port, bound on the same
+	// interfaces as UDP
+	TCPMuxPort int
+	// NAT1To1IPs replace host candidate addresses, e.g. the public IP of a
+	// node behind Docker or Kubernetes networking
+	NAT1To1IPs []string
+	// PortMin and PortMax bound the ephemeral UDP ports when no mux is used
+	PortMin uint16
+	PortMax uint16
+	// Interfaces restricts gathering to these interface names
+	Interfaces []string
+}
+
+// BandwidthEstimationConfig bounds the congestion controller run for each
+// peer connection. Bitrates are in bits per second.
+type BandwidthEstimationConfig struct {
+	InitialBitrate int
+	MinBitrate     int
+	MaxBitrate     int
+}
+
+// DefaultBandwidthEstimationConfig starts subscribers at 1 Mbps
+func DefaultBandwidthEstimationConfig() BandwidthEstimationConfig {
+	return BandwidthEstimationConfig{
+		InitialBitrate: 1_000_000,
+		MinBitrate:     100_000,
+		MaxBitrate:     10_000_000,
+	}
+}
+
+// WebRTCAPI is the webrtc.API shared by all peer connections together with
+// the sockets it owns
+type WebRTCAPI struct {
+	*webrtc.API
+	closers []io.Closer
+
+	// estimatorMutex serializes peer connection creation, so the estimator
+	// handed out by the congestion control interceptor can be matched with
+	// its connection
+	estimatorMutex sync.Mutex
+	estimator      cc.BandwidthEstimator
+}
+
+// NewWebRTCAPI builds the shared API from a SettingEngine and an interceptor
+// chain with RTCP reports, TWCC and send-side bandwidth estimation (GCC). Mux
+// sockets are bound here, so a busy port fails at startup rather than on the
+// first join.
+func NewWebRTCAPI(network ICENetworkConfig, bandwidth BandwidthEstimationConfig) (*WebRTCAPI, error) {
+	api := &WebRTCAPI{}
+	settings := webrtc.SettingEngine{}
+
+	var interfaceFilter func(string) bool
+	if len(network.Interfaces) > 0 {
+		interfaceFilter = func(name string) bool {
+			return slices.Contains(network.Interfaces, name)
+		}
+		settings.SetInterfaceFilter(interfaceFilter)
+	}
+
+	if len(network.NAT1To1IPs) > 0 {
+		settings.SetNAT1To1IPs(network.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	if network.PortMin != 0 || network.PortMax != 0 {
+		if err := settings.SetEphemeralUDPPortRange(network.PortMin, network.PortMax); err != nil {
+			return nil, fmt.Errorf("invalid ICE port range: %w", err)
+		}
+	}
+
+	if network.UDPMuxPort != 0 {
+		var options []ice.UDPMuxFromPortOption
+		if interfaceFilter != nil {
+			options = append(options, ice.UDPMuxFromPortWithInterfaceFilter(interfaceFilter))
+		}
+		udpMux, err := ice.NewMultiUDPMuxFromPort(network.UDPMuxPort, options...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for ICE on udp port %d: %w", network.UDPMuxPort, err)
+		}
+		settings.SetICEUDPMux(udpMux)
+		api.closers = append(api.closers, udpMux)
+	}
+
+	if network.TCPMuxPort != 0 {
+		tcpMux, err := listenTCPMux(network.TCPMuxPort, network.Interfaces)
+		if err != nil {
+			api.Close()
+			return nil, fmt.Errorf("failed to listen for ICE on tcp port %d: %w", network.TCPMuxPort, err)
+		}
+		settings.SetICETCPMux(tcpMux)
+		settings.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4,
+			webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4,
+			webrtc.NetworkTypeTCP6,
+		})
+		api.closers = append(api.closers, tcpMux)
+	}
+
+	mediaEngine := &webrtc.MediaEngine{}
+	registry := &interceptor.Registry{}
+	if err := api.configureInterceptors(mediaEngine, registry, bandwidth); err != nil {
+		api.Close()
+		return nil, err
+	}
+
+	api.API = webrtc.NewAPI(
+		webrtc.WithSettingEngine(settings),
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+	)
+	return api, nil
+}
+
+// listenTCPMux binds port on every address of the named interfaces, or on
+// all addresses without a filter. Like the UDP mux and candidate gathering,
+// it leaves out loopback and interfaces that are down.
+func listenTCPMux(port int, interfaces []string) (ice.TCPMux, error) {
+	if len(interfaces) == 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			return nil, err
+		}
+		return webrtc.NewICETCPMux(nil, listener, 8), nil
+	}
+
+	var addrs []*net.TCPAddr
+	for _, name := range interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil || iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range ifaceAddrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() {
+				continue
+			}
+			tcpAddr := &net.TCPAddr{IP: ipNet.IP, Port: port}
+			if ipNet.IP.IsLinkLocalUnicast() && ipNet.IP.To4() == nil {
+				tcpAddr.Zone = iface.Name
+			}
+			addrs = append(addrs, tcpAddr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses on interfaces %s", strings.Join(interfaces, ", "))
+	}
+
+	muxes := make([]ice.TCPMux, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			for _, mux := range muxes {
+				mux.Close()
+			}
+			return nil, err
+		}
+		muxes = append(muxes, webrtc.NewICETCPMux(nil, listener, 8))
+	}
+	return ice.NewMultiTCPMuxDefault(muxes...), nil
+}
+
+func (a *WebRTCAPI) configureInterceptors(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry, bandwidth BandwidthEstimationConfig) error {
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return fmt.Errorf("failed to register codecs: %w", err)
+	}
+
+	// Publishers tag their audio with its level for active speaker
+	// detection
+	if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return fmt.Errorf("failed to register audio level extension: %w", err)
+	}
+
+	// Media is forwarded as it arrives; congestion is handled by picking
+	// layers and pausing video, not by queueing in a pacer
+	congestion, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(bandwidth.InitialBitrate),
+			gcc.SendSideBWEMinBitrate(bandwidth.MinBitrate),
+			gcc.SendSideBWEMaxBitrate(bandwidth.MaxBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create congestion controller: %w", err)
+	}
+	congestion.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		a.estimator = estimator
+	})
+	registry.Add(congestion)
+
+	// Outgoing packets carry transport-wide sequence numbers, so subscribers
+	// send the TWCC feedback the estimator runs on
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry); err != nil {
+		return fmt.Errorf("failed to configure TWCC: %w", err)
+	}
+
+	// Lost packets are requested from publishers and retransmitted to
+	// subscribers by the SFU itself, from its per-track buffers, so only
+	// the feedback types are negotiated here
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+
+	// RTCP sender and receiver reports, simulcast RID extensions, stats and
+	// TWCC feedback for published media
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return fmt.Errorf("failed to configure RTCP reports: %w", err)
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return fmt.Errorf("failed to configure simulcast: %w", err)
+	}
+	if err := webrtc.ConfigureStatsInterceptor(registry); err != nil {
+		return fmt.Errorf("failed to configure stats: %w", err)
+	}
+	if err := webrtc.ConfigureTWCCSender(mediaEngine, registry); err != nil {
+		return fmt.Errorf("failed to configure TWCC feedback: %w", err)
+	}
+	return nil
+}
+
+// NewPeerConnectionWithEstimator creates a peer connection and returns the
+// bandwidth estimator of its outgoing media
+func (a *WebRTCAPI) NewPeerConnectionWithEstimator(configuration webrtc.Configuration) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	a.estimatorMutex.Lock()
+	defer a.estimatorMutex.Unlock()
+
+	a.estimator = nil
+	pc, err := a.API.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc, a.estimator, nil
+}
+
+// Close releases the mux sockets. Peer connections created from the API
+// must be closed first.
+func (a *WebRTCAPI) Close() error {
+	var errs []error
+	for _, closer := range a.closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	a.closers = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,130 @@
+package signaling
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// gatherHostCandidates returns the candidate lines of a data-channel-only offer
+func gatherHostCandidates(t *testing.T, api *webrtc.API) []string {
+	t.Helper()
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	_, err = pc.CreateDataChannel("probe", nil)
+	require.NoError(t, err)
+
+	offer, err := pc.CreateOffer(nil)
+	require.NoError(t, err)
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+	require.NoError(t, pc.SetLocalDescription(offer))
+	<-gathered
+
+	var candidates []string
+	for _, line := range strings.Split(pc.LocalDescription().SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidates = append(candidates, line)
+		}
+	}
+	return candidates
+}
+
+func TestNewWebRTCAPIDefaults(t *testing.T) {
+	api, err := NewWebRTCAPI(ICENetworkConfig{}, DefaultBandwidthEstimationConfig())
+	require.NoError(t, err)
+	defer api.Close()
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	assert.NoError(t, pc.Close())
+}
+
+func TestNewWebRTCAPITCPMuxInterfaces(t *testing.T) {
+	// Any interface with an IPv4 address other than loopback
+	var name, ip string
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				name, ip = iface.Name, ipNet.IP.String()
+			}
+		}
+	}
+	if name == "" {
+		t.Skip("no network interface besides loopback")
+	}
+
+	port := freeTCPPort(t)
+	api, err := NewWebRTCAPI(ICENetworkConfig{TCPMuxPort: port, Interfaces: []string{name}}, DefaultBandwidthEstimationConfig())
+	require.NoError(t, err)
+	defer api.Close()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	require.NoError(t, err)
+	conn.Close()
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	assert.Error(t, err, "loopback is not among the interfaces")
+
+	_, err = NewWebRTCAPI(ICENetworkConfig{TCPMuxPort: port, Interfaces: []string{"no-such-interface"}}, DefaultBandwidthEstimationConfig())
+	assert.Error(t, err)
+}
+
+func TestNewWebRTCAPIInvalidPortRange(t *testing.T) {
+	_, err := NewWebRTCAPI(ICENetworkConfig{PortMin: 50100, PortMax: 50000}, DefaultBandwidthEstimationConfig())
+	assert.Error(t, err)
+}
+
+func TestNewWebRTCAPIMuxAndNAT1To1(t *testing.T) {
+	port := freeTCPPort(t)
+
+	api, err := NewWebRTCAPI(ICENetworkConfig{
+		UDPMuxPort: port,
+		TCPMuxPort: port,
+		NAT1To1IPs: []string{"203.0.113.7"},
+	}, DefaultBandwidthEstimationConfig())
+	require.NoError(t, err)
+	defer api.Close()
+
+	mapped := 0
+	for _, candidate := range gatherHostCandidates(t, api.API) {
+		fields := strings.Fields(candidate)
+		require.GreaterOrEqual(t, len(fields), 6)
+		if strings.Contains(fields[4], ":") {
+			continue // the 1:1 mapping only covers IPv4
+		}
+		assert.Equal(t, "203.0.113.7", fields[4], candidate)
+		mapped++
+		if strings.EqualFold(fields[2], "udp") {
+			assert.Equal(t, strconv.Itoa(port), fields[5], candidate)
+		}
+	}
+	assert.NotZero(t, mapped)
+
+	// The mux ports are taken until the API is closed
+	_, err = NewWebRTCAPI(ICENetworkConfig{TCPMuxPort: port}, DefaultBandwidthEstimationConfig())
+	assert.Error(t, err)
+}
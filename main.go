@@ -6,13 +6,18 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/Kaamos-Comms/server/internal/app"
+	"github.com/Kaamos-Comms/server/internal/config"
 )
 
 func main() {
-	a := app.Initialize()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	a := app.Initialize(cfg)
 	a.Start()
 
 	quit := make(chan os.Signal, 1)
@@ -21,7 +26,7 @@ func main() {
 
 	log.Println("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer cancel()
 
 	if err := a.Shutdown(ctx); err != nil {